@@ -1,10 +1,13 @@
 package re2
 
 import (
+	"errors"
 	"reflect"
+	"regexp"
 	"regexp/syntax"
 	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 var goodRe = []string{
@@ -44,6 +47,11 @@ var badRe = []stringError{
 	{`a**`, "invalid nested repetition operator: `**`"},
 	{`a*+`, "invalid nested repetition operator: `*+`"},
 	{`\x`, "invalid escape sequence: `\\x`"},
+	{`a{1001}`, "invalid repeat count: `{1001}`"},
+	{`x{1001,}`, "invalid repeat count: `{1001,}`"},
+	{`a{2,1}`, "invalid repeat count: `{2,1}`"},
+	{`(foo)(bar`, "missing closing ): `(foo)(bar`"},
+	{`(foo))`, "unexpected ): `(foo))`"},
 	// TODO(anuraaga): This test passes with Go but does not complete in a practical time with wasm.
 	// {strings.Repeat(`\pL`, 27000), "expression too large"},
 }
@@ -73,6 +81,70 @@ func TestBadCompile(t *testing.T) {
 	}
 }
 
+func TestMustCompilePanic(t *testing.T) {
+	for _, tc := range badRe {
+		func() {
+			defer func() {
+				r := recover()
+				if r == nil {
+					t.Errorf("MustCompile(%q) did not panic", tc.re)
+					return
+				}
+				msg, ok := r.(string)
+				if !ok {
+					t.Errorf("MustCompile(%q) panicked with %T, want string", tc.re, r)
+					return
+				}
+				if want := "regexp: Compile(" + quote(tc.re) + "): "; !strings.HasPrefix(msg, want) {
+					t.Errorf("MustCompile(%q) panic = %q; want prefix %q", tc.re, msg, want)
+				}
+				if !strings.Contains(msg, tc.err) {
+					t.Errorf("MustCompile(%q) panic = %q; want %q", tc.re, msg, tc.err)
+				}
+			}()
+			MustCompile(tc.re)
+		}()
+	}
+}
+
+func TestMustCompileWithPanic(t *testing.T) {
+	tests := []struct {
+		re   string
+		opts Options
+		err  string
+	}{
+		{`a(`, Options{CaseInsensitive: true}, "missing closing )"},
+		{`a`, Options{DotNL: true, NeverNL: true}, "DotNL and NeverNL are mutually exclusive"},
+	}
+	for _, tc := range tests {
+		func() {
+			defer func() {
+				r := recover()
+				if r == nil {
+					t.Errorf("MustCompileWith(%q, %+v) did not panic", tc.re, tc.opts)
+					return
+				}
+				msg, ok := r.(string)
+				if !ok {
+					t.Errorf("MustCompileWith(%q, %+v) panicked with %T, want string", tc.re, tc.opts, r)
+					return
+				}
+				if want := "regexp: CompileWith(" + quote(tc.re) + "): "; !strings.HasPrefix(msg, want) {
+					t.Errorf("MustCompileWith(%q, %+v) panic = %q; want prefix %q", tc.re, tc.opts, msg, want)
+				}
+				if !strings.Contains(msg, tc.err) {
+					t.Errorf("MustCompileWith(%q, %+v) panic = %q; want %q", tc.re, tc.opts, msg, tc.err)
+				}
+			}()
+			MustCompileWith(tc.re, tc.opts)
+		}()
+	}
+
+	if re := MustCompileWith(`ABC`, Options{CaseInsensitive: true}); !re.MatchString("abc") {
+		t.Errorf("MustCompileWith(%q, CaseInsensitive).MatchString(%q) = false; want true", `ABC`, "abc")
+	}
+}
+
 func matchTest(t *testing.T, test *FindTest) {
 	re := compileTest(t, test.pat, "")
 	if re == nil {
@@ -263,6 +335,107 @@ func TestReplaceAll(t *testing.T) {
 			t.Errorf("%q.ReplaceAll(%q,%q) = %q; want %q",
 				tc.pattern, tc.input, tc.replacement, actual, tc.output)
 		}
+		actual = string(re.AppendReplaceAll(nil, []byte(tc.input), []byte(tc.replacement)))
+		if actual != tc.output {
+			t.Errorf("%q.AppendReplaceAll(nil,%q,%q) = %q; want %q",
+				tc.pattern, tc.input, tc.replacement, actual, tc.output)
+		}
+	}
+}
+
+// replaceStdlibPatterns and replaceStdlibTemplates form a matrix of cases compared against
+// the standard library, covering template syntax that re2's rewrite strings do not share.
+var replaceStdlibPatterns = []string{
+	`(a)(b)?`,
+	`(?P<x>a)(?P<y>b)?`,
+	`a*`,
+	`(日)`,
+	`(a|(b))+`,
+	`(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)(k)`,
+	`(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)(?P<eleventh>k)`,
+	`(?P<year>\d{4})-(?P<month>\d{2})`,
+}
+
+var replaceStdlibInputs = []string{"", "abab", "baaab", "abcdefghijk", "日本日", "2023-04, 1999-12"}
+
+var replaceStdlibTemplates = []string{
+	"$1", "[$0]", "${0}${0}", "$2$1",
+	"$$", "$$1", "$", "a$", "${", "${1",
+	"${1}x", "$1x", "$x", "${x}-${y}",
+	"$9", "$10", "$11", "${11}", "${eleventh}", "$99",
+	"${month}/${year}", "$month/$year", "$$${year}", "${unknown}-$unknown",
+	`\1`, `\`, `\n$1\`,
+}
+
+func TestReplaceAllStdlib(t *testing.T) {
+	for _, pat := range replaceStdlibPatterns {
+		re := MustCompile(pat)
+		std := regexp.MustCompile(pat)
+		for _, src := range replaceStdlibInputs {
+			for _, repl := range replaceStdlibTemplates {
+				if got, want := re.ReplaceAllString(src, repl), std.ReplaceAllString(src, repl); got != want {
+					t.Errorf("%#q.ReplaceAllString(%q, %q) = %q; want %q", pat, src, repl, got, want)
+				}
+				if got, want := re.ReplaceAll([]byte(src), []byte(repl)), std.ReplaceAll([]byte(src), []byte(repl)); string(got) != string(want) {
+					t.Errorf("%#q.ReplaceAll(%q, %q) = %q; want %q", pat, src, repl, got, want)
+				}
+				if got, want := re.AppendReplaceAll([]byte("x"), []byte(src), []byte(repl)), std.ReplaceAll([]byte(src), []byte(repl)); string(got) != "x"+string(want) {
+					t.Errorf("%#q.AppendReplaceAll(%q, %q, %q) = %q; want %q", pat, "x", src, repl, got, "x"+string(want))
+				}
+				if got, err := re.TryReplaceAllString(src, repl); got != std.ReplaceAllString(src, repl) || err != nil {
+					t.Errorf("%#q.TryReplaceAllString(%q, %q) = %q, %v; want %q, nil", pat, src, repl, got, err, std.ReplaceAllString(src, repl))
+				}
+			}
+		}
+	}
+}
+
+func TestReplaceAllNamedTemplate(t *testing.T) {
+	re := MustCompile(`(?P<year>\d{4})-(?P<month>\d{2})`)
+	if got, want := re.ReplaceAllString("2023-04, 1999-12", "${month}/${year}"), "04/2023, 12/1999"; got != want {
+		t.Errorf("ReplaceAllString(%q, %q) = %q; want %q", "2023-04, 1999-12", "${month}/${year}", got, want)
+	}
+}
+
+func TestReplaceAllLiteralStdlib(t *testing.T) {
+	templates := append([]string{"$1\\n", `\0`, `\$`, "123", "$1$", `\x`}, replaceStdlibTemplates...)
+	for _, pat := range replaceStdlibPatterns {
+		re := MustCompile(pat)
+		std := regexp.MustCompile(pat)
+		for _, src := range replaceStdlibInputs {
+			for _, repl := range templates {
+				if got, want := re.ReplaceAllLiteralString(src, repl), std.ReplaceAllLiteralString(src, repl); got != want {
+					t.Errorf("%#q.ReplaceAllLiteralString(%q, %q) = %q; want %q", pat, src, repl, got, want)
+				}
+				if got, want := re.ReplaceAllLiteral([]byte(src), []byte(repl)), std.ReplaceAllLiteral([]byte(src), []byte(repl)); string(got) != string(want) {
+					t.Errorf("%#q.ReplaceAllLiteral(%q, %q) = %q; want %q", pat, src, repl, got, want)
+				}
+			}
+		}
+	}
+
+	if got, want := MustCompile(`b`).ReplaceAllLiteralString("abc", "$1\\n"), "a$1\\nc"; got != want {
+		t.Errorf("ReplaceAllLiteralString with %q = %q; want it verbatim as %q", "$1\\n", got, want)
+	}
+}
+
+func TestReplaceAllLiteralBytes(t *testing.T) {
+	re := MustCompile(`(a)(b)?`)
+	repl := []byte(`\0$2\`)
+	for _, src := range []string{"xaby a", "xyz", ""} {
+		want := regexp.MustCompile(`(a)(b)?`).ReplaceAllLiteral([]byte(src), repl)
+		b := []byte(src)
+		got := re.ReplaceAllLiteral(b, repl)
+		if string(got) != string(want) {
+			t.Errorf("ReplaceAllLiteral(%q, %q) = %q; want %q", src, repl, got, want)
+		}
+		if len(b) > 0 && len(got) > 0 && &got[0] == &b[0] {
+			t.Errorf("ReplaceAllLiteral(%q, %q) returned src instead of a copy", src, repl)
+		}
+	}
+	b := []byte("xyz")
+	if got := re.ReplaceAll(b, []byte("$1")); &got[0] == &b[0] {
+		t.Errorf("ReplaceAll(%q, %q) returned src instead of a copy", b, "$1")
 	}
 }
 
@@ -311,6 +484,74 @@ func TestReplaceAllLiteral(t *testing.T) {
 	}
 }
 
+type ReplaceFuncTest struct {
+	pattern       string
+	replacement   func(string) string
+	input, output string
+}
+
+var replaceFuncTests = []ReplaceFuncTest{
+	{"[a-c]", func(s string) string { return "x" + s + "y" }, "defabcdef", "defxayxbyxcydef"},
+	{"[a-c]+", func(s string) string { return "x" + s + "y" }, "defabcdef", "defxabcydef"},
+	{"[a-c]*", func(s string) string { return "x" + s + "y" }, "defabcdef", "xydxyexyfxabcydxyexyfxy"},
+	{"[a-c]*", func(s string) string { return "x" + s + "y" }, "\u65e5a\u672c", "xy\u65e5xay\u672cxy"},
+	{"", func(s string) string { return "-" }, "", "-"},
+	{"b", func(s string) string { return strings.ToUpper(s) }, "", ""},
+}
+
+func TestReplaceAllFunc(t *testing.T) {
+	for _, tc := range replaceFuncTests {
+		re, err := Compile(tc.pattern)
+		if err != nil {
+			t.Errorf("Unexpected error compiling %q: %v", tc.pattern, err)
+			continue
+		}
+		actual := re.ReplaceAllStringFunc(tc.input, tc.replacement)
+		if actual != tc.output {
+			t.Errorf("%q.ReplaceFunc(%q,fn) = %q; want %q",
+				tc.pattern, tc.input, actual, tc.output)
+		}
+		// now try bytes
+		actual = string(re.ReplaceAllFunc([]byte(tc.input), func(s []byte) []byte { return []byte(tc.replacement(string(s))) }))
+		if actual != tc.output {
+			t.Errorf("%q.ReplaceFunc(%q,fn) = %q; want %q",
+				tc.pattern, tc.input, actual, tc.output)
+		}
+	}
+}
+
+var expandTests = []struct {
+	pattern, template, input string
+}{
+	{`(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)`, "$10", "abcdefghij"},
+	{`(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)`, "${1}0", "abcdefghij"},
+	{`(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)`, "$11", "abcdefghij"},
+	{`(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)`, "$1x", "abcdefghij"},
+	{`(a)(b)`, "$$1 $$$2 $", "ab"},
+	{`(a)(b)`, "${2}${1}${3}", "ab"},
+	{`(a)(b)`, "${oops", "ab"},
+	{`(a)|(b)`, "[$1][$2]", "b"},
+	{`(?P<first>\w+) (?P<last>\w+)`, "${last}, $first", "Alan Turing"},
+	{`(?P<first>\w+) (?P<last>\w+)`, "$firstx ${missing}$0", "Alan Turing"},
+}
+
+func TestExpand(t *testing.T) {
+	for _, tc := range expandTests {
+		re := MustCompile(tc.pattern)
+		stdRE := regexp.MustCompile(tc.pattern)
+
+		match := re.FindStringSubmatchIndex(tc.input)
+		want := string(stdRE.ExpandString(nil, tc.template, tc.input, stdRE.FindStringSubmatchIndex(tc.input)))
+
+		if got := string(re.ExpandString(nil, tc.template, tc.input, match)); got != want {
+			t.Errorf("%q.ExpandString(%q, %q) = %q; want %q", tc.pattern, tc.template, tc.input, got, want)
+		}
+		if got := string(re.Expand(nil, []byte(tc.template), []byte(tc.input), match)); got != want {
+			t.Errorf("%q.Expand(%q, %q) = %q; want %q", tc.pattern, tc.template, tc.input, got, want)
+		}
+	}
+}
+
 type MetaTest struct {
 	pattern, output, literal string
 	isLiteral                bool
@@ -355,6 +596,144 @@ func TestQuoteMeta(t *testing.T) {
 	}
 }
 
+func FuzzQuoteMeta(f *testing.F) {
+	for _, tc := range metaTests {
+		f.Add(tc.pattern)
+	}
+	f.Add("\x00")
+	f.Add("a\x00b.c\x00")
+	f.Add(`\x00\\.+*?()|[]{}^$`)
+	f.Add("\xff\xfe")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		quoted := QuoteMeta(s)
+		if want := regexp.QuoteMeta(s); quoted != want {
+			t.Fatalf("QuoteMeta(%q) = %q; want %q", s, quoted, want)
+		}
+
+		// re2 only accepts UTF-8 patterns.
+		if !utf8.ValidString(s) {
+			return
+		}
+		re, err := Compile(`^(?:` + quoted + `)$`)
+		if err != nil {
+			t.Fatalf("Unexpected error compiling QuoteMeta(%q): %v", s, err)
+		}
+		defer re.Close()
+		if !re.MatchString(s) {
+			t.Errorf("QuoteMeta(%q) = %q does not match the literal text", s, quoted)
+		}
+	})
+}
+
+var literalPrefixTests = []MetaTest{
+	// See golang.org/issue/11175.
+	// output is unused.
+	{`^0^0$`, ``, `0`, false},
+	{`^0^`, ``, ``, false},
+	{`^0$`, ``, `0`, true},
+	{`$0^`, ``, ``, false},
+	{`$0$`, ``, ``, false},
+	{`^^0$$`, ``, ``, false},
+	{`^$^$`, ``, ``, false},
+	{`$$0^^`, ``, ``, false},
+	{`a\x{fffd}b`, ``, `a`, false},
+	{`\x{fffd}b`, ``, ``, false},
+	{"\ufffd", ``, ``, false},
+}
+
+func TestLiteralPrefix(t *testing.T) {
+	for _, tc := range append(metaTests, literalPrefixTests...) {
+		// Literal method needs to scan the pattern.
+		re := MustCompile(tc.pattern)
+		str, complete := re.LiteralPrefix()
+		if complete != tc.isLiteral {
+			t.Errorf("LiteralPrefix(`%s`) = %t; want %t", tc.pattern, complete, tc.isLiteral)
+		}
+		if str != tc.literal {
+			t.Errorf("LiteralPrefix(`%s`) = `%s`; want `%s`", tc.pattern, str, tc.literal)
+		}
+	}
+}
+
+func TestLiteralPrefixOptions(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		opts     Options
+		prefix   string
+		complete bool
+	}{
+		{`abc`, Options{CaseInsensitive: true}, ``, false},
+		{`abc|abd`, Options{POSIX: true, Longest: true}, `ab`, false},
+		{`\pL+`, Options{}, ``, false},
+		// \C is not supported by the standard library.
+		{`ab\C`, Options{}, ``, false},
+	}
+	for _, tc := range tests {
+		re, err := CompileWith(tc.pattern, tc.opts)
+		if err != nil {
+			t.Fatalf("CompileWith(%#q): unexpected error: %v", tc.pattern, err)
+		}
+		prefix, complete := re.LiteralPrefix()
+		if prefix != tc.prefix || complete != tc.complete {
+			t.Errorf("CompileWith(%#q, %+v).LiteralPrefix() = %q, %t; want %q, %t", tc.pattern, tc.opts, prefix, complete, tc.prefix, tc.complete)
+		}
+	}
+}
+
+func TestLiteralSuffix(t *testing.T) {
+	for _, tc := range metaTests {
+		if !tc.isLiteral {
+			continue
+		}
+		if suffix, complete := MustCompile(tc.pattern).LiteralSuffix(); suffix != tc.literal || !complete {
+			t.Errorf("LiteralSuffix(%#q) = %q, %t; want %q, true", tc.pattern, suffix, complete, tc.literal)
+		}
+	}
+
+	tests := []struct {
+		pattern  string
+		opts     Options
+		suffix   string
+		complete bool
+	}{
+		{`foo$`, Options{}, `foo`, false},
+		{`.*bar`, Options{}, `bar`, false},
+		{`abc`, Options{}, `abc`, true},
+		{`a.c`, Options{Literal: true}, `a.c`, true},
+		{``, Options{}, ``, true},
+		{`(?m)foo\b$`, Options{}, `foo`, false},
+		{`a+(b)c`, Options{}, `abc`, false},
+		{`x(ab)+`, Options{}, `ab`, false},
+		{`(ab){2,}`, Options{}, `ab`, false},
+		{`(ab){0,2}`, Options{}, ``, false},
+		{`[ab]c`, Options{}, `c`, false},
+		{`x(abc|bbc)`, Options{}, `bc`, false},
+		{`foo|bar`, Options{}, ``, false},
+		{`é|\x{e9}x|e`, Options{}, ``, false},
+		{`日本|本`, Options{}, `本`, false},
+		{`foo(bar)?`, Options{}, ``, false},
+		{`(?i)abc`, Options{}, ``, false},
+		{`abc`, Options{CaseInsensitive: true}, ``, false},
+		{`abc`, Options{Latin1: true}, ``, false},
+		// \C is not supported by the standard library.
+		{`ab\C`, Options{}, ``, false},
+	}
+	for _, tc := range tests {
+		re, err := CompileWith(tc.pattern, tc.opts)
+		if errors.Is(err, errUnsupportedOption) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("CompileWith(%#q): unexpected error: %v", tc.pattern, err)
+		}
+		suffix, complete := re.LiteralSuffix()
+		if suffix != tc.suffix || complete != tc.complete {
+			t.Errorf("CompileWith(%#q, %+v).LiteralSuffix() = %q, %t; want %q, %t", tc.pattern, tc.opts, suffix, complete, tc.suffix, tc.complete)
+		}
+	}
+}
+
 type subexpIndex struct {
 	name  string
 	index int
@@ -380,6 +759,8 @@ var subexpCases = []subexpCase{
 	{`(.*)((a)b)(.*)a`, 4, []string{"", "", "", "", ""}, emptySubexpIndices},
 	{`(.*)(\(ab)(.*)a`, 3, []string{"", "", "", ""}, emptySubexpIndices},
 	{`(.*)(\(a\)b)(.*)a`, 3, []string{"", "", "", ""}, emptySubexpIndices},
+	{`(a)(b)(?:c)(d)`, 3, []string{"", "", "", ""}, emptySubexpIndices},
+	{`(?P<first>a)(b)(?P<third>c)`, 3, []string{"", "first", "", "third"}, []subexpIndex{{"", -1}, {"missing", -1}, {"first", 1}, {"third", 3}, {"b", -1}}},
 	{`(?P<foo>.*)(?P<bar>(a)b)(?P<foo>.*)a`, 4, []string{"", "foo", "bar", "", "foo"}, []subexpIndex{{"", -1}, {"missing", -1}, {"foo", 1}, {"bar", 2}}},
 }
 
@@ -441,6 +822,12 @@ var splitTests = []struct {
 	{"foobar", "", -1, []string{"f", "o", "o", "b", "a", "r"}},
 	{"abaabaccadaaae", "a*", 5, []string{"", "b", "b", "c", "cadaaae"}},
 	{":x:y:z:", ":", -1, []string{"", "x", "y", "z", ""}},
+	{"a,b,,c", ",", -1, []string{"a", "b", "", "c"}},
+	{"a b\t\tc\n", `\s+`, -1, []string{"a", "b", "c", ""}},
+	{"a b\t\tc\n", `\s+`, 2, []string{"a", "b\t\tc\n"}},
+	{"axbxxc", "x*", -1, []string{"a", "b", "c"}},
+	{"axbxxc", "x*", 3, []string{"a", "b", "c"}},
+	{"\u65e5x\u672c", "x*", -1, []string{"\u65e5", "\u672c"}},
 }
 
 func TestSplit(t *testing.T) {
@@ -456,6 +843,11 @@ func TestSplit(t *testing.T) {
 			t.Errorf("#%d: %q: got %q; want %q", i, test.r, split, test.out)
 		}
 
+		stdsplit := regexp.MustCompile(test.r).Split(test.s, test.n)
+		if !reflect.DeepEqual(split, stdsplit) {
+			t.Errorf("#%d: Split(%q, %q, %d): re2 vs regexp mismatch\nre2=%q\nregexp=%q", i, test.s, test.r, test.n, split, stdsplit)
+		}
+
 		if QuoteMeta(test.r) == test.r {
 			strsplit := strings.SplitN(test.s, test.r, test.n)
 			if !reflect.DeepEqual(split, strsplit) {
@@ -502,6 +894,55 @@ func TestSwitchBacktrack(t *testing.T) {
 	re.Match(long[:1]) // triggers backtracker
 }
 
+func TestBytesStdlib(t *testing.T) {
+	tests := []struct {
+		pat   string
+		input []byte
+	}{
+		{`(a)?(b)`, []byte("xabyb")},
+		{`a*`, []byte("baaab")},
+		{`a*`, []byte{}},
+		{`a*`, nil},
+		{`(x)`, nil},
+	}
+
+	for _, tc := range tests {
+		re := MustCompile(tc.pat)
+		std := regexp.MustCompile(tc.pat)
+
+		if got, want := re.Match(tc.input), std.Match(tc.input); got != want {
+			t.Errorf("%#q.Match(%q) = %t; want %t", tc.pat, tc.input, got, want)
+		}
+		find := re.Find(tc.input)
+		if want := std.Find(tc.input); !reflect.DeepEqual(find, want) {
+			t.Errorf("%#q.Find(%q) = %#v; want %#v", tc.pat, tc.input, find, want)
+		}
+		findSubmatch := re.FindSubmatch(tc.input)
+		if want := std.FindSubmatch(tc.input); !reflect.DeepEqual(findSubmatch, want) {
+			t.Errorf("%#q.FindSubmatch(%q) = %#v; want %#v", tc.pat, tc.input, findSubmatch, want)
+		}
+		findAll := re.FindAll(tc.input, -1)
+		if want := std.FindAll(tc.input, -1); !reflect.DeepEqual(findAll, want) {
+			t.Errorf("%#q.FindAll(%q) = %#v; want %#v", tc.pat, tc.input, findAll, want)
+		}
+		if got, want := re.ReplaceAll(tc.input, []byte("<$1>")), std.ReplaceAll(tc.input, []byte("<$1>")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%#q.ReplaceAll(%q) = %#v; want %#v", tc.pat, tc.input, got, want)
+		}
+
+		// Results are not backed by wasm memory, which later operations overwrite.
+		re.Match([]byte(strings.Repeat("b", 100)))
+		if want := std.Find(tc.input); !reflect.DeepEqual(find, want) {
+			t.Errorf("%#q.Find(%q) changed to %#v after another match; want %#v", tc.pat, tc.input, find, want)
+		}
+		if want := std.FindSubmatch(tc.input); !reflect.DeepEqual(findSubmatch, want) {
+			t.Errorf("%#q.FindSubmatch(%q) changed to %#v after another match; want %#v", tc.pat, tc.input, findSubmatch, want)
+		}
+		if want := std.FindAll(tc.input, -1); !reflect.DeepEqual(findAll, want) {
+			t.Errorf("%#q.FindAll(%q) changed to %#v after another match; want %#v", tc.pat, tc.input, findAll, want)
+		}
+	}
+}
+
 // GAP: Because we just wrap pointers to C++ structs, Go reflection cannot compare
 // for equality correctly.
 //func TestDeepEqual(t *testing.T) {
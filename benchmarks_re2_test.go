@@ -2,6 +2,12 @@
 
 package re2
 
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
 func MustCompileBenchmark(expr string) *Regexp {
 	return MustCompile(expr)
 }
@@ -9,3 +15,225 @@ func MustCompileBenchmark(expr string) *Regexp {
 func CompileBenchmark(expr string) (*Regexp, error) {
 	return Compile(expr)
 }
+
+func BenchmarkAppendAllStringIndex(b *testing.B) {
+	s := strings.Repeat("ab ", 1000000)
+	re := MustCompile(`b`)
+	var dst []int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = re.AppendAllStringIndex(dst[:0], s)
+	}
+}
+
+func BenchmarkCountMatches(b *testing.B) {
+	s := strings.Repeat("ab ", 1000000)
+	re := MustCompile(`b`)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		re.CountMatches(s)
+	}
+}
+
+func BenchmarkMatchStringAny(b *testing.B) {
+	inputs := make([]string, 100)
+	for i := range inputs {
+		inputs[i] = "not an address " + strconv.Itoa(i)
+	}
+	re := MustCompile(`(\w+)@(\w+)\.com`)
+	defer re.Close()
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, s := range inputs {
+				if re.MatchString(s) {
+					break
+				}
+			}
+		}
+	})
+	b.Run("MatchStringAny", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			re.MatchStringAny(inputs)
+		}
+	})
+}
+
+func BenchmarkUnsynchronized(b *testing.B) {
+	for _, unsynchronized := range []bool{false, true} {
+		re, err := CompileWith(`^[a-z]+\d$`, Options{Unsynchronized: unsynchronized})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run("Unsynchronized="+strconv.FormatBool(unsynchronized), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				re.MatchString("abc1")
+			}
+		})
+		re.Close()
+	}
+}
+
+func BenchmarkSubexpNames(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 20; i++ {
+		sb.WriteString("(?P<g" + strconv.Itoa(i) + ">a)")
+	}
+	re := MustCompile(sb.String())
+	defer re.Close()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// As when compiling the expression.
+		re.abi.startOperation(8)
+		subexpNames(re.abi, re.ptr)
+		re.abi.endOperation()
+	}
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	inputs := []string{"user@example.com", "not an address", "someone.else@example.org"}
+	re := MustCompile(`(\w+)@(\w+)\.com`)
+	defer re.Close()
+	b.Run("MatchString/Regexp", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				re.MatchString(inputs[i%len(inputs)])
+			}
+		})
+	})
+	b.Run("MatchString/Matcher", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			m, err := re.Matcher()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			defer m.Close()
+			for i := 0; pb.Next(); i++ {
+				m.MatchString(inputs[i%len(inputs)])
+			}
+		})
+	})
+	b.Run("FindStringSubmatchIndex/Regexp", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			re.FindStringSubmatchIndex(inputs[i%len(inputs)])
+		}
+	})
+	b.Run("FindStringSubmatchIndex/Matcher", func(b *testing.B) {
+		m, err := re.Matcher()
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer m.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.FindStringSubmatchIndex(inputs[i%len(inputs)])
+		}
+	})
+}
+
+func BenchmarkSource(b *testing.B) {
+	text := []byte(strings.Repeat("2023-04-01 12:00:00 INFO request served in 12ms\n", 100000))
+	const rangeSize = 64 << 10
+	re := MustCompile(`ERROR|panic:`)
+	defer re.Close()
+	b.Run("Regexp", func(b *testing.B) {
+		b.SetBytes(rangeSize)
+		for i := 0; i < b.N; i++ {
+			start := (i * rangeSize) % (len(text) - rangeSize)
+			re.Match(text[start : start+rangeSize])
+		}
+	})
+	b.Run("Source", func(b *testing.B) {
+		src, err := re.NewSource(text)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer src.Close()
+		b.SetBytes(rangeSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			start := (i * rangeSize) % (len(text) - rangeSize)
+			src.MatchRange(start, start+rangeSize)
+		}
+	})
+}
+
+func BenchmarkReplacer(b *testing.B) {
+	inputs := make([]string, 100000)
+	for i := range inputs {
+		inputs[i] = "user" + strconv.Itoa(i) + "@example.com"
+	}
+	const repl = "${name} at ${domain}"
+	re := MustCompile(`(?P<name>\w+)@(?P<domain>[\w.]+)`)
+	defer re.Close()
+	b.Run("Regexp", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			re.ReplaceAllString(inputs[i%len(inputs)], repl)
+		}
+	})
+	b.Run("Replacer", func(b *testing.B) {
+		r, err := re.Replacer(repl)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer r.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			r.ReplaceAll(inputs[i%len(inputs)])
+		}
+	})
+}
+
+func BenchmarkAppendReplaceAll(b *testing.B) {
+	src := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 20000))
+	re := MustCompile(`(\w+) (\w+)`)
+	repl := []byte("$2 $1")
+	b.Run("ReplaceAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			re.ReplaceAll(src, repl)
+		}
+	})
+	b.Run("AppendReplaceAll", func(b *testing.B) {
+		var dst []byte
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dst = re.AppendReplaceAll(dst[:0], src, repl)
+		}
+	})
+}
+
+func BenchmarkParallelism(b *testing.B) {
+	s := strings.Repeat("mail someone at foo@bar.com ", 100)
+	for _, parallelism := range []int{1, 0} {
+		name := "GOMAXPROCS"
+		if parallelism > 0 {
+			name = strconv.Itoa(parallelism)
+		}
+		b.Run(name, func(b *testing.B) {
+			re, err := CompileWith(`(\w+)@(\w+)\.com`, Options{Parallelism: parallelism})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer re.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					re.MatchString(s)
+				}
+			})
+		})
+	}
+}
@@ -262,6 +262,17 @@ func BenchmarkMatchParallelShared(b *testing.B) {
 	})
 }
 
+func BenchmarkMatchStringParallelShared(b *testing.B) {
+	x := "this is a long line that contains foo bar baz"
+	re := MustCompileBenchmark("foo (ba+r)? baz")
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			re.MatchString(x)
+		}
+	})
+}
+
 func BenchmarkMatchParallelCopied(b *testing.B) {
 	x := []byte("this is a long line that contains foo bar baz")
 	re := MustCompileBenchmark("foo (ba+r)? baz")
@@ -274,6 +285,28 @@ func BenchmarkMatchParallelCopied(b *testing.B) {
 	})
 }
 
+func BenchmarkMatchStringMixedSizes(b *testing.B) {
+	var inputs []string
+	for _, n := range []int{10, 2000, 150, 5000, 40, 3000, 800} {
+		inputs = append(inputs, strings.Repeat("x", n)+"foo bar baz")
+	}
+	re := MustCompileBenchmark("foo (ba+r)? baz")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		re.MatchString(inputs[i%len(inputs)])
+	}
+}
+
+func BenchmarkFindAllStringIndexMillion(b *testing.B) {
+	s := strings.Repeat("ab ", 1000000)
+	re := MustCompileBenchmark(`b`)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		re.FindAllStringIndex(s, -1)
+	}
+}
+
 var sink string
 
 func BenchmarkQuoteMetaAll(b *testing.B) {
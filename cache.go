@@ -0,0 +1,88 @@
+package re2
+
+import (
+	"errors"
+	"sync"
+)
+
+// cacheKey identifies a cached expression by its pattern and the options it is compiled
+// with, so that the same pattern compiled with different options is cached separately.
+type cacheKey struct {
+	pattern string
+	opts    Options
+}
+
+var cache sync.Map // cacheKey -> *Regexp
+
+// compileCall is a compilation by CompileCached in progress, waited for by concurrent
+// calls for the same pattern and options instead of compiling it again.
+type compileCall struct {
+	done chan struct{}
+	re   *Regexp
+	err  error
+}
+
+var inflight struct {
+	mu    sync.Mutex
+	calls map[cacheKey]*compileCall
+}
+
+// CompileCached is like CompileWith but returns the same Regexp for all calls with the
+// same pattern and options, compiling it only on the first, e.g., for call sites across
+// an application that use the same patterns. Concurrent calls for a pattern not cached
+// yet wait for a single compilation, so a burst of them instantiates no more modules
+// than one. A Regexp can be used by multiple goroutines simultaneously, so sharing it is
+// safe, but a cached Regexp must not be closed or have Longest called on it since that
+// would affect all of its users. Errors are not cached, only returned to the calls
+// waiting for the compilation that failed. Options.Unsynchronized is rejected with an
+// error since a cached Regexp is shared by goroutines that cannot coordinate its use.
+func CompileCached(pattern string, opts Options) (*Regexp, error) {
+	if opts.Unsynchronized {
+		return nil, errors.New("re2: CompileCached does not support Options.Unsynchronized")
+	}
+
+	key := cacheKey{pattern: pattern, opts: opts}
+	if re, ok := cache.Load(key); ok {
+		return re.(*Regexp), nil
+	}
+
+	inflight.mu.Lock()
+	if c, ok := inflight.calls[key]; ok {
+		inflight.mu.Unlock()
+		<-c.done
+		return c.re, c.err
+	}
+	// Compiled by another caller since checking the cache above.
+	if re, ok := cache.Load(key); ok {
+		inflight.mu.Unlock()
+		return re.(*Regexp), nil
+	}
+	c := &compileCall{done: make(chan struct{})}
+	if inflight.calls == nil {
+		inflight.calls = make(map[cacheKey]*compileCall)
+	}
+	inflight.calls[key] = c
+	inflight.mu.Unlock()
+
+	c.re, c.err = CompileWith(pattern, opts)
+	if c.err == nil {
+		cache.Store(key, c.re)
+	}
+
+	inflight.mu.Lock()
+	delete(inflight.calls, key)
+	inflight.mu.Unlock()
+	close(c.done)
+
+	return c.re, c.err
+}
+
+// ClearCache removes all expressions from the cache of CompileCached, so that later
+// calls compile them again. The removed expressions are not closed since they may still
+// be in use, and are released when garbage collected.
+func ClearCache() {
+	cache.Range(func(key, _ interface{}) bool {
+		cache.Delete(key)
+		return true
+	})
+}
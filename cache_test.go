@@ -0,0 +1,83 @@
+package re2
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCompileCached(t *testing.T) {
+	defer ClearCache()
+
+	re1, err := CompileCached(`abc`, Options{})
+	if err != nil {
+		t.Fatalf("CompileCached: unexpected error: %v", err)
+	}
+	same, err := CompileCached(`abc`, Options{})
+	if err != nil {
+		t.Fatalf("CompileCached: unexpected error: %v", err)
+	}
+	if same != re1 {
+		t.Errorf("CompileCached returned different Regexps for the same pattern and options")
+	}
+
+	reCI, err := CompileCached(`abc`, Options{CaseInsensitive: true})
+	if err != nil {
+		t.Fatalf("CompileCached: unexpected error: %v", err)
+	}
+	if reCI == re1 {
+		t.Errorf("CompileCached returned the same Regexp for different options")
+	}
+	if re1.MatchString("ABC") || !reCI.MatchString("ABC") {
+		t.Errorf("cached Regexps match with the options of each other")
+	}
+
+	if _, err := CompileCached(`a(`, Options{}); err == nil {
+		t.Errorf("CompileCached(%#q): expected error", `a(`)
+	}
+
+	ClearCache()
+	re3, err := CompileCached(`abc`, Options{})
+	if err != nil {
+		t.Fatalf("CompileCached: unexpected error: %v", err)
+	}
+	if re3 == re1 {
+		t.Errorf("CompileCached returned a Regexp compiled before ClearCache")
+	}
+}
+
+func TestCompileCachedConcurrent(t *testing.T) {
+	defer ClearCache()
+
+	const n = 8
+	res := make([]*Regexp, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			re, err := CompileCached(`a+b`, Options{})
+			if err != nil {
+				t.Errorf("CompileCached: unexpected error: %v", err)
+				return
+			}
+			if !re.MatchString("aab") {
+				t.Errorf("%#q.MatchString(%q) = false; want true", re, "aab")
+			}
+			res[i] = re
+		}(i)
+	}
+	wg.Wait()
+	for i := 1; i < n; i++ {
+		if res[i] != res[0] {
+			t.Errorf("concurrent CompileCached returned different Regexps")
+		}
+	}
+}
+
+func TestCompileCachedUnsynchronized(t *testing.T) {
+	defer ClearCache()
+
+	if _, err := CompileCached(`abc`, Options{Unsynchronized: true}); err == nil {
+		t.Errorf("CompileCached with Unsynchronized: expected error")
+	}
+}
@@ -0,0 +1,30 @@
+package re2
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+var _ Engine = (*regexp.Regexp)(nil)
+
+func TestEngine(t *testing.T) {
+	const pattern, input = `(?P<key>\w+)=(\d+)`, "a=1 b=22 c"
+
+	engines := []Engine{regexp.MustCompile(pattern), MustCompile(pattern)}
+	for _, e := range engines {
+		if e.String() != pattern {
+			t.Errorf("%T.String() = %q; want %q", e, e.String(), pattern)
+		}
+	}
+	std, re2 := engines[0], engines[1]
+	if got, want := re2.FindAllStringSubmatch(input, -1), std.FindAllStringSubmatch(input, -1); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAllStringSubmatch(%q) = %q; want %q", input, got, want)
+	}
+	if got, want := re2.ReplaceAllString(input, "${key}:$2"), std.ReplaceAllString(input, "${key}:$2"); got != want {
+		t.Errorf("ReplaceAllString(%q) = %q; want %q", input, got, want)
+	}
+	if got, want := re2.SubexpNames(), std.SubexpNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SubexpNames() = %q; want %q", got, want)
+	}
+}
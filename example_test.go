@@ -2,6 +2,7 @@ package re2_test
 
 import (
 	"fmt"
+	"strings"
 
 	regexp "github.com/wasilibs/go-re2"
 )
@@ -255,13 +256,21 @@ func ExampleRegexp_ReplaceAllString() {
 	// -W-xxW-
 }
 
-// GAP: We cannot pass callback functions to re2
-//func ExampleRegexp_ReplaceAllStringFunc() {
-//	re := regexp.MustCompile(`[^aeiou]`)
-//	fmt.Println(re.ReplaceAllStringFunc("seafood fool", strings.ToUpper))
-//	// Output:
-//	// SeaFooD FooL
-//}
+func ExampleRegexp_ReplaceAllStringFunc() {
+	re := regexp.MustCompile(`[^aeiou]`)
+	fmt.Println(re.ReplaceAllStringFunc("seafood fool", strings.ToUpper))
+	// Output:
+	// SeaFooD FooL
+}
+
+func ExampleRegexp_ReplaceAllStringSubmatchFunc() {
+	re := regexp.MustCompile(`(\w+)@(\w+)\.com`)
+	fmt.Println(re.ReplaceAllStringSubmatchFunc("alice@example.com, bob@test.com", func(groups []string) string {
+		return strings.ToUpper(groups[1]) + " at " + groups[2]
+	}))
+	// Output:
+	// ALICE at example, BOB at test
+}
 
 func ExampleRegexp_SubexpNames() {
 	re := regexp.MustCompile(`(?P<first>[a-zA-Z]+) (?P<last>[a-zA-Z]+)`)
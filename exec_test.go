@@ -539,7 +539,7 @@ Reading:
 				}
 			}
 
-			re, err := compile(pattern, true, true, caseInsensitive)
+			re, err := compile(pattern, Options{POSIX: true, Longest: true, CaseInsensitive: caseInsensitive})
 			if err != nil {
 				if shouldCompile {
 					t.Errorf("%s:%d: %#q did not compile", file, lineno, pattern)
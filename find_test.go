@@ -1,7 +1,13 @@
 package re2
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -285,6 +291,31 @@ func TestFindAllString(t *testing.T) {
 	}
 }
 
+func TestFindAllStringLimit(t *testing.T) {
+	for _, test := range findTests {
+		re := MustCompile(test.pat)
+		if result := re.FindAllString(test.text, 0); result != nil {
+			t.Errorf("expected no match with n == 0; got %q: %s", result, test)
+		}
+		if test.matches == nil {
+			continue
+		}
+		for n := 1; n <= len(test.matches); n++ {
+			result := re.FindAllString(test.text, n)
+			if len(result) != n {
+				t.Errorf("expected %d matches with n == %d; got %d: %s", n, n, len(result), test)
+				continue
+			}
+			for k, e := range test.matches[:n] {
+				expect := test.text[e[0]:e[1]]
+				if expect != result[k] {
+					t.Errorf("expected %q got %q: %s", expect, result, test)
+				}
+			}
+		}
+	}
+}
+
 func testFindAllIndex(test *FindTest, result [][]int, t *testing.T) {
 	switch {
 	case test.matches == nil && result == nil:
@@ -318,8 +349,114 @@ func TestFindAllStringIndex(t *testing.T) {
 	}
 }
 
+var allIndexStdlibTests = []struct {
+	pat  string
+	text string
+}{
+	{`a*`, "baa"},
+	{`a*`, "baaab"},
+	{`a*?`, "baa"},
+	{`x*`, "abc"},
+	{``, "abc"},
+	{`b`, "abcbab"},
+	{`\b`, "ab cd"},
+	{`^`, "abc"},
+	{`$`, "abc"},
+	{`(?m)^`, "a\nb\nc"},
+	{`[a-c]+`, "abcdabce"},
+	{`\d+|x*`, "x12xx3"},
+	{`日*`, "日本日日"},
+	{`.`, "日本語"},
+}
+
+func TestFindAllStringIndexStdlib(t *testing.T) {
+	for _, test := range allIndexStdlibTests {
+		for _, n := range []int{-1, 0, 1, 2} {
+			got := MustCompile(test.pat).FindAllStringIndex(test.text, n)
+			want := regexp.MustCompile(test.pat).FindAllStringIndex(test.text, n)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.FindAllStringIndex(%q, %d) = %v; want %v", test.pat, test.text, n, got, want)
+			}
+		}
+	}
+}
+
 // Now come the Submatch cases.
 
+// submatchStdlibTests exercises subexpressions that don't participate in the match,
+// which must be distinguished from those matching the empty string.
+var submatchStdlibTests = []struct {
+	pat  string
+	text string
+}{
+	{`(a)?(b)`, "b"},
+	{`(a)?(b)`, "ab"},
+	{`(a)?(b)`, "c"},
+	{`(a)|(b)`, "b"},
+	{`(a)?(b)?`, "c"},
+	{`(a*)(b)?`, ""},
+	{`()`, "abc"},
+	{`x(y)?`, "zzxw"},
+	{`(.)(日)?`, "本"},
+}
+
+func TestFindStringSubmatchStdlib(t *testing.T) {
+	for _, test := range submatchStdlibTests {
+		got := MustCompile(test.pat).FindStringSubmatch(test.text)
+		want := regexp.MustCompile(test.pat).FindStringSubmatch(test.text)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%#q.FindStringSubmatch(%q) = %q; want %q", test.pat, test.text, got, want)
+		}
+	}
+}
+
+func TestFindStringSubmatchIndexStdlib(t *testing.T) {
+	for _, test := range submatchStdlibTests {
+		re := MustCompile(test.pat)
+		want := regexp.MustCompile(test.pat).FindStringSubmatchIndex(test.text)
+		if got := re.FindStringSubmatchIndex(test.text); !reflect.DeepEqual(got, want) {
+			t.Errorf("%#q.FindStringSubmatchIndex(%q) = %v; want %v", test.pat, test.text, got, want)
+		}
+
+		// Offsets are relative to the input even when it is placed after a longer
+		// input in the shared memory buffer.
+		re.MatchString(strings.Repeat("z", 1000))
+		if got := re.FindStringSubmatchIndex(test.text); !reflect.DeepEqual(got, want) {
+			t.Errorf("%#q.FindStringSubmatchIndex(%q) after longer input = %v; want %v", test.pat, test.text, got, want)
+		}
+	}
+}
+
+func TestFindAllStringSubmatchStdlib(t *testing.T) {
+	tests := []struct {
+		pat  string
+		text string
+	}{
+		{`(\w)(\d)`, "a1b2c3"},
+		{`(\w)(\d)?`, "a1bc3"},
+		// Empty matches right after a match are skipped and must not count towards n.
+		{`(a*)`, "baaab"},
+		{`(a)*`, "baaab"},
+		{`(a|(b))*`, "abxbax"},
+	}
+	for _, test := range tests {
+		re := MustCompile(test.pat)
+		std := regexp.MustCompile(test.pat)
+		for _, n := range []int{-1, 0, 1, 2, 3, 10} {
+			got := re.FindAllStringSubmatch(test.text, n)
+			want := std.FindAllStringSubmatch(test.text, n)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.FindAllStringSubmatch(%q, %d) = %q; want %q", test.pat, test.text, n, got, want)
+			}
+			gotIdx := re.FindAllStringSubmatchIndex(test.text, n)
+			wantIdx := std.FindAllStringSubmatchIndex(test.text, n)
+			if !reflect.DeepEqual(gotIdx, wantIdx) {
+				t.Errorf("%#q.FindAllStringSubmatchIndex(%q, %d) = %v; want %v", test.pat, test.text, n, gotIdx, wantIdx)
+			}
+		}
+	}
+}
+
 func testSubmatchBytes(test *FindTest, n int, submatches []int, result [][]byte, t *testing.T) {
 	if len(submatches) != len(result)*2 {
 		t.Errorf("match %d: expected %d submatches; got %d: %s", n, len(submatches)/2, len(result), test)
@@ -504,3 +641,378 @@ func TestFindAllStringSubmatchIndex(t *testing.T) {
 		testFindAllSubmatchIndex(&test, MustCompile(test.pat).FindAllStringSubmatchIndex(test.text, -1), t)
 	}
 }
+
+func TestFindAllStringSubmatchIndexNested(t *testing.T) {
+	tests := []struct {
+		pattern, input string
+	}{
+		{`((a)(b))+`, "abab xab ab"},
+		{`((a)(b))+`, ""},
+		{`((a)|(b))*`, "abba-ba"},
+		{`(a(x)?)+`, "aaxa ax"},
+		{`(日(本)?)`, "日本日x日本"},
+	}
+	for _, tc := range tests {
+		re := MustCompile(tc.pattern)
+		std := regexp.MustCompile(tc.pattern)
+		for _, n := range []int{-1, 0, 1, 2} {
+			want := std.FindAllStringSubmatchIndex(tc.input, n)
+			if got := re.FindAllStringSubmatchIndex(tc.input, n); !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.FindAllStringSubmatchIndex(%q, %d) = %v; want %v", tc.pattern, tc.input, n, got, want)
+			}
+			if got := re.FindAllSubmatchIndex([]byte(tc.input), n); !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.FindAllSubmatchIndex(%q, %d) = %v; want %v", tc.pattern, tc.input, n, got, want)
+			}
+		}
+	}
+}
+
+func TestFindAllStringOverlapping(t *testing.T) {
+	tests := []struct {
+		pat  string
+		opts Options
+		text string
+		n    int
+		want []string
+	}{
+		{`aa`, Options{}, "aaaa", -1, []string{"aa", "aa", "aa"}},
+		{`aa`, Options{}, "aaaa", 2, []string{"aa", "aa"}},
+		{`aa`, Options{}, "aaaa", 0, nil},
+		{`a+`, Options{}, "aaa", -1, []string{"aaa", "aa", "a"}},
+		{`ab|a`, Options{}, "aab", -1, []string{"a", "ab"}},
+		{`\w+`, Options{}, "ab cd", -1, []string{"ab", "b", "cd", "d"}},
+		{`.$`, Options{}, "日本", -1, []string{"本"}},
+		{`..`, Options{}, "日本語", -1, []string{"日本", "本語"}},
+		{`x*`, Options{}, "ab", -1, []string{"", "", ""}},
+		{`b`, Options{}, "aaa", -1, nil},
+		// Every byte is a character in Latin-1.
+		{`.`, Options{Latin1: true}, "\xc3\xa9", -1, []string{"\xc3", "\xa9"}},
+		{`..`, Options{Latin1: true}, "\xc3\xa9x", -1, []string{"\xc3\xa9", "\xa9x"}},
+	}
+	for _, tc := range tests {
+		re, err := CompileWith(tc.pat, tc.opts)
+		if errors.Is(err, errUnsupportedOption) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("CompileWith(%#q): unexpected error: %v", tc.pat, err)
+		}
+		if got := re.FindAllStringOverlapping(tc.text, tc.n); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%#q.FindAllStringOverlapping(%q, %d) = %q; want %q", tc.pat, tc.text, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestAppendAllStringIndex(t *testing.T) {
+	for _, test := range findTests {
+		re := MustCompile(test.pat)
+		var want []int
+		for _, m := range re.FindAllStringIndex(test.text, -1) {
+			want = append(want, m...)
+		}
+		prefix := []int{-7}
+		got := re.AppendAllStringIndex(prefix, test.text)
+		if !reflect.DeepEqual(got[1:], want) && !(len(got) == 1 && want == nil) {
+			t.Errorf("%#q.AppendAllStringIndex(%q) = %v; want %v", test.pat, test.text, got[1:], want)
+		}
+		if got[0] != -7 {
+			t.Errorf("%#q.AppendAllStringIndex(%q) overwrote dst", test.pat, test.text)
+		}
+	}
+}
+
+func TestEachMatchIndex(t *testing.T) {
+	for _, test := range findTests {
+		re := MustCompile(test.pat)
+		for _, n := range []int{-1, 0, 1, 3} {
+			var got [][]int
+			re.EachMatchIndex(test.text, n, func(loc []int) bool {
+				got = append(got, append([]int(nil), loc...))
+				return true
+			})
+			if want := re.FindAllStringIndex(test.text, n); !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.EachMatchIndex(%q, %d) = %v; want %v", test.pat, test.text, n, got, want)
+			}
+		}
+	}
+
+	re := MustCompile(`a`)
+	var got [][]int
+	re.EachMatchIndex("banana", -1, func(loc []int) bool {
+		got = append(got, append([]int(nil), loc...))
+		// The Regexp can be used while iterating.
+		re.MatchString("a")
+		return len(got) < 2
+	})
+	if want := [][]int{{1, 2}, {3, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EachMatchIndex stopped after 2 matches = %v; want %v", got, want)
+	}
+
+	// Matches span several batches, including empty ones at their boundaries.
+	re = MustCompile(`\d*`)
+	text := strings.Repeat("1x22yé", 100)
+	for _, n := range []int{-1, firstMatchBatch, firstMatchBatch + 1, 100} {
+		got = nil
+		re.EachMatchIndex(text, n, func(loc []int) bool {
+			got = append(got, append([]int(nil), loc...))
+			return true
+		})
+		if want := re.FindAllStringIndex(text, n); !reflect.DeepEqual(got, want) {
+			t.Errorf("EachMatchIndex(%d) = %v; want %v", n, got, want)
+		}
+	}
+	got = nil
+	re.EachMatchIndex(text, -1, func(loc []int) bool {
+		got = append(got, append([]int(nil), loc...))
+		return len(got) < firstMatchBatch+2
+	})
+	if want := re.FindAllStringIndex(text, firstMatchBatch+2); !reflect.DeepEqual(got, want) {
+		t.Errorf("EachMatchIndex stopped in the second batch = %v; want %v", got, want)
+	}
+}
+
+func TestFindStringLeftmostLongest(t *testing.T) {
+	tests := []struct {
+		pattern, input string
+	}{
+		{`a|ab`, "xabc"},
+		{`a+?`, "aaa"},
+		{`(a|ab)(c|bcd)`, "abcd"},
+		{`b*`, "abb"},
+		{`x`, "abc"},
+	}
+	for _, tc := range tests {
+		for _, mode := range []string{"Compile", "CompilePOSIX", "Longest"} {
+			var re *Regexp
+			var std *regexp.Regexp
+			switch mode {
+			case "Compile":
+				re, std = MustCompile(tc.pattern), regexp.MustCompile(tc.pattern)
+			case "CompilePOSIX":
+				re, std = MustCompilePOSIX(tc.pattern), regexp.MustCompilePOSIX(tc.pattern)
+			case "Longest":
+				re, std = MustCompile(tc.pattern), regexp.MustCompile(tc.pattern)
+				re.Longest()
+				std.Longest()
+			}
+			if got, want := re.FindString(tc.input), std.FindString(tc.input); got != want {
+				t.Errorf("%s(%#q).FindString(%q) = %q; want %q", mode, tc.pattern, tc.input, got, want)
+			}
+			if got, want := re.FindStringIndex(tc.input), std.FindStringIndex(tc.input); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s(%#q).FindStringIndex(%q) = %v; want %v", mode, tc.pattern, tc.input, got, want)
+			}
+		}
+	}
+}
+
+func TestCountMatches(t *testing.T) {
+	for _, test := range findTests {
+		re := MustCompile(test.pat)
+		if got, want := re.CountMatches(test.text), len(regexp.MustCompile(test.pat).FindAllString(test.text, -1)); got != want {
+			t.Errorf("%#q.CountMatches(%q) = %d; want %d", test.pat, test.text, got, want)
+		}
+	}
+}
+
+func TestFindStringIndexFrom(t *testing.T) {
+	tests := []struct {
+		pat   string
+		text  string
+		start int
+		want  []int
+	}{
+		{`b`, "abcabc", 0, []int{1, 2}},
+		{`b`, "abcabc", 2, []int{4, 5}},
+		{`b`, "abcabc", 5, nil},
+		{`^a`, "abcabc", 0, []int{0, 1}},
+		{`^a`, "abcabc", 3, nil},
+		{`(?m)^a`, "abc\nabc", 1, []int{4, 5}},
+		{`(?m)^a`, "abcabc", 3, nil},
+		{`\bb`, "ab b", 1, []int{3, 4}},
+		{`$`, "abc", 3, []int{3, 3}},
+		{`a`, "abc", -1, nil},
+		{`a`, "abc", 4, nil},
+	}
+	for _, tc := range tests {
+		re := MustCompile(tc.pat)
+		if got := re.FindStringIndexFrom(tc.text, tc.start); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%#q.FindStringIndexFrom(%q, %d) = %v; want %v", tc.pat, tc.text, tc.start, got, tc.want)
+		}
+	}
+}
+
+func TestFindStringSubmatchRuneIndex(t *testing.T) {
+	tests := []struct {
+		pat  string
+		text string
+		want []int
+	}{
+		{`b(c)`, "abc", []int{1, 3, 2, 3}},
+		// Emoji are a single rune of four bytes.
+		{`(x)(y)?`, "🙂🙂x🙂", []int{2, 3, 2, 3, -1, -1}},
+		{`🙂+`, "a🙂🙂b", []int{1, 3}},
+		// The combining acute accent is a rune of its own.
+		{`(e\x{301})(s)`, "cafe\u0301s", []int{3, 6, 3, 5, 5, 6}},
+		// Family emoji joined with zero-width joiners are several runes.
+		{`(\x{200d})`, "👩\u200d👧!", []int{1, 2, 1, 2}},
+		{`!`, "👩\u200d👧!", []int{3, 4}},
+		{`z`, "日本", nil},
+	}
+	for _, tc := range tests {
+		re := MustCompile(tc.pat)
+		got := re.FindStringSubmatchRuneIndex(tc.text)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%#q.FindStringSubmatchRuneIndex(%q) = %v; want %v", tc.pat, tc.text, got, tc.want)
+			continue
+		}
+		// The rune offsets index the same text in the runes of the input.
+		runes := []rune(tc.text)
+		byteLoc := re.FindStringSubmatchIndex(tc.text)
+		for i := 0; i+1 < len(got); i += 2 {
+			if got[i] < 0 {
+				continue
+			}
+			if r, b := string(runes[got[i]:got[i+1]]), tc.text[byteLoc[i]:byteLoc[i+1]]; r != b {
+				t.Errorf("%#q: group %d is %q in runes; want %q", tc.pat, i/2, r, b)
+			}
+		}
+	}
+}
+
+// errReaderAt returns an error reading past limit.
+type errReaderAt struct {
+	r     io.ReaderAt
+	limit int64
+}
+
+var errReadFailed = errors.New("read failed")
+
+func (r errReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.limit {
+		return 0, errReadFailed
+	}
+	return r.r.ReadAt(p, off)
+}
+
+type submatchText struct {
+	group int
+	text  string
+}
+
+func TestEachSubmatch(t *testing.T) {
+	for _, test := range findTests {
+		re := MustCompile(test.pat)
+		var got, want []submatchText
+		re.EachSubmatch(test.text, func(group int, text string) bool {
+			got = append(got, submatchText{group, text})
+			return true
+		})
+		for _, match := range re.FindAllStringSubmatchIndex(test.text, -1) {
+			for i := 0; i < len(match); i += 2 {
+				if match[i] >= 0 {
+					want = append(want, submatchText{i / 2, test.text[match[i]:match[i+1]]})
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%#q.EachSubmatch(%q) = %v; want %v", test.pat, test.text, got, want)
+		}
+	}
+
+	// Groups come match by match, skipping (z) and (y) where they did not participate.
+	re := MustCompile(`(\w)=(\d)(z)?|(y)`)
+	var got []submatchText
+	re.EachSubmatch("a=1 b=2z y c=3", func(group int, text string) bool {
+		got = append(got, submatchText{group, text})
+		// The Regexp can be used while iterating.
+		re.MatchString("y")
+		return len(got) < 9
+	})
+	want := []submatchText{
+		{0, "a=1"}, {1, "a"}, {2, "1"},
+		{0, "b=2z"}, {1, "b"}, {2, "2"}, {3, "z"},
+		{0, "y"}, {4, "y"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EachSubmatch stopped after 9 groups = %v; want %v", got, want)
+	}
+
+	// Matches span several batches, and stopping in the second one ends the search.
+	re = MustCompile(`(\d)(x)?|(y)`)
+	text := strings.Repeat("1x2y", firstMatchBatch)
+	var matches []string
+	re.EachSubmatch(text, func(group int, text string) bool {
+		if group == 0 {
+			matches = append(matches, text)
+		}
+		return len(matches) < firstMatchBatch+2
+	})
+	if want := re.FindAllString(text, firstMatchBatch+2); !reflect.DeepEqual(matches, want) {
+		t.Errorf("EachSubmatch stopped in the second batch = %q; want %q", matches, want)
+	}
+}
+
+func TestFindStringSubmatchMap(t *testing.T) {
+	tests := []struct {
+		pat  string
+		text string
+		want map[string]string
+	}{
+		{`(?P<k>\w+)=(?P<v>\w+)`, "foo=bar", map[string]string{"k": "foo", "v": "bar", "0": "foo=bar"}},
+		{`(a)(?P<x>b)?c`, "xac", map[string]string{"0": "ac", "1": "a"}},
+		{`(?P<2>a)(b)`, "ab", map[string]string{"0": "ab", "2": "a"}},
+		{`(?P<2>x)?(b)`, "b", map[string]string{"0": "b", "2": "b"}},
+		{`abc`, "abc", map[string]string{"0": "abc"}},
+		{`abc`, "xyz", nil},
+	}
+	for _, tc := range tests {
+		if got := MustCompile(tc.pat).FindStringSubmatchMap(tc.text); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%#q.FindStringSubmatchMap(%q) = %q; want %q", tc.pat, tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestFindAllReaderAtIndex(t *testing.T) {
+	defer SetReaderAtWindowSize(0)
+
+	text := strings.Repeat("abc foo 日本 xfoo abcabc\nfoo ", 50) + "abc"
+	f, err := os.CreateTemp(t.TempDir(), "find")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := []string{`abc`, `\bfoo\b`, `日本`, `^abc`, `(?m)^foo`, `x?`, `c$`, `[a-c]{2}`, `foo.*`}
+	for _, window := range []int{1, 2, 3, 7, 16, 100, 0} {
+		SetReaderAtWindowSize(window)
+		for _, pat := range patterns {
+			re := MustCompile(pat)
+			for _, n := range []int{-1, 3} {
+				got, err := re.FindAllReaderAtIndex(f, int64(len(text)), n)
+				if err != nil {
+					t.Fatalf("%#q.FindAllReaderAtIndex with window %d: unexpected error: %v", pat, window, err)
+				}
+				if want := re.FindAllIndex([]byte(text), n); !reflect.DeepEqual(got, want) {
+					t.Errorf("%#q.FindAllReaderAtIndex(n=%d) with window %d = %v; want %v", pat, n, window, got, want)
+				}
+			}
+		}
+	}
+
+	SetReaderAtWindowSize(16)
+	re := MustCompile(`abc`)
+	want := re.FindAllIndex([]byte(text[:200]), -1)
+	got, err := re.FindAllReaderAtIndex(errReaderAt{r: f, limit: 200}, int64(len(text)), -1)
+	if !errors.Is(err, errReadFailed) {
+		t.Errorf("FindAllReaderAtIndex with failing reader: err = %v; want %v", err, errReadFailed)
+	}
+	if len(got) == 0 || !reflect.DeepEqual(got, want[:len(got)]) {
+		t.Errorf("FindAllReaderAtIndex with failing reader = %v; want a prefix of %v", got, want)
+	}
+	if _, err := re.FindAllReaderAtIndex(f, int64(len(text))+1, -1); err == nil {
+		t.Errorf("FindAllReaderAtIndex past the end of the file: expected error")
+	}
+}
@@ -4,5 +4,5 @@ go 1.18
 
 require (
 	github.com/magefile/mage v1.14.0
-	github.com/tetratelabs/wazero v1.0.0-pre.8
+	github.com/tetratelabs/wazero v1.0.0
 )
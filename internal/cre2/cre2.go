@@ -4,6 +4,7 @@ package cre2
 
 /*
 #include <stdbool.h>
+#include <stdint.h>
 
 void* cre2_new(void* pattern, int pattern_len, void* opts);
 void cre2_delete(void* re);
@@ -13,17 +14,32 @@ int cre2_match(void* re, void* text, int text_len, int startpos, int endpos, int
 int cre2_find_and_consume_re(void* re, void* text, void* match, int nmatch);
 int cre2_global_replace_re(void* re, void* textAndTarget, void* rewrite);
 int cre2_num_capturing_groups(void* re);
+int cre2_program_size(void* re);
 void* cre2_named_groups_iter_new(void* re);
 bool cre2_named_groups_iter_next(void* iter, void** name, int* index);
 void cre2_named_groups_iter_delete(void* iter);
 
 void* cre2_opt_new();
 void cre2_opt_delete(void* opts);
+void cre2_opt_set_max_mem(void* opt, int64_t m);
+void cre2_opt_set_encoding(void* opt, int enc);
+void cre2_opt_set_never_nl(void* opt, int flag);
+void cre2_opt_set_dot_nl(void* opt, int flag);
+void cre2_opt_set_literal(void* opt, int flag);
+void cre2_opt_set_never_capture(void* opt, int flag);
+void cre2_opt_set_word_boundary(void* opt, int flag);
+void cre2_opt_set_one_line(void* opt, int flag);
 void cre2_opt_set_log_errors(void* opt, int flag);
 void cre2_opt_set_longest_match(void* opt, int flag);
 void cre2_opt_set_posix_syntax(void* opt, int flag);
 void cre2_opt_set_case_sensitive(void* opt, int flag);
 
+void* cre2_set_new(void* opt, int anchor);
+void cre2_set_delete(void* set);
+int cre2_set_add(void* set, void* pattern, unsigned long pattern_len, void* error, unsigned long error_len);
+int cre2_set_compile(void* set);
+unsigned long cre2_set_match(void* set, void* text, unsigned long text_len, void* match, unsigned long match_len);
+
 void* malloc(unsigned long size);
 void free(void* ptr);
 */
@@ -77,6 +93,10 @@ func NumCapturingGroups(rePtr unsafe.Pointer) int {
 	return int(C.cre2_num_capturing_groups(rePtr))
 }
 
+func ProgramSize(rePtr unsafe.Pointer) int {
+	return int(C.cre2_program_size(rePtr))
+}
+
 func NewOpt() unsafe.Pointer {
 	return C.cre2_opt_new()
 }
@@ -85,6 +105,38 @@ func DeleteOpt(opt unsafe.Pointer) {
 	C.cre2_opt_delete(opt)
 }
 
+func OptSetMaxMem(opt unsafe.Pointer, m int64) {
+	C.cre2_opt_set_max_mem(opt, C.int64_t(m))
+}
+
+func OptSetEncoding(opt unsafe.Pointer, enc int) {
+	C.cre2_opt_set_encoding(opt, C.int(enc))
+}
+
+func OptSetNeverNL(opt unsafe.Pointer, flag bool) {
+	C.cre2_opt_set_never_nl(opt, cFlag(flag))
+}
+
+func OptSetDotNL(opt unsafe.Pointer, flag bool) {
+	C.cre2_opt_set_dot_nl(opt, cFlag(flag))
+}
+
+func OptSetLiteral(opt unsafe.Pointer, flag bool) {
+	C.cre2_opt_set_literal(opt, cFlag(flag))
+}
+
+func OptSetNeverCapture(opt unsafe.Pointer, flag bool) {
+	C.cre2_opt_set_never_capture(opt, cFlag(flag))
+}
+
+func OptSetWordBoundary(opt unsafe.Pointer, flag bool) {
+	C.cre2_opt_set_word_boundary(opt, cFlag(flag))
+}
+
+func OptSetOneLine(opt unsafe.Pointer, flag bool) {
+	C.cre2_opt_set_one_line(opt, cFlag(flag))
+}
+
 func OptSetLogErrors(opt unsafe.Pointer, flag bool) {
 	C.cre2_opt_set_log_errors(opt, cFlag(flag))
 }
@@ -101,6 +153,32 @@ func OptSetCaseSensitive(opt unsafe.Pointer, flag bool) {
 	C.cre2_opt_set_case_sensitive(opt, cFlag(flag))
 }
 
+func SetNew(opt unsafe.Pointer, anchor int) unsafe.Pointer {
+	return C.cre2_set_new(opt, C.int(anchor))
+}
+
+func SetDelete(setPtr unsafe.Pointer) {
+	C.cre2_set_delete(setPtr)
+}
+
+func SetAdd(setPtr unsafe.Pointer, patternPtr unsafe.Pointer, patternLen int) int {
+	return int(C.cre2_set_add(setPtr, patternPtr, C.ulong(patternLen), nil, 0))
+}
+
+func SetCompile(setPtr unsafe.Pointer) bool {
+	return C.cre2_set_compile(setPtr) > 0
+}
+
+// SetMatch copies the indexes of the matching patterns into match, returning how many
+// patterns matched, which may be more than fit.
+func SetMatch(setPtr unsafe.Pointer, textPtr unsafe.Pointer, textLen int, match []int32) int {
+	var matchPtr unsafe.Pointer
+	if len(match) > 0 {
+		matchPtr = unsafe.Pointer(&match[0])
+	}
+	return int(C.cre2_set_match(setPtr, textPtr, C.ulong(textLen), matchPtr, C.ulong(len(match))))
+}
+
 func Malloc(size int) unsafe.Pointer {
 	return C.malloc(C.ulong(size))
 }
@@ -0,0 +1,110 @@
+package re2
+
+import (
+	"bufio"
+	"io"
+	"runtime"
+)
+
+// lineBatchSize is the number of bytes of lines after which MatchLinesFunc stops adding
+// lines to the batch it matches in one operation.
+const lineBatchSize = 64 << 10
+
+// MatchLinesFunc calls fn with the number, counting from 1, and the content of each line
+// read from r that contains a match of the expression, like grep, until fn returns false
+// or r is exhausted. It returns the first error reading r other than io.EOF.
+//
+// Lines are split at "\n" and passed to fn without it or a "\r" preceding it, so that
+// files with CRLF line endings match as expected, e.g., with $. Lines of any length are
+// supported. The content of a line is only valid until fn returns, as its buffer is
+// reused for later lines.
+//
+// The lines read so far are matched in batches, each in a single operation reusing the
+// memory of the module for its lines, with fn called for each batch outside of matching
+// so that fn may use the Regexp. A batch only waits for r to read more lines until it has
+// at least one, so that lines are reported as soon as they can be read.
+func (re *Regexp) MatchLinesFunc(r io.Reader, fn func(n int, line []byte) bool) error {
+	br := bufio.NewReaderSize(r, lineBatchSize)
+	var (
+		buf     []byte // contents of the lines of the batch
+		ends    []int  // end of each line in buf
+		matched []bool
+	)
+	for first := 1; ; {
+		buf, ends = buf[:0], ends[:0]
+		maxLen := 0
+		var err error
+		for len(ends) == 0 || (len(buf) < lineBatchSize && br.Buffered() > 0) {
+			start := len(buf)
+			if buf, err = readLine(br, buf); err != nil && err != io.EOF {
+				break
+			}
+			if len(buf) == start && err == io.EOF {
+				break
+			}
+			ends = append(ends, len(buf))
+			if l := len(buf) - start; l > maxLen {
+				maxLen = l
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+
+		matched = re.matchLines(matched[:0], buf, ends, maxLen)
+		start := 0
+		for i, end := range ends {
+			if matched[i] && !fn(first+i, buf[start:end:end]) {
+				return nil
+			}
+			start = end
+		}
+		first += len(ends)
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLine appends the next line read from br to dst without its line ending, returning
+// io.EOF if it is the last line, which is then empty if r ended with a newline.
+func readLine(br *bufio.Reader, dst []byte) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	dst = append(dst, line...)
+	// The line does not fit in the buffer of br.
+	for err == bufio.ErrBufferFull {
+		line, err = br.ReadSlice('\n')
+		dst = append(dst, line...)
+	}
+	if err == nil {
+		dst = dst[:len(dst)-1]
+		if len(dst) > 0 && dst[len(dst)-1] == '\r' {
+			dst = dst[:len(dst)-1]
+		}
+	}
+	return dst, err
+}
+
+// matchLines appends to dst whether each line of buf, ending at ends, contains a match, in
+// a single operation reserving memory for the longest line, of maxLen.
+func (re *Regexp) matchLines(dst []bool, buf []byte, ends []int, maxLen int) []bool {
+	if len(ends) == 0 {
+		return dst
+	}
+	re = re.startOperation(maxLen)
+	defer re.endOperation()
+
+	start := 0
+	for _, end := range ends {
+		re.abi.resetMemory()
+		cs := newCStringFromBytes(re.abi, buf[start:end])
+		dst = append(dst, match(re, cs, 0, 0))
+		start = end
+	}
+	runtime.KeepAlive(buf)
+	return dst
+}
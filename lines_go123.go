@@ -0,0 +1,18 @@
+//go:build go1.23
+
+package re2
+
+import (
+	"io"
+	"iter"
+)
+
+// MatchLines returns an iterator over the number and content of each line read from r
+// that contains a match of the expression, as passed by MatchLinesFunc, which Go versions
+// without range-over-func iterators can use instead. An error reading r ends the
+// iteration, MatchLinesFunc must be used to tell it from the end of r.
+func (re *Regexp) MatchLines(r io.Reader) iter.Seq2[int, []byte] {
+	return func(yield func(int, []byte) bool) {
+		_ = re.MatchLinesFunc(r, yield)
+	}
+}
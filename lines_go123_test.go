@@ -0,0 +1,30 @@
+//go:build go1.23
+
+package re2
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchLines(t *testing.T) {
+	var got []matchedLine
+	for n, line := range MustCompile(`error`).MatchLines(strings.NewReader(linesFixture)) {
+		got = append(got, matchedLine{n, string(line)})
+	}
+	if !reflect.DeepEqual(got, linesFixtureMatches) {
+		t.Errorf("MatchLines = %.40q; want %.40q", got, linesFixtureMatches)
+	}
+
+	got = nil
+	for n, line := range MustCompile(`error`).MatchLines(strings.NewReader(linesFixture)) {
+		if n > 3 {
+			break
+		}
+		got = append(got, matchedLine{n, string(line)})
+	}
+	if want := linesFixtureMatches[:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchLines with break = %.40q; want %.40q", got, want)
+	}
+}
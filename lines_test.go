@@ -0,0 +1,108 @@
+package re2
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type matchedLine struct {
+	n    int
+	line string
+}
+
+// linesFixture has CRLF line endings, a line longer than the buffer of bufio.Reader, an
+// empty line and no final newline.
+var linesFixture = strings.Join([]string{
+	"error: disk full",
+	"info: started",
+	"warning: error budget low\r",
+	"",
+	strings.Repeat("x", 100000) + " error",
+	"debug: ok\r",
+	"error",
+}, "\n")
+
+var linesFixtureMatches = []matchedLine{
+	{1, "error: disk full"},
+	{3, "warning: error budget low"},
+	{5, strings.Repeat("x", 100000) + " error"},
+	{7, "error"},
+}
+
+func TestMatchLinesFunc(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []matchedLine
+	}{
+		{`error`, linesFixtureMatches},
+		{`low$`, []matchedLine{{3, "warning: error budget low"}}},
+		{`^$`, []matchedLine{{4, ""}}},
+		{`\r`, nil},
+		{`nothing`, nil},
+	}
+	for _, tc := range tests {
+		var got []matchedLine
+		err := MustCompile(tc.pattern).MatchLinesFunc(strings.NewReader(linesFixture), func(n int, line []byte) bool {
+			got = append(got, matchedLine{n, string(line)})
+			return true
+		})
+		if err != nil {
+			t.Errorf("%#q.MatchLinesFunc: unexpected error: %v", tc.pattern, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%#q.MatchLinesFunc = %.40q; want %.40q", tc.pattern, got, tc.want)
+		}
+	}
+
+	var got []int
+	err := MustCompile(`error`).MatchLinesFunc(strings.NewReader(linesFixture), func(n int, line []byte) bool {
+		got = append(got, n)
+		return len(got) < 2
+	})
+	if err != nil || !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("MatchLinesFunc stopped after 2 lines = %v, %v; want [1 3], nil", got, err)
+	}
+
+	errRead := errors.New("read failed")
+	r := io.MultiReader(strings.NewReader("error\nok\n"), iotest.ErrReader(errRead))
+	got = nil
+	err = MustCompile(`error`).MatchLinesFunc(r, func(n int, line []byte) bool {
+		got = append(got, n)
+		return true
+	})
+	if !errors.Is(err, errRead) || !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("MatchLinesFunc with failing reader = %v, %v; want [1], %v", got, err, errRead)
+	}
+}
+
+func TestMatchLinesFuncBatches(t *testing.T) {
+	// Enough lines for several batches, with fn using the Regexp, which must not wait for
+	// the operation matching the batch when the expression has no spares.
+	var sb strings.Builder
+	var want []int
+	for n := 1; n <= 20000; n++ {
+		if n%7 == 0 {
+			sb.WriteString("error\n")
+			want = append(want, n)
+		} else {
+			sb.WriteString("info: nothing to see here\n")
+		}
+	}
+
+	re := MustCompileWith(`error`, Options{Parallelism: 1})
+	var got []int
+	err := re.MatchLinesFunc(strings.NewReader(sb.String()), func(n int, line []byte) bool {
+		if !re.Match(line) {
+			t.Errorf("line %d = %q does not match", n, line)
+		}
+		got = append(got, n)
+		return true
+	})
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchLinesFunc over batches = %d lines, %v; want %d lines, nil", len(got), err, len(want))
+	}
+}
@@ -0,0 +1,90 @@
+package re2
+
+import "runtime"
+
+// Matcher matches a Regexp repeatedly from a single goroutine, e.g., against many short
+// strings in a tight loop. It holds an instance of the expression in a module of its own,
+// so matching never waits for other expressions, and keeps the memory reserved for the
+// largest input seen so far so that later inputs of similar size reuse it as is. Results
+// are written to a buffer owned by the Matcher, reused across calls.
+//
+// A Matcher is not safe for concurrent use, and must be closed with Close when no longer
+// needed, though its resources are also released when it is garbage collected.
+type Matcher struct {
+	re         *Regexp
+	memorySize int
+	matches    []int
+}
+
+// Matcher returns a new Matcher for the expression, returning an error if it cannot be
+// compiled into a module of its own, e.g., when out of memory.
+func (re *Regexp) Matcher() (*Matcher, error) {
+	inst, err := re.newPrivateInstance()
+	if err != nil {
+		return nil, err
+	}
+	return &Matcher{re: inst}, nil
+}
+
+// MatchString reports whether the string s contains any match of the expression, as
+// Regexp.MatchString.
+func (m *Matcher) MatchString(s string) bool {
+	m.startOperation(len(s))
+	defer m.re.endOperation()
+
+	cs := newCString(m.re.abi, s)
+	res := match(m.re, cs, 0, 0)
+	runtime.KeepAlive(s)
+	return res
+}
+
+// Match reports whether the byte slice b contains any match of the expression, as
+// Regexp.Match.
+func (m *Matcher) Match(b []byte) bool {
+	m.startOperation(len(b))
+	defer m.re.endOperation()
+
+	cs := newCStringFromBytes(m.re.abi, b)
+	res := match(m.re, cs, 0, 0)
+	runtime.KeepAlive(b)
+	return res
+}
+
+// FindStringSubmatchIndex returns the index pairs of the leftmost match of the expression
+// in s and of its submatches, as Regexp.FindStringSubmatchIndex. The returned slice is
+// only valid until the next call on the Matcher.
+func (m *Matcher) FindStringSubmatchIndex(s string) []int {
+	re := m.re
+	m.startOperation(len(s) + 8*len(re.subexpNames))
+	defer re.endOperation()
+
+	cs := newCString(re.abi, s)
+
+	found := false
+	m.matches = m.matches[:0]
+	re.findSubmatch(cs, func(match []int) {
+		found = true
+		m.matches = append(m.matches, match...)
+	})
+	runtime.KeepAlive(s)
+
+	if !found {
+		return nil
+	}
+	return m.matches
+}
+
+// Close releases the module of the Matcher. Using the Matcher after Close panics.
+func (m *Matcher) Close() error {
+	return m.re.Close()
+}
+
+// startOperation starts an operation needing memorySize bytes, reserving memory for the
+// largest operation so far so that the reservation is reused by smaller ones instead of
+// being shrunk for them.
+func (m *Matcher) startOperation(memorySize int) {
+	if memorySize > m.memorySize {
+		m.memorySize = memorySize
+	}
+	m.re.abi.startOperation(m.memorySize)
+}
@@ -0,0 +1,56 @@
+package re2
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	expr := `(\w+)@(\w+)?\.com`
+	re := MustCompile(expr)
+	defer re.Close()
+	std := regexp.MustCompile(expr)
+
+	m, err := re.Matcher()
+	if err != nil {
+		t.Fatalf("Matcher: unexpected error: %v", err)
+	}
+	defer m.Close()
+
+	// Inputs grow and shrink to exercise reusing the reserved memory.
+	inputs := []string{"", "a@b.com", "nothing here", strings.Repeat("x", 5000) + " c@.com", "d@e.org", "f@g.com"}
+	for _, s := range inputs {
+		if got, want := m.MatchString(s), std.MatchString(s); got != want {
+			t.Errorf("MatchString(%.20q) = %v; want %v", s, got, want)
+		}
+		if got, want := m.Match([]byte(s)), std.Match([]byte(s)); got != want {
+			t.Errorf("Match(%.20q) = %v; want %v", s, got, want)
+		}
+		if got, want := m.FindStringSubmatchIndex(s), std.FindStringSubmatchIndex(s); !reflect.DeepEqual(got, want) {
+			t.Errorf("FindStringSubmatchIndex(%.20q) = %v; want %v", s, got, want)
+		}
+	}
+}
+
+func TestMatcherClose(t *testing.T) {
+	re := MustCompile(`a`)
+	defer re.Close()
+	m, err := re.Matcher()
+	if err != nil {
+		t.Fatalf("Matcher: unexpected error: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if !re.MatchString("a") {
+		t.Errorf("closing the Matcher closed the Regexp")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MatchString after Close: expected panic")
+		}
+	}()
+	m.MatchString("a")
+}
@@ -1,21 +1,58 @@
 package re2
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"regexp"
+	"regexp/syntax"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
+// ErrOutOfMemory is the error for the WebAssembly module running out of memory, e.g.,
+// past SetMaxWasmMemoryPages, which functions returning an error wrap and others panic
+// with.
+var ErrOutOfMemory = errors.New("re2: out of wasm memory")
+
+// ErrTooManyModules is the error for compiling an expression that needs a new WebAssembly
+// module past the limit set with SetMaxModules, which compilation wraps.
+var ErrTooManyModules = errors.New("re2: too many wasm modules")
+
+// ErrCorruptMatch is the error for a match read from the memory of the WebAssembly module
+// that is not within the input, which means the memory is corrupt, e.g., from misuse of
+// Options.Unsynchronized. Functions returning an error wrap it and others panic with it.
+var ErrCorruptMatch = errors.New("re2: match outside of the input")
+
+var (
+	errClosed            = errors.New("re2: use of closed Regexp")
+	errModuleDropped     = errors.New("re2: module closed after an earlier call into it failed")
+	errUnsupportedOption = errors.New("not supported by the embedded libcre2, which needs to be rebuilt")
+	errFailedRead        = errors.New("re2: failed to read from wasm memory")
+	errFailedWrite       = errors.New("re2: failed to write to wasm memory")
+)
+
+// wasmErrors are the errors for failures of the WebAssembly module that can be caused by
+// the expression or text, which functions returning an error return instead of panicking.
+var wasmErrors = []error{ErrOutOfMemory, errFailedRead, errFailedWrite, ErrCorruptMatch}
+
+// encodingLatin1 is the value of CRE2_Latin1 for cre2_opt_set_encoding.
+const encodingLatin1 = 2
+
 type Regexp struct {
 	ptr uintptr
 
-	posix   bool
-	longest bool
+	opts Options
 
 	expr string
 
@@ -23,9 +60,101 @@ type Regexp struct {
 
 	abi *libre2ABI
 
+	// spares are additional instances of the expression, nil for a spare itself.
+	spares *spares
+
+	// owner is the Regexp compiled for one unmarshaled in place, which holds the finalizer
+	// releasing the expression, as re may not be an allocation of its own, e.g., when a
+	// field of another struct. It is nil for a Regexp returned by Compile.
+	owner *Regexp
+
 	released uint32
 }
 
+// spares holds additional instances of an expression, each compiled into its own module,
+// for matching in parallel. With wazero, a module can only execute one call at a time, so
+// matches in goroutines that find the Regexp busy use a spare instead of waiting for it.
+// Spares are created on demand, up to one less than Options.Parallelism or GOMAXPROCS, in
+// modules of their own as a module shared with other expressions may be the one that is
+// busy.
+type spares struct {
+	mu        sync.Mutex
+	instances []*Regexp
+
+	// interruptible is the instance MatchStringContext matches with, in a module of its
+	// own as interrupting a match closes the module, compiled on first use and again after
+	// a match closed it.
+	interruptible *Regexp
+}
+
+// Anchor restricts where in the text a match may occur, for matching with
+// MatchAnchored and MatchStringAnchored.
+type Anchor int
+
+// The values are those of cre2_anchor_t.
+const (
+	// Unanchored allows a match anywhere in the text, as in Match.
+	Unanchored Anchor = iota + 1
+	// AnchorStart only allows a match that starts at the beginning of the text.
+	AnchorStart
+	// AnchorBoth only allows a match of the entire text.
+	AnchorBoth
+)
+
+// MatchAnchored reports whether the byte slice b contains a match of the
+// regular expression re at the position required by anchor. It matches the
+// entire text with AnchorBoth more efficiently than wrapping the expression
+// in ^(?:...)$.
+func (re *Regexp) MatchAnchored(b []byte, anchor Anchor) bool {
+	re = re.startOperation(len(b))
+	defer re.endOperation()
+
+	cs := newCStringFromBytes(re.abi, b)
+	res := matchAnchored(re, cs, 0, anchor, 0, 0)
+	runtime.KeepAlive(b)
+	return res
+}
+
+// MatchStringAnchored is like MatchAnchored but matches the string s.
+func (re *Regexp) MatchStringAnchored(s string, anchor Anchor) bool {
+	re = re.startOperation(len(s))
+	defer re.endOperation()
+
+	cs := newCString(re.abi, s)
+	res := matchAnchored(re, cs, 0, anchor, 0, 0)
+	runtime.KeepAlive(s)
+	return res
+}
+
+// FullMatch reports whether the entire byte slice b matches the expression, as
+// MatchAnchored with AnchorBoth, e.g., for validating input without the pitfalls
+// of anchoring an alternation like a|ab manually.
+func (re *Regexp) FullMatch(b []byte) bool {
+	return re.MatchAnchored(b, AnchorBoth)
+}
+
+// FullMatchString is like FullMatch but matches the string s.
+func (re *Regexp) FullMatchString(s string) bool {
+	return re.MatchStringAnchored(s, AnchorBoth)
+}
+
+// MatchReader reports whether the text returned by the RuneReader
+// contains any match of the regular expression pattern.
+// More complicated queries need to use Compile and the full Regexp interface.
+//
+// All of the text is read into memory before matching, see Regexp.MatchReader.
+// Unlike the standard library, an error reading the text is returned with a
+// false result.
+func MatchReader(pattern string, r io.RuneReader) (matched bool, err error) {
+	re, err := Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	defer closeTransient(re, &err)
+	defer recoverWasmError(&err)
+	return re.matchReader(r)
+}
+
 // MatchString reports whether the string s
 // contains any match of the regular expression pattern.
 // More complicated queries need to use Compile and the full Regexp interface.
@@ -34,7 +163,8 @@ func MatchString(pattern string, s string) (matched bool, err error) {
 	if err != nil {
 		return false, err
 	}
-	defer re.release()
+	defer closeTransient(re, &err)
+	defer recoverWasmError(&err)
 	return re.MatchString(s), nil
 }
 
@@ -46,10 +176,19 @@ func Match(pattern string, b []byte) (matched bool, err error) {
 	if err != nil {
 		return false, err
 	}
-	defer re.release()
+	defer closeTransient(re, &err)
+	defer recoverWasmError(&err)
 	return re.Match(b), nil
 }
 
+// closeTransient closes a Regexp compiled for a single call, reporting an error
+// closing it in err if the call did not fail otherwise.
+func closeTransient(re *Regexp, err *error) {
+	if closeErr := re.Close(); *err == nil {
+		*err = closeErr
+	}
+}
+
 // Copy returns a new Regexp object copied from re.
 // Calling Longest on one copy does not affect another.
 //
@@ -58,11 +197,27 @@ func Match(pattern string, b []byte) (matched bool, err error) {
 // As of Go 1.12, using Copy is no longer necessary to avoid lock contention.
 // Copy may still be appropriate if the reason for its use is to make
 // two copies with different Longest settings.
+//
+// Unlike the standard library, the copy is compiled again with the same options,
+// taking as much memory as re, and is independent of it, e.g., closing one does not
+// affect the other. Matching on a single Regexp from multiple goroutines does not
+// need copies either, as it uses spare instances of the expression when busy.
+//
+// As compiling the copy needs resources of its own, Copy panics if they are exhausted,
+// with an error wrapping ErrTooManyModules past the limit of SetMaxModules, or
+// ErrOutOfMemory when the WebAssembly module cannot grow its memory, e.g., past
+// SetMaxWasmMemoryPages.
 func (re *Regexp) Copy() *Regexp {
 	// Recompiling is slower than this should be but for a deprecated method it
 	// is probably fine. The alternative would be to have reference counting to
 	// make sure regex is only deleted when the last reference is gone.
-	return MustCompile(re.expr)
+	c, err := compile(re.expr, re.opts)
+	if err != nil {
+		// The expression compiled with the same options before, so this can only be
+		// running out of modules or memory.
+		panic(err)
+	}
+	return c
 }
 
 // Compile parses a regular expression and returns, if successful,
@@ -76,7 +231,178 @@ func (re *Regexp) Copy() *Regexp {
 // package implements it without the expense of backtracking.
 // For POSIX leftmost-longest matching, see CompilePOSIX.
 func Compile(expr string) (*Regexp, error) {
-	return compile(expr, false, false, false)
+	return compile(expr, Options{})
+}
+
+// Options configures how a regular expression is compiled by CompileWith.
+// The zero value compiles the expression exactly as Compile does.
+type Options struct {
+	// MaxMem is the approximate number of bytes re2 may use for the compiled
+	// program and the cache of automata built while matching. Expressions whose
+	// program does not fit within the budget fail to compile, which bounds the
+	// memory used by untrusted patterns. Zero uses re2's default of 8 MiB.
+	MaxMem int64
+
+	// CaseInsensitive makes the expression match letters regardless of case, as if
+	// it were prefixed with the (?i) flag.
+	CaseInsensitive bool
+
+	// Latin1 makes both the expression and the text it matches be interpreted as
+	// Latin-1 rather than UTF-8, so that every byte is a character of its own, e.g.,
+	// for matching binary data that is not valid UTF-8. In this mode, . matches any
+	// single byte and \xff in the expression matches the byte 0xff.
+	Latin1 bool
+
+	// NeverNL makes the expression never match a newline, even where it contains one
+	// explicitly as in \n or [^a], so that matches never span lines, e.g., for scanning
+	// multi-line logs. Unlike (?m), ^ and $ still only match at the start and end of
+	// the text.
+	NeverNL bool
+
+	// DotNL makes . match any character including a newline, as if the expression were
+	// prefixed with the (?s) flag. It cannot be combined with NeverNL.
+	DotNL bool
+
+	// Literal makes the expression be matched as a literal string rather than parsed as
+	// a regular expression, as if escaped with QuoteMeta, for fast substring search
+	// through the same API.
+	Literal bool
+
+	// Longest makes searches prefer the leftmost-longest match, as after a call to
+	// Regexp.Longest.
+	Longest bool
+
+	// POSIX restricts the expression to POSIX ERE (egrep) syntax with leftmost-longest
+	// semantics, as in CompilePOSIX.
+	POSIX bool
+
+	// NeverCapture makes parenthesized subexpressions not capture, as if written
+	// (?:...), which is cheaper when submatches are not needed. Named subexpressions
+	// still capture, so without them NumSubexp is zero and only the whole match is
+	// reported.
+	NeverCapture bool
+
+	// WordBoundary allows the \b and \B assertions with POSIX syntax, which otherwise
+	// rejects them. It has no effect without POSIX.
+	WordBoundary bool
+
+	// OneLine makes ^ and $ only match at the start and end of the text with POSIX
+	// syntax, which otherwise also matches them at line boundaries. It has no effect
+	// without POSIX, where this is always the case unless the (?m) flag is used.
+	OneLine bool
+
+	// LogErrors makes re2 log errors compiling the expression, which are returned
+	// by CompileWith either way, to standard error.
+	LogErrors bool
+
+	// MaxProgramSize, if positive, rejects expressions whose compiled program is larger,
+	// as measured by re2's program size, a rough measure of the cost of matching. Unlike
+	// MaxMem, which bounds the memory of compilation, it is meant for enforcing a policy
+	// on the complexity of accepted expressions. With wazero, it needs the embedded
+	// libcre2 to export cre2_program_size, and CompileWith returns an error otherwise.
+	MaxProgramSize int
+
+	// Parallelism, if positive, is the maximum number of goroutines that match the
+	// expression at the same time, defaulting to GOMAXPROCS. With wazero, each needs an
+	// instance of the expression in a module of its own, compiled when a match finds the
+	// others busy, so lower values save memory for expressions matched by many
+	// goroutines, with 1 making them wait for each other. It has no effect with cgo.
+	Parallelism int
+
+	// Unsynchronized compiles the expression into a module of its own whose use is not
+	// synchronized at all, saving the cost of locking it around every match, e.g., for
+	// millions of tiny matches in a single-goroutine batch job.
+	//
+	// DANGER: the Regexp must then never be used from more than one goroutine at a time,
+	// including through values derived from it. Concurrent use is not detected and
+	// corrupts the memory of the module, returning wrong results or crashing the
+	// program, and the race detector may not report it as the memory is accessed by
+	// WebAssembly code. It has no effect with cgo, where matching needs no lock.
+	Unsynchronized bool
+}
+
+// CompileWith is like Compile but configures compilation of the expression with opts.
+func CompileWith(expr string, opts Options) (*Regexp, error) {
+	return compile(expr, opts)
+}
+
+// maxReaderExprSize is the longest expression CompileReader reads.
+const maxReaderExprSize = 1 << 20
+
+// CompileReader is like Compile but reads the expression from r until io.EOF, e.g., from
+// an entry of a rules file. The expression is compiled as read, including any trailing
+// newline. Reading stops after 1 MiB, returning an error wrapping ErrPatternTooLarge if
+// the expression is longer, so that a huge stream is not read in full. Errors reading r
+// are returned wrapped.
+func CompileReader(r io.Reader) (*Regexp, error) {
+	expr, err := io.ReadAll(io.LimitReader(r, maxReaderExprSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("re2: failed to read expression: %w", err)
+	}
+	if len(expr) > maxReaderExprSize {
+		return nil, fmt.Errorf("re2: expression longer than %d bytes: %w", maxReaderExprSize, ErrPatternTooLarge)
+	}
+	return Compile(string(expr))
+}
+
+// CompileCompat is like Compile but also reports whether the standard library's
+// regexp.Compile accepts expr, for deciding how to handle the few expressions
+// where the two differ, e.g., \C, which only re2 accepts, or (?<=a), which both
+// reject but differently. Errors wrap a *syntax.Error like those of the standard
+// library, with the same message for the same problem.
+func CompileCompat(expr string) (re *Regexp, stdlibOK bool, err error) {
+	_, stdErr := regexp.Compile(expr)
+	re, err = Compile(expr)
+	return re, stdErr == nil, err
+}
+
+// CompileBatch compiles each of patterns with opts, e.g., for rule sets compiled at
+// startup. The returned slice has an element per pattern, which is nil for patterns
+// that fail to compile, so that the others can still be used. The error is non-nil
+// if any pattern fails, reporting how many did and wrapping the error of the first.
+//
+// With wazero, the modules for the whole batch are acquired up front and the patterns
+// compiled into them together, filling each new module with as many expressions as it
+// hosts before instantiating the next, so that a large batch instantiates far fewer
+// modules than compiling its patterns one by one, which spreads them over a module per
+// CPU. Options.Unsynchronized still compiles each pattern into a module of its own.
+func CompileBatch(patterns []string, opts Options) ([]*Regexp, error) {
+	res := make([]*Regexp, len(patterns))
+	var firstErr error
+	firstIdx, failed := -1, 0
+	fail := func(i int, err error) {
+		if firstErr == nil {
+			firstErr, firstIdx = err, i
+		}
+		failed++
+	}
+
+	var abis []*libre2ABI
+	var abiErr error
+	if !opts.Unsynchronized && !(opts.DotNL && opts.NeverNL) {
+		abis, abiErr = acquireBatchABIs(len(patterns))
+	}
+	for i, pattern := range patterns {
+		var re *Regexp
+		var err error
+		switch {
+		case abis == nil:
+			re, err = compile(pattern, opts)
+		case abis[i] == nil:
+			err = fmt.Errorf("re2: failed to instantiate module: %w", abiErr)
+		default:
+			re, err = compileInto(pattern, opts, abis[i])
+		}
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		res[i] = re
+	}
+	if firstErr != nil {
+		return res, fmt.Errorf("re2: %d of %d patterns failed to compile, first at index %d: %w", failed, len(patterns), firstIdx, firstErr)
+	}
+	return res, nil
 }
 
 // CompilePOSIX is like Compile but restricts the regular expression
@@ -99,71 +425,242 @@ func Compile(expr string) (*Regexp, error) {
 // The POSIX rule is computationally prohibitive and not even well-defined.
 // See https://swtch.com/~rsc/regexp/regexp2.html#posix for details.
 func CompilePOSIX(expr string) (*Regexp, error) {
-	return compile(expr, true, true, false)
+	return compile(expr, Options{POSIX: true, Longest: true})
+}
+
+func compile(expr string, opts Options) (*Regexp, error) {
+	if opts.DotNL && opts.NeverNL {
+		return nil, errors.New("re2: DotNL and NeverNL are mutually exclusive")
+	}
+	acquire := acquireABI
+	if opts.Unsynchronized {
+		acquire = acquireUnsynchronizedABI
+	}
+	abi, err := acquire()
+	if err != nil {
+		return nil, fmt.Errorf("re2: failed to instantiate module: %w", err)
+	}
+	return compileInto(expr, opts, abi)
+}
+
+// compileInto compiles the expression returned by compile into abi, acquired for it.
+func compileInto(expr string, opts Options, abi *libre2ABI) (*Regexp, error) {
+	re, err := compileInstance(expr, opts, abi)
+	if err != nil {
+		return nil, err
+	}
+	// An expression compiled with Unsynchronized never finds its module busy, so it only
+	// keeps the instance MatchStringContext matches with.
+	re.spares = &spares{}
+
+	runtime.SetFinalizer(re, (*Regexp).release)
+
+	return re, nil
 }
 
-func compile(expr string, posix bool, longest bool, caseInsensitive bool) (*Regexp, error) {
-	abi := newABI()
-	abi.startOperation(len(expr) + 2 + 8)
+// newPrivateInstance compiles an instance of the expression into a module of its own,
+// not shared with other expressions, which is released when the instance is closed or
+// garbage collected.
+func (re *Regexp) newPrivateInstance() (*Regexp, error) {
+	if re.abi == nil {
+		panic(errClosed)
+	}
+	abi, err := acquireSpareABI()
+	if err != nil {
+		return nil, fmt.Errorf("re2: failed to instantiate module: %w", err)
+	}
+	inst, err := compileInstance(re.expr, re.opts, abi)
+	if err != nil {
+		return nil, err
+	}
+	runtime.SetFinalizer(inst, (*Regexp).release)
+	return inst, nil
+}
+
+// compileInstance compiles a single instance of the expression into abi, releasing
+// it if compilation fails.
+func compileInstance(expr string, opts Options, abi *libre2ABI) (*Regexp, error) {
+	if err := checkOptions(abi, opts); err != nil {
+		releaseABI(abi)
+		return nil, err
+	}
+	// Besides the expression, 8 bytes are needed for iterating over the named groups.
+	if err := abi.startOperationContext(context.Background(), len(expr)+2+8); err != nil {
+		releaseABI(abi)
+		return nil, err
+	}
 	defer abi.endOperation()
 
 	cs := newCString(abi, expr)
 
-	rePtr := newRE(abi, cs, longest, posix, caseInsensitive)
+	rePtr, err := tryNewRE(abi, cs, opts)
+	if err != nil {
+		releaseABI(abi)
+		return nil, err
+	}
+	if rePtr == 0 {
+		releaseABI(abi)
+		return nil, fmt.Errorf("error parsing regexp: out of memory compiling %#q", expr)
+	}
 	errCode, errArg := reError(abi, rePtr)
-	switch errCode {
-	case 0:
-	// No error.
-	case 1:
-		return nil, fmt.Errorf("error parsing regexp: unexpected error: %#q", errArg)
-	case 2:
-		return nil, fmt.Errorf("error parsing regexp: invalid escape sequence: %#q", errArg)
-	case 3:
-		return nil, fmt.Errorf("error parsing regexp: bad character class: %#q", errArg)
-	case 4:
-		return nil, fmt.Errorf("error parsing regexp: invalid character class range: %#q", errArg)
-	case 5:
-		return nil, fmt.Errorf("error parsing regexp: missing closing ]: %#q", errArg)
-	case 6:
-		return nil, fmt.Errorf("error parsing regexp: missing closing ): %#q", errArg)
-	case 7:
-		return nil, fmt.Errorf("error parsing regexp: unexpected ): %#q", errArg)
-	case 8:
-		return nil, fmt.Errorf("error parsing regexp: trailing backslash at end of expression: %#q", errArg)
-	case 9:
-		return nil, fmt.Errorf("error parsing regexp: missing argument to repetition operator: %#q", errArg)
-	case 10:
-		return nil, fmt.Errorf("error parsing regexp: bad repitition argument: %#q", errArg)
-	case 11:
-		return nil, fmt.Errorf("error parsing regexp: invalid nested repetition operator: %#q", errArg)
-	case 12:
-		return nil, fmt.Errorf("error parsing regexp: bad perl operator: %#q", errArg)
-	case 13:
-		return nil, fmt.Errorf("error parsing regexp: invalid UTF-8 in regexp: %#q", errArg)
-	case 14:
-		return nil, fmt.Errorf("error parsing regexp: bad named capture group: %#q", errArg)
-	case 15:
-		// TODO(anuraaga): While the unit test passes, it is likely that the actual limit is currently
-		// different than regexp.
-		return nil, fmt.Errorf("error parsing regexp: expression too large")
+	if errCode != 0 {
+		deleteRE(abi, rePtr)
+		releaseABI(abi)
+		return nil, compileError(errCode, errArg, expr)
+	}
+	if opts.MaxProgramSize > 0 {
+		if size := programSize(abi, rePtr); size > opts.MaxProgramSize {
+			deleteRE(abi, rePtr)
+			releaseABI(abi)
+			return nil, fmt.Errorf("re2: program size %d of %#q exceeds MaxProgramSize %d", size, expr, opts.MaxProgramSize)
+		}
 	}
 
 	subexp := subexpNames(abi, rePtr)
 
 	re := &Regexp{
 		ptr:         rePtr,
-		posix:       posix,
-		longest:     longest,
+		opts:        opts,
 		expr:        expr,
 		subexpNames: subexp,
 		abi:         abi,
 	}
 
-	runtime.SetFinalizer(re, (*Regexp).release)
-
 	return re, nil
 }
 
+// tryNewRE is like newRE but returns an error if the module fails.
+func tryNewRE(abi *libre2ABI, cs cString, opts Options) (rePtr uintptr, err error) {
+	defer recoverWasmError(&err)
+	return newRE(abi, cs, opts), nil
+}
+
+// recoverWasmError recovers a panic with one of wasmErrors into err, for functions that
+// return an error, and panics again with anything else. It must be deferred directly.
+func recoverWasmError(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if rErr, ok := r.(error); ok {
+		for _, wasmErr := range wasmErrors {
+			if errors.Is(rErr, wasmErr) {
+				*err = rErr
+				return
+			}
+		}
+	}
+	panic(r)
+}
+
+// Errors compiling an expression, one for each error code of re2, which can be
+// checked with errors.Is. The error returned by compilation wraps the one for the
+// failure together with the *syntax.Error the standard library returns for it.
+var (
+	ErrInternal          = errors.New("re2: internal error")
+	ErrBadEscape         = errors.New("re2: invalid escape sequence")
+	ErrBadCharClass      = errors.New("re2: invalid character class")
+	ErrBadCharRange      = errors.New("re2: invalid character class range")
+	ErrMissingBracket    = errors.New("re2: missing closing ]")
+	ErrMissingParen      = errors.New("re2: missing closing )")
+	ErrUnexpectedParen   = errors.New("re2: unexpected )")
+	ErrTrailingBackslash = errors.New("re2: trailing backslash at end of expression")
+	ErrRepeatArgument    = errors.New("re2: missing argument to repetition operator")
+	ErrRepeatSize        = errors.New("re2: invalid repeat count")
+	ErrRepeatOp          = errors.New("re2: invalid nested repetition operator")
+	ErrBadPerlOp         = errors.New("re2: invalid or unsupported Perl syntax")
+	ErrBadUTF8           = errors.New("re2: invalid UTF-8")
+	ErrBadNamedCapture   = errors.New("re2: invalid named capture group")
+	ErrPatternTooLarge   = errors.New("re2: expression too large")
+)
+
+// compileErrorCodes maps the error codes of re2, indexed from 1, to their errors and to
+// the codes of the standard library, whose messages match re2's for the same problems.
+var compileErrorCodes = [...]struct {
+	err  error
+	code syntax.ErrorCode
+}{
+	{ErrInternal, syntax.ErrInternalError},
+	{ErrBadEscape, syntax.ErrInvalidEscape},
+	{ErrBadCharClass, syntax.ErrInvalidCharClass},
+	{ErrBadCharRange, syntax.ErrInvalidCharRange},
+	{ErrMissingBracket, syntax.ErrMissingBracket},
+	{ErrMissingParen, syntax.ErrMissingParen},
+	{ErrUnexpectedParen, syntax.ErrUnexpectedParen},
+	{ErrTrailingBackslash, syntax.ErrTrailingBackslash},
+	{ErrRepeatArgument, syntax.ErrMissingRepeatArgument},
+	{ErrRepeatSize, syntax.ErrInvalidRepeatSize},
+	{ErrRepeatOp, syntax.ErrInvalidRepeatOp},
+	{ErrBadPerlOp, syntax.ErrInvalidPerlOp},
+	{ErrBadUTF8, syntax.ErrInvalidUTF8},
+	{ErrBadNamedCapture, syntax.ErrInvalidNamedCapture},
+	// syntax.ErrLarge, only defined since Go 1.20.
+	{ErrPatternTooLarge, syntax.ErrorCode("expression too large")},
+}
+
+// syntaxError is an error compiling an expression, with the message of the standard
+// library's *syntax.Error it unwraps to, that is also one of the errors of re2's codes.
+type syntaxError struct {
+	std *syntax.Error
+	err error
+}
+
+func (e *syntaxError) Error() string {
+	return e.std.Error()
+}
+
+func (e *syntaxError) Unwrap() error {
+	return e.std
+}
+
+func (e *syntaxError) Is(target error) bool {
+	return target == e.err
+}
+
+// compileError converts an error code and argument returned by re2 into the error for
+// the code, wrapping the same *syntax.Error the standard library returns for the failure.
+func compileError(errCode int, errArg string, expr string) error {
+	if errCode < 1 || errCode > len(compileErrorCodes) {
+		return fmt.Errorf("error parsing regexp: unknown error code %d: %#q", errCode, expr)
+	}
+	code := compileErrorCodes[errCode-1].code
+	switch code {
+	case syntax.ErrInvalidUTF8:
+		// re2 doesn't report the invalid text, which the standard library reports
+		// from the first invalid byte.
+		for i, r := range expr {
+			if r == utf8.RuneError {
+				if _, size := utf8.DecodeRuneInString(expr[i:]); size == 1 {
+					errArg = expr[i:]
+					break
+				}
+			}
+		}
+	case syntax.ErrorCode("expression too large"):
+		// TODO(anuraaga): While the unit test passes, it is likely that the actual limit is currently
+		// different than regexp.
+		errArg = expr
+	}
+	return &syntaxError{std: &syntax.Error{Code: code, Expr: errArg}, err: compileErrorCodes[errCode-1].err}
+}
+
+// Valid returns nil if expr is a valid expression, or else the error Compile returns for
+// it. The expression is compiled and then freed immediately, which is cheaper than
+// discarding the Regexp returned by Compile as nothing is left for the garbage collector
+// to finalize. With wazero, all validations reuse a single module, so they don't fill
+// the modules that compiled expressions share.
+func Valid(expr string) error {
+	abi, err := acquireScratchABI()
+	if err != nil {
+		return fmt.Errorf("re2: failed to instantiate module: %w", err)
+	}
+	re, err := compileInstance(expr, Options{}, abi)
+	if err != nil {
+		return err
+	}
+	return release(re)
+}
+
 // MustCompile is like Compile but panics if the expression cannot be parsed.
 // It simplifies safe initialization of global variables holding compiled regular
 // expressions.
@@ -175,6 +672,17 @@ func MustCompile(str string) *Regexp {
 	return re
 }
 
+// MustCompileWith is like CompileWith but panics if the expression cannot be compiled
+// with opts, e.g., as they are invalid. It simplifies safe initialization of global
+// variables holding compiled regular expressions.
+func MustCompileWith(str string, opts Options) *Regexp {
+	re, err := CompileWith(str, opts)
+	if err != nil {
+		panic(`regexp: CompileWith(` + quote(str) + `): ` + err.Error())
+	}
+	return re
+}
+
 // MustCompilePOSIX is like CompilePOSIX but panics if the expression cannot be parsed.
 // It simplifies safe initialization of global variables holding compiled regular
 // expressions.
@@ -193,6 +701,18 @@ func quote(s string) string {
 	return strconv.Quote(s)
 }
 
+// re2Commit is the commit of google/re2 that libcre2.so is built from. It must
+// match RE2_COMMIT in buildtools/re2/Dockerfile.
+const re2Commit = "954656f47fe8fb505d4818da1e128417a79ea500"
+
+// Version returns the version of the RE2 library bundled with this package, as
+// the commit of github.com/google/re2 it was built from. It changes whenever
+// the underlying engine is updated, so it can be logged or checked to confirm
+// which engine is in use.
+func Version() string {
+	return re2Commit
+}
+
 // QuoteMeta returns a string that escapes all regular expression metacharacters
 // inside the argument text; the returned string is a regular expression matching
 // the literal text.
@@ -277,8 +797,8 @@ func (re *Regexp) expand(dst []byte, template string, bsrc []byte, src string, m
 // Find returns a slice holding the text of the leftmost match in b of the regular expression.
 // A return value of nil indicates no match.
 func (re *Regexp) Find(b []byte) []byte {
-	re.abi.startOperation(len(b) + 8)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b) + 8)
+	defer re.endOperation()
 
 	cs := newCStringFromBytes(re.abi, b)
 
@@ -293,8 +813,8 @@ func (re *Regexp) Find(b []byte) []byte {
 // b[loc[0]:loc[1]].
 // A return value of nil indicates no match.
 func (re *Regexp) FindIndex(b []byte) (loc []int) {
-	re.abi.startOperation(len(b) + 8)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b) + 8)
+	defer re.endOperation()
 	cs := newCStringFromBytes(re.abi, b)
 
 	return re.find(cs, nil)
@@ -306,8 +826,8 @@ func (re *Regexp) FindIndex(b []byte) (loc []int) {
 // an empty string. Use FindStringIndex or FindStringSubmatch if it is
 // necessary to distinguish these cases.
 func (re *Regexp) FindString(s string) string {
-	re.abi.startOperation(len(s) + 8)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s) + 8)
+	defer re.endOperation()
 	cs := newCString(re.abi, s)
 
 	var dstCap [2]int
@@ -321,13 +841,35 @@ func (re *Regexp) FindString(s string) string {
 // itself is at s[loc[0]:loc[1]].
 // A return value of nil indicates no match.
 func (re *Regexp) FindStringIndex(s string) (loc []int) {
-	re.abi.startOperation(len(s) + 8)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s) + 8)
+	defer re.endOperation()
 	cs := newCString(re.abi, s)
 
 	return re.find(cs, nil)
 }
 
+// FindStringIndexFrom is like FindStringIndex but only finds matches starting at or
+// after the byte offset start, e.g., to resume matching an incrementally processed
+// buffer without reslicing it. The text before start is still considered for context,
+// so that \b or (?m)^ at start behave as within the whole of s, while ^ without the
+// multi-line flag never matches after the beginning of s. The returned indexes are
+// offsets into s. A return value of nil indicates no match, including when start is
+// outside of s.
+func (re *Regexp) FindStringIndexFrom(s string, start int) []int {
+	if start < 0 || start > len(s) {
+		return nil
+	}
+	re = re.startOperation(len(s) + 8)
+	defer re.endOperation()
+	cs := newCString(re.abi, s)
+
+	matchArr := newCStringArray(re.abi, 1)
+	if !matchFrom(re, cs, start, matchArr.ptr, 1) {
+		return nil
+	}
+	return readMatch(re.abi, cs, matchArr.ptr, nil)
+}
+
 func (re *Regexp) find(cs cString, dstCap []int) []int {
 	matchArr := newCStringArray(re.abi, 1)
 
@@ -344,14 +886,14 @@ func (re *Regexp) find(cs cString, dstCap []int) []int {
 // package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindAll(b []byte, n int) [][]byte {
-	re.abi.startOperation(len(b) + 16)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b) + 16)
+	defer re.endOperation()
 
 	cs := newCStringFromBytes(re.abi, b)
 
 	var matches [][]byte
 
-	re.findAll(cs, n, func(match []int) {
+	re.findAll(cs, b, "", n, func(match []int) {
 		matches = append(matches, matchedBytes(b, match))
 	})
 
@@ -363,14 +905,14 @@ func (re *Regexp) FindAll(b []byte, n int) [][]byte {
 // in the package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindAllIndex(b []byte, n int) [][]int {
-	re.abi.startOperation(len(b) + 16)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b) + 16)
+	defer re.endOperation()
 
 	cs := newCStringFromBytes(re.abi, b)
 
 	var matches [][]int
 
-	re.findAll(cs, n, func(match []int) {
+	re.findAll(cs, b, "", n, func(match []int) {
 		matches = append(matches, append([]int(nil), match...))
 	})
 
@@ -382,42 +924,212 @@ func (re *Regexp) FindAllIndex(b []byte, n int) [][]int {
 // in the package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindAllString(s string, n int) []string {
-	re.abi.startOperation(len(s) + 16)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s) + 16)
+	defer re.endOperation()
 
 	cs := newCString(re.abi, s)
 
 	var matches []string
 
-	re.findAll(cs, n, func(match []int) {
+	re.findAll(cs, nil, s, n, func(match []int) {
 		matches = append(matches, matchedString(s, match))
 	})
 
 	return matches
 }
 
+// FindAllStringOverlapping is like FindAllString but returns overlapping matches,
+// resuming the search after each match one character past its start rather than at its
+// end, so that aa matches "aaaa" three times instead of two. It returns the leftmost
+// match starting at each position where there is one, not every match starting there,
+// e.g., only "ab" for ab|a. As every match may extend to the end of s, finding them can
+// take time quadratic in the length of s.
+func (re *Regexp) FindAllStringOverlapping(s string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	re = re.startOperation(len(s) + 8)
+	defer re.endOperation()
+
+	cs := newCString(re.abi, s)
+	matchArr := newCStringArray(re.abi, 1)
+
+	var matches []string
+	var dstCap [2]int
+	for start := 0; n < 0 || len(matches) < n; {
+		if !matchFrom(re, cs, start, matchArr.ptr, 1) {
+			break
+		}
+		loc := readMatch(re.abi, cs, matchArr.ptr, dstCap[:0])
+		matches = append(matches, s[loc[0]:loc[1]])
+		if loc[0] == len(s) {
+			break
+		}
+		start = loc[0] + re.charWidth(nil, s, loc[0])
+	}
+
+	return matches
+}
+
 // FindAllStringIndex is the 'All' version of FindStringIndex; it returns a
 // slice of all successive matches of the expression, as defined by the 'All'
 // description in the package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindAllStringIndex(s string, n int) [][]int {
-	re.abi.startOperation(len(s) + 16)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s) + 16)
+	defer re.endOperation()
 
 	cs := newCString(re.abi, s)
 
 	var matches [][]int
 
-	re.findAll(cs, n, func(match []int) {
+	re.findAll(cs, nil, s, n, func(match []int) {
 		matches = append(matches, append([]int(nil), match...))
 	})
 
 	return matches
 }
 
-func (re *Regexp) findAll(cs cString, n int, deliver func(match []int)) {
+// EachMatchIndex calls fn with the indexes of successive matches of the expression in s,
+// up to n as with FindAllStringIndex, until fn returns false. It is like
+// FindAllStringIndex without allocating a slice for each match. The loc slice is reused
+// between calls, so fn must copy it to retain it.
+//
+// Matches are found in batches, with fn called for each batch outside of matching so that
+// fn may use the Regexp, and no further batches are found once fn returns false. Batches
+// start small and double in size, as s is copied into the module for each of them.
+func (re *Regexp) EachMatchIndex(s string, n int, fn func(loc []int) bool) {
+	re.eachMatch(s, n, false, func(locs []int) bool {
+		for i := 0; i < len(locs); i += 2 {
+			if !fn(locs[i : i+2 : i+2]) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// firstMatchBatch is the number of matches in the first batch found by eachMatch.
+const firstMatchBatch = 16
+
+// eachMatch finds up to n successive matches of the expression in s in batches of
+// increasing size, calling fn with the flat indexes of each batch after its operation
+// ended, until fn returns false. With submatch, the indexes of a match are followed by
+// those of its submatches, as with FindAllStringSubmatchIndex.
+func (re *Regexp) eachMatch(s string, n int, submatch bool, fn func(locs []int) bool) {
+	if n < 0 {
+		n = len(s) + 1
+	}
+	groups := 1
+	if submatch {
+		groups = len(re.subexpNames)
+	}
+	st := findState{prevMatchEnd: -1}
+	var locs []int
+	for batch := firstMatchBatch; n > 0 && !st.done; batch *= 2 {
+		if batch > n {
+			batch = n
+		}
+		locs = re.findBatch(locs[:0], s, batch, submatch, &st)
+		if !fn(locs) {
+			return
+		}
+		n -= len(locs) / (2 * groups)
+	}
+}
+
+// findBatch appends to dst the indexes of up to n successive matches of the expression in
+// s, and of their submatches with submatch, from where st was left, in an operation of its
+// own.
+func (re *Regexp) findBatch(dst []int, s string, n int, submatch bool, st *findState) []int {
+	deliver := func(match []int) bool {
+		dst = append(dst, match...)
+		return true
+	}
+	if !submatch {
+		re = re.startOperation(len(s) + 16)
+		defer re.endOperation()
+
+		re.findAllFrom(newCString(re.abi, s), nil, s, n, st, deliver)
+		return dst
+	}
+
+	re = re.startOperation(len(s) + 8*len(re.subexpNames) + 8)
+	defer re.endOperation()
+
+	re.findAllSubmatchFrom(newCString(re.abi, s), nil, s, n, st, deliver)
+	return dst
+}
+
+// AppendAllStringIndex appends to dst the indexes of all successive matches of the
+// expression in s, as defined by the 'All' description in the package comment, and
+// returns the extended slice. Each match is a pair of elements holding its start
+// and end, so that a dst reused across calls avoids the slice per match allocated
+// by FindAllStringIndex, reducing garbage for inputs with many matches.
+func (re *Regexp) AppendAllStringIndex(dst []int, s string) []int {
+	return re.appendAllStringIndex(dst, s, -1)
+}
+
+// appendAllStringIndex is like AppendAllStringIndex but appends at most n matches.
+func (re *Regexp) appendAllStringIndex(dst []int, s string, n int) []int {
+	re = re.startOperation(len(s) + 16)
+	defer re.endOperation()
+
+	cs := newCString(re.abi, s)
+
+	re.findAll(cs, nil, s, n, func(match []int) {
+		dst = append(dst, match...)
+	})
+
+	return dst
+}
+
+// CountMatches returns the number of successive matches of the expression in s, as
+// defined by the 'All' description in the package comment, which is the length of
+// the result of FindAllString(s, -1) without allocating it.
+func (re *Regexp) CountMatches(s string) int {
+	re = re.startOperation(len(s) + 8)
+	defer re.endOperation()
+
+	cs := newCString(re.abi, s)
+
+	count := 0
+	re.findAll(cs, nil, s, -1, func([]int) {
+		count++
+	})
+
+	return count
+}
+
+func (re *Regexp) findAll(cs cString, b []byte, s string, n int, deliver func(match []int)) {
+	re.findAllUntil(cs, b, s, n, func(match []int) bool {
+		deliver(match)
+		return true
+	})
+}
+
+// findAllUntil is like findAll but stops finding matches when deliver returns false.
+func (re *Regexp) findAllUntil(cs cString, b []byte, s string, n int, deliver func(match []int) bool) {
+	st := findState{prevMatchEnd: -1}
+	re.findAllFrom(cs, b, s, n, &st, deliver)
+}
+
+// findState is where finding successive matches continues from, so that they can be
+// found in batches of separate operations.
+type findState struct {
+	pos          int
+	prevMatchEnd int
+	// done is set once there are no further matches.
+	done bool
+}
+
+// findAllFrom is like findAllUntil but finds matches from where st was left, updating it.
+func (re *Regexp) findAllFrom(cs cString, b []byte, s string, n int, st *findState, deliver func(match []int) bool) {
 	var dstCap [2]int
 
+	if n == 0 {
+		return
+	}
 	if n < 0 {
 		n = cs.length + 1
 	}
@@ -425,10 +1137,9 @@ func (re *Regexp) findAll(cs cString, n int, deliver func(match []int)) {
 	matchArr := newCStringArray(re.abi, 1)
 
 	count := 0
-	prevMatchEnd := -1
-	pos := 0
-	for pos < cs.length+1 {
-		if !matchFrom(re, cs, pos, matchArr.ptr, 1) {
+	for {
+		if st.pos >= cs.length+1 || !matchFrom(re, cs, st.pos, matchArr.ptr, 1) {
+			st.done = true
 			break
 		}
 
@@ -436,20 +1147,22 @@ func (re *Regexp) findAll(cs cString, n int, deliver func(match []int)) {
 		accept := true
 		if matches[0] == matches[1] {
 			// We've found an empty match.
-			if matches[0] == prevMatchEnd {
+			if matches[0] == st.prevMatchEnd {
 				// We don't allow an empty match right
 				// after a previous match, so ignore it.
 				accept = false
 			}
-			pos++
+			st.pos = matches[1] + re.charWidth(b, s, matches[1])
 		} else {
-			pos = matches[1]
+			st.pos = matches[1]
 		}
+		st.prevMatchEnd = matches[1]
 		if accept {
-			deliver(matches)
+			if !deliver(matches) {
+				break
+			}
 			count++
 		}
-		prevMatchEnd = matches[1]
 
 		if count == n {
 			break
@@ -462,17 +1175,17 @@ func (re *Regexp) findAll(cs cString, n int, deliver func(match []int)) {
 // description in the package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindAllSubmatch(b []byte, n int) [][][]byte {
-	re.abi.startOperation(len(b) + 8*len(re.subexpNames) + 8)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b) + 8*len(re.subexpNames) + 8)
+	defer re.endOperation()
 
 	cs := newCStringFromBytes(re.abi, b)
 
 	var matches [][][]byte
 
-	re.findAllSubmatch(cs, n, func(match [][]int) {
-		matched := make([][]byte, len(match))
-		for i, m := range match {
-			matched[i] = matchedBytes(b, m)
+	re.findAllSubmatch(cs, b, "", n, func(match []int) {
+		matched := make([][]byte, len(match)/2)
+		for i := range matched {
+			matched[i] = matchedBytes(b, match[2*i:2*i+2])
 		}
 		matches = append(matches, matched)
 	})
@@ -485,19 +1198,15 @@ func (re *Regexp) FindAllSubmatch(b []byte, n int) [][][]byte {
 // 'All' description in the package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindAllSubmatchIndex(b []byte, n int) [][]int {
-	re.abi.startOperation(len(b) + 8*len(re.subexpNames) + 8)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b) + 8*len(re.subexpNames) + 8)
+	defer re.endOperation()
 
 	cs := newCStringFromBytes(re.abi, b)
 
 	var matches [][]int
 
-	re.findAllSubmatch(cs, n, func(match [][]int) {
-		var flat []int
-		for _, m := range match {
-			flat = append(flat, m...)
-		}
-		matches = append(matches, flat)
+	re.findAllSubmatch(cs, b, "", n, func(match []int) {
+		matches = append(matches, append([]int(nil), match...))
 	})
 
 	return matches
@@ -508,17 +1217,17 @@ func (re *Regexp) FindAllSubmatchIndex(b []byte, n int) [][]int {
 // the 'All' description in the package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindAllStringSubmatch(s string, n int) [][]string {
-	re.abi.startOperation(len(s) + 8*len(re.subexpNames) + 8)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s) + 8*len(re.subexpNames) + 8)
+	defer re.endOperation()
 
 	cs := newCString(re.abi, s)
 
 	var matches [][]string
 
-	re.findAllSubmatch(cs, n, func(match [][]int) {
-		matched := make([]string, len(match))
-		for i, m := range match {
-			matched[i] = matchedString(s, m)
+	re.findAllSubmatch(cs, nil, s, n, func(match []int) {
+		matched := make([]string, len(match)/2)
+		for i := range matched {
+			matched[i] = matchedString(s, match[2*i:2*i+2])
 		}
 		matches = append(matches, matched)
 	})
@@ -532,62 +1241,109 @@ func (re *Regexp) FindAllStringSubmatch(s string, n int) [][]string {
 // comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindAllStringSubmatchIndex(s string, n int) [][]int {
-	re.abi.startOperation(len(s) + 8*len(re.subexpNames) + 8)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s) + 8*len(re.subexpNames) + 8)
+	defer re.endOperation()
 
 	cs := newCString(re.abi, s)
 
 	var matches [][]int
 
-	re.findAllSubmatch(cs, n, func(match [][]int) {
-		var flat []int
-		for _, m := range match {
-			flat = append(flat, m...)
-		}
-		matches = append(matches, flat)
+	re.findAllSubmatch(cs, nil, s, n, func(match []int) {
+		matches = append(matches, append([]int(nil), match...))
 	})
 
 	return matches
 }
 
-func (re *Regexp) findAllSubmatch(cs cString, n int, deliver func(match [][]int)) {
+// EachSubmatch calls fn with the index and text of each group of successive matches of
+// the expression in s, as defined by the 'All' description in the package comment,
+// until fn returns false, e.g., for extracting fields of log lines without allocating
+// slices for them. The groups of a match are passed in order, starting with 0 for the
+// whole match, before those of the next one. Groups that did not participate in a match
+// are skipped, so that fn is only called with text that was matched.
+//
+// As with EachMatchIndex, matches are found in batches, with fn called for each batch
+// outside of matching so that fn may use the Regexp, and no further batches are found once
+// fn returns false.
+func (re *Regexp) EachSubmatch(s string, fn func(groupIndex int, text string) bool) {
+	groups := len(re.subexpNames)
+	re.eachMatch(s, -1, true, func(locs []int) bool {
+		for i := 0; i < len(locs); i += 2 {
+			if locs[i] < 0 {
+				continue
+			}
+			if !fn(i/2%groups, s[locs[i]:locs[i+1]]) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// findAllSubmatch calls deliver with the offsets of each successive match and its
+// submatches, two per group with -1 for groups that did not participate. The offsets
+// are read into a single buffer reused for every match, so deliver must copy them
+// to retain them.
+func (re *Regexp) findAllSubmatch(cs cString, b []byte, s string, n int, deliver func(match []int)) {
+	re.findAllSubmatchUntil(cs, b, s, n, func(match []int) bool {
+		deliver(match)
+		return true
+	})
+}
+
+// findAllSubmatchUntil is like findAllSubmatch but stops finding matches when deliver
+// returns false.
+func (re *Regexp) findAllSubmatchUntil(cs cString, b []byte, s string, n int, deliver func(match []int) bool) {
+	st := findState{prevMatchEnd: -1}
+	re.findAllSubmatchFrom(cs, b, s, n, &st, deliver)
+}
+
+// findAllSubmatchFrom is like findAllSubmatchUntil but finds matches from where st was
+// left, updating it.
+func (re *Regexp) findAllSubmatchFrom(cs cString, b []byte, s string, n int, st *findState, deliver func(match []int) bool) {
+	if n == 0 {
+		return
+	}
 	if n < 0 {
 		n = cs.length + 1
 	}
 
 	numGroups := len(re.subexpNames)
 	matchArr := newCStringArray(re.abi, numGroups)
+	match := make([]int, 0, 2*numGroups)
 
 	count := 0
-	prevMatchEnd := -1
-	pos := 0
-	for pos < cs.length+1 {
-		if !matchFrom(re, cs, pos, matchArr.ptr, uint32(numGroups)) {
+	for {
+		if st.pos >= cs.length+1 || !matchFrom(re, cs, st.pos, matchArr.ptr, uint32(numGroups)) {
+			st.done = true
 			break
 		}
 
-		var matches [][]int
+		match = match[:0]
+		readMatches(re.abi, cs, matchArr.ptr, numGroups, func(group []int) {
+			match = append(match, group...)
+		})
+
 		accept := true
-		readMatches(re.abi, cs, matchArr.ptr, numGroups, func(match []int) {
-			if len(matches) == 0 {
-				// First match, check if it's an empty match following a match, which we ignore.
-				// TODO: Don't iterate further when ignoring.
-				if match[0] == match[1] {
-					if match[0] == prevMatchEnd {
-						accept = false
-					}
-					pos++
-				} else {
-					pos = match[1]
-				}
-				prevMatchEnd = match[1]
+		if match[0] == match[1] {
+			// We've found an empty match.
+			if match[0] == st.prevMatchEnd {
+				// We don't allow an empty match right
+				// after a previous match, so ignore it.
+				accept = false
 			}
-			matches = append(matches, append([]int(nil), match...))
-		})
+			st.pos = match[1] + re.charWidth(b, s, match[1])
+		} else {
+			st.pos = match[1]
+		}
+		st.prevMatchEnd = match[1]
+
 		if accept {
-			deliver(matches)
+			if !deliver(match) {
+				break
+			}
+			count++
 		}
-		count++
 
 		if count == n {
 			break
@@ -601,8 +1357,8 @@ func (re *Regexp) findAllSubmatch(cs cString, n int, deliver func(match [][]int)
 // comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindSubmatch(b []byte) [][]byte {
-	re.abi.startOperation(len(b) + 8*len(re.subexpNames))
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b) + 8*len(re.subexpNames))
+	defer re.endOperation()
 
 	cs := newCStringFromBytes(re.abi, b)
 
@@ -621,8 +1377,8 @@ func (re *Regexp) FindSubmatch(b []byte) [][]byte {
 // in the package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindSubmatchIndex(b []byte) []int {
-	re.abi.startOperation(len(b) + 8*len(re.subexpNames))
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b) + 8*len(re.subexpNames))
+	defer re.endOperation()
 
 	cs := newCStringFromBytes(re.abi, b)
 
@@ -636,8 +1392,8 @@ func (re *Regexp) FindSubmatchIndex(b []byte) []int {
 }
 
 func (re *Regexp) FindStringSubmatch(s string) []string {
-	re.abi.startOperation(len(s) + 8*len(re.subexpNames))
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s) + 8*len(re.subexpNames))
+	defer re.endOperation()
 
 	cs := newCString(re.abi, s)
 
@@ -650,14 +1406,40 @@ func (re *Regexp) FindStringSubmatch(s string) []string {
 	return matches
 }
 
+// FindStringSubmatchMap is like FindStringSubmatch but returns a map from the name of
+// each subexpression to the text it matched, e.g., for templates, with unnamed ones keyed
+// by their number and the whole match by "0". Subexpressions that did not participate in
+// the match are not in the map. A name made of digits may collide with the number of an
+// unnamed subexpression, in which case the named one is kept if it participated in the
+// match. A return value of nil indicates no match.
+func (re *Regexp) FindStringSubmatchMap(s string) map[string]string {
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return nil
+	}
+
+	m := make(map[string]string, len(re.subexpNames))
+	for i, name := range re.subexpNames {
+		if loc[2*i] >= 0 && name == "" {
+			m[strconv.Itoa(i)] = s[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	for i, name := range re.subexpNames {
+		if loc[2*i] >= 0 && name != "" {
+			m[name] = s[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	return m
+}
+
 // FindStringSubmatchIndex returns a slice holding the index pairs
 // identifying the leftmost match of the regular expression in s and the
 // matches, if any, of its subexpressions, as defined by the 'Submatch' and
 // 'Index' descriptions in the package comment.
 // A return value of nil indicates no match.
 func (re *Regexp) FindStringSubmatchIndex(s string) []int {
-	re.abi.startOperation(len(s) + 8*len(re.subexpNames))
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s) + 8*len(re.subexpNames))
+	defer re.endOperation()
 
 	cs := newCString(re.abi, s)
 
@@ -670,6 +1452,41 @@ func (re *Regexp) FindStringSubmatchIndex(s string) []int {
 	return matches
 }
 
+// FindStringSubmatchRuneIndex is like FindStringSubmatchIndex but the returned offsets
+// count runes instead of bytes, e.g., for positions in editors working with runes.
+// Invalid UTF-8 bytes count as a rune each, as with utf8.RuneCountInString, and a rune
+// is a code point, so combining characters count separately from the ones they modify.
+//
+// Converting the offsets decodes s up to the end of the match, so it costs time linear
+// in the position of the match on top of finding it.
+func (re *Regexp) FindStringSubmatchRuneIndex(s string) []int {
+	loc := re.FindStringSubmatchIndex(s)
+	byteToRuneIndex(s, loc)
+	return loc
+}
+
+// byteToRuneIndex converts the byte offsets into s in loc to rune offsets in place,
+// leaving the -1 of unmatched subexpressions, decoding s only once.
+func byteToRuneIndex(s string, loc []int) {
+	order := make([]int, 0, len(loc))
+	for i, off := range loc {
+		if off >= 0 {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(a, b int) bool { return loc[order[a]] < loc[order[b]] })
+
+	pos, runes := 0, 0
+	for _, i := range order {
+		for pos < loc[i] {
+			_, size := utf8.DecodeRuneInString(s[pos:])
+			pos += size
+			runes++
+		}
+		loc[i] = runes
+	}
+}
+
 func (re *Regexp) findSubmatch(cs cString, deliver func(match []int)) {
 	numGroups := len(re.subexpNames)
 	matchArr := newCStringArray(re.abi, numGroups)
@@ -681,25 +1498,139 @@ func (re *Regexp) findSubmatch(cs cString, deliver func(match []int)) {
 	readMatches(re.abi, cs, matchArr.ptr, numGroups, deliver)
 }
 
+// LiteralPrefix returns a literal string that must begin any match
+// of the regular expression re. It returns the boolean true if the
+// literal string comprises the entire regular expression.
+//
+// re2 does not expose the prefix it computes, so the expression is analyzed
+// with the standard library parser instead. If it uses syntax not supported
+// by the standard library or Options.Latin1, an empty prefix is returned.
+func (re *Regexp) LiteralPrefix() (prefix string, complete bool) {
+	std, err := re.stdlib()
+	if err != nil {
+		return "", false
+	}
+	return std.LiteralPrefix()
+}
+
+// LiteralSuffix is like LiteralPrefix but returns a literal string that must end any
+// match of the regular expression re, e.g., for filtering candidates with an index of
+// reversed text. Like LiteralPrefix, it returns true if the literal string comprises the
+// entire regular expression.
+//
+// The suffix is extracted syntactically and conservatively from the literal text at the
+// end of the expression, skipping assertions like $ and common to all alternatives, so
+// it may be shorter than the longest suffix matches must have. An empty suffix is
+// returned for expressions compiled with Latin1 or using syntax specific to re2.
+func (re *Regexp) LiteralSuffix() (suffix string, complete bool) {
+	if re.opts.Latin1 {
+		return "", false
+	}
+	parsed, err := re.parseSyntax()
+	if err != nil {
+		return "", false
+	}
+	suffix, _ = literalSuffix(parsed)
+	literal := parsed.Op == syntax.OpLiteral && parsed.Flags&syntax.FoldCase == 0
+	return suffix, literal || parsed.Op == syntax.OpEmptyMatch
+}
+
+// stdlib compiles the expression with the standard library for the analysis of its
+// syntax, returning an error if it is not supported by the standard library.
+func (re *Regexp) stdlib() (*regexp.Regexp, error) {
+	if re.opts.Latin1 {
+		return nil, errors.New("re2: Latin-1 expressions are not supported by the standard library")
+	}
+	if re.opts.NeverNL {
+		return nil, errors.New("re2: NeverNL expressions are not supported by the standard library")
+	}
+	expr := re.expr
+	if re.opts.Literal {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if re.opts.CaseInsensitive {
+		expr = "(?i:" + expr + ")"
+	}
+	if re.opts.DotNL {
+		expr = "(?s:" + expr + ")"
+	}
+	if re.opts.POSIX {
+		return regexp.CompilePOSIX(expr)
+	}
+	return regexp.Compile(expr)
+}
+
 // Longest makes future searches prefer the leftmost-longest match.
 // That is, when matching against text, the regexp returns a match that
 // begins as early as possible in the input (leftmost), and among those
 // it chooses a match that is as long as possible.
 // This method modifies the Regexp and may not be called concurrently
 // with any other methods.
+//
+// re2 fixes the match semantics when compiling an expression, so unlike the standard
+// library, which only sets a flag, Longest compiles the expression again, with about
+// the cost of compiling it in the first place.
 func (re *Regexp) Longest() {
 	re.abi.startOperation(len(re.expr) + 2)
 	defer re.abi.endOperation()
 
-	if re.longest {
+	if re.opts.Longest {
 		return
 	}
+	re.opts.Longest = true
 
 	// longest is not a mutable option in re2 so we must release and recompile.
 	deleteRE(re.abi, re.ptr)
 
 	cs := newCString(re.abi, re.expr)
-	re.ptr = newRE(re.abi, cs, true, re.posix, false)
+	re.ptr = newRE(re.abi, cs, re.opts)
+	if re.owner != nil {
+		re.owner.ptr, re.owner.opts = re.ptr, re.opts
+	}
+
+	// Spares were compiled without longest, new ones will be created as needed. Longest
+	// cannot report an error, and failing to close their modules leaves nothing to undo.
+	_ = re.releaseSpares()
+}
+
+// Stats describes a compiled expression, as returned by Regexp.Stats.
+//
+// It does not report whether matching uses the NFA or the DFA of re2, which is not a
+// property of the expression: re2 picks an engine for each match depending on the
+// text, the anchoring and whether submatches are requested, falling back to the NFA
+// when the DFA runs out of MaxMem.
+type Stats struct {
+	// ProgramSize is re2's measure of the size of the compiled program, as limited by
+	// Options.MaxProgramSize, or -1 if the bundled library does not report it, i.e., with
+	// wazero when the embedded libcre2 does not export cre2_program_size.
+	ProgramSize int
+
+	// NumCaptureGroups is the number of capturing groups, as returned by NumSubexp.
+	NumCaptureGroups int
+
+	// MaxMem is the memory budget of the expression for its program and automata, as
+	// set by Options.MaxMem or re2's default otherwise.
+	MaxMem int64
+}
+
+// defaultMaxMem is the default of re2 for Options.MaxMem.
+const defaultMaxMem = 8 << 20
+
+// Stats returns statistics about the compiled expression, e.g., for finding which of a
+// set of expressions uses the most memory.
+func (re *Regexp) Stats() Stats {
+	re = re.startOperation(0)
+	defer re.endOperation()
+
+	maxMem := re.opts.MaxMem
+	if maxMem == 0 {
+		maxMem = defaultMaxMem
+	}
+	return Stats{
+		ProgramSize:      programSize(re.abi, re.ptr),
+		NumCaptureGroups: re.NumSubexp(),
+		MaxMem:           maxMem,
+	}
 }
 
 // NumSubexp returns the number of parenthesized subexpressions in this Regexp.
@@ -792,8 +1723,8 @@ func (re *Regexp) SubexpIndex(name string) int {
 // Match reports whether the byte slice b
 // contains any match of the regular expression re.
 func (re *Regexp) Match(b []byte) bool {
-	re.abi.startOperation(len(b))
-	defer re.abi.endOperation()
+	re = re.startOperation(len(b))
+	defer re.endOperation()
 
 	cs := newCStringFromBytes(re.abi, b)
 	res := match(re, cs, 0, 0)
@@ -801,11 +1732,478 @@ func (re *Regexp) Match(b []byte) bool {
 	return res
 }
 
+// MatchReader reports whether the text returned by the RuneReader
+// contains any match of the regular expression re.
+//
+// re2 can only match text in contiguous memory, so unlike the standard library,
+// which reads only as much as needed, MatchReader reads all of the text from r
+// until io.EOF before matching. It is not suitable for streams that are unbounded
+// or too large to hold in memory. If r returns any other error, MatchReader
+// returns false.
+func (re *Regexp) MatchReader(r io.RuneReader) bool {
+	matched, _ := re.matchReader(r)
+	return matched
+}
+
+func (re *Regexp) matchReader(r io.RuneReader) (bool, error) {
+	b, err := readRunes(nil, r, -1)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return re.Match(b), nil
+}
+
+// readerChunkSize is the number of bytes FindReaderIndex reads from its RuneReader at a
+// time, and maxReaderWindow the longest bounded match it searches in a window rather than
+// reading all of the text.
+const (
+	readerChunkSize = 64 << 10
+	maxReaderWindow = 1 << 20
+)
+
+// FindReaderIndex returns a two-element slice of integers defining the
+// location of the leftmost match of the regular expression in text read from
+// the RuneReader. The match text was found in the input stream at
+// byte offset loc[0] through loc[1]-1.
+// A return value of nil indicates no match.
+//
+// re2 can only match text in contiguous memory, so text is read from r in chunks.
+// When matches of the expression have a bounded length, e.g., without * or +,
+// only enough of the previous chunk to hold a match straddling chunks is kept, so
+// that streams too large to hold in memory can be searched. Otherwise, all of the
+// text is read until io.EOF before matching, as with MatchReader. Offsets count
+// the UTF-8 encoding of the runes read, which only differs from the bytes read if
+// the input is not valid UTF-8. If r returns an error other than io.EOF,
+// FindReaderIndex returns nil.
+func (re *Regexp) FindReaderIndex(r io.RuneReader) []int {
+	loc, _ := re.findReaderIndex(r)
+	return loc
+}
+
+func (re *Regexp) findReaderIndex(r io.RuneReader) ([]int, error) {
+	width, ok := re.MaxMatchLen()
+	if !ok || width > maxReaderWindow {
+		b, err := readRunes(nil, r, -1)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return re.FindIndex(b), nil
+	}
+
+	// buf holds the text from offset base, in which matches may start from offset from.
+	var buf []byte
+	base, from := 0, 0
+	for {
+		var err error
+		buf, err = readRunes(buf, r, from+width+readerChunkSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		eof := err == io.EOF
+
+		// A match is final when all of the text it could span was read, as the text
+		// that follows can neither make a match starting earlier nor change it.
+		loc := re.findIndexFrom(buf, from)
+		if loc != nil && (eof || loc[0]+width < len(buf)) {
+			return []int{base + loc[0], base + loc[1]}, nil
+		}
+		if eof {
+			return nil, nil
+		}
+
+		// No match starts before next, keep the text after it and the character before
+		// it, which is needed to match \b and not match ^ at next.
+		next := len(buf) - width
+		cut := next - 1
+		for cut > 0 && !utf8.RuneStart(buf[cut]) {
+			cut--
+		}
+		buf = append(buf[:0], buf[cut:]...)
+		base += cut
+		from = next - cut
+	}
+}
+
+// readerAtWindowSize is the number of bytes FindAllReaderAtIndex reads at a time, set with
+// SetReaderAtWindowSize.
+var readerAtWindowSize int64 = readerChunkSize
+
+// SetReaderAtWindowSize sets the number of bytes FindAllReaderAtIndex reads from its
+// io.ReaderAt at a time, 64 KiB by default, on top of the text kept from the previous
+// window for matches straddling them. Larger windows mean fewer reads and calls into re2
+// at the expense of more memory. A size that is not positive restores the default.
+func SetReaderAtWindowSize(size int) {
+	if size <= 0 {
+		size = readerChunkSize
+	}
+	atomic.StoreInt64(&readerAtWindowSize, int64(size))
+}
+
+// FindAllReaderAtIndex is the 'All' version of FindIndex for the size bytes of text read
+// from r, e.g., a memory-mapped file, returning the byte offsets of successive matches
+// in the text as defined by the 'All' description in the package comment. A return
+// value of nil indicates no match. If r returns an error reading the text, it is
+// returned with the matches found before it.
+//
+// When matches of the expression have a bounded length, as reported by MaxMatchLen, the
+// text is read in windows set with SetReaderAtWindowSize, keeping enough of the previous
+// window to find matches straddling them, so that files too large to hold in memory can
+// be searched. Otherwise, all of the text is read before matching, so size must fit in
+// memory.
+func (re *Regexp) FindAllReaderAtIndex(r io.ReaderAt, size int64, n int) ([][]int, error) {
+	if n == 0 || size < 0 {
+		return nil, nil
+	}
+	width, ok := re.MaxMatchLen()
+	if !ok || width > maxReaderWindow {
+		b := make([]byte, size)
+		if err := readAtFull(r, b, 0); err != nil {
+			return nil, err
+		}
+		return re.FindAllIndex(b, n), nil
+	}
+	window := int(atomic.LoadInt64(&readerAtWindowSize))
+	// A match is final when the text it could span and the character after it, needed to
+	// advance past an empty match, were read.
+	margin := width + utf8.UTFMax
+
+	var matches [][]int
+	// buf holds the text from offset base, pos and prevMatchEnd are offsets in buf as in
+	// findAll.
+	var buf []byte
+	base := int64(0)
+	pos, prevMatchEnd := 0, -1
+	for {
+		want := len(buf) + window
+		if rest := size - base; int64(want) > rest {
+			want = int(rest)
+		}
+		if want > len(buf) {
+			read := len(buf)
+			buf = append(buf, make([]byte, want-read)...)
+			if err := readAtFull(r, buf[read:], base+int64(read)); err != nil {
+				return matches, err
+			}
+		}
+		eof := base+int64(len(buf)) == size
+
+		done := re.findAllInWindow(buf, eof, margin, &pos, &prevMatchEnd, func(loc []int) bool {
+			matches = append(matches, []int{int(base) + loc[0], int(base) + loc[1]})
+			return len(matches) < n || n < 0
+		})
+		if done || eof {
+			return matches, nil
+		}
+
+		// No more matches start before len(buf)-margin, so continue from there, keeping
+		// the character before pos, which is needed to match \b and not match ^ at pos.
+		if from := len(buf) - margin; pos < from {
+			pos = from
+			for pos > 0 && !utf8.RuneStart(buf[pos]) {
+				pos--
+			}
+		}
+		cut := pos - 1
+		for cut > 0 && !utf8.RuneStart(buf[cut]) {
+			cut--
+		}
+		if cut < 0 {
+			cut = 0
+		}
+		buf = append(buf[:0], buf[cut:]...)
+		base += int64(cut)
+		pos -= cut
+		prevMatchEnd -= cut
+	}
+}
+
+// findAllInWindow delivers the successive matches in buf from *pos, updating *pos and
+// *prevMatchEnd as in findAll, that are final, i.e., start more than margin bytes before
+// the end of buf unless eof, as the text that follows can neither make a match starting
+// earlier nor change them. It returns true if deliver returns false to stop finding
+// matches.
+func (re *Regexp) findAllInWindow(buf []byte, eof bool, margin int, pos *int, prevMatchEnd *int, deliver func(loc []int) bool) bool {
+	re = re.startOperation(len(buf) + 8)
+	defer re.endOperation()
+
+	cs := newCStringFromBytes(re.abi, buf)
+	matchArr := newCStringArray(re.abi, 1)
+
+	var dstCap [2]int
+	for *pos <= len(buf) {
+		if !matchFrom(re, cs, *pos, matchArr.ptr, 1) {
+			break
+		}
+		loc := readMatch(re.abi, cs, matchArr.ptr, dstCap[:0])
+		if !eof && loc[0]+margin >= len(buf) {
+			break
+		}
+
+		accept := true
+		if loc[0] == loc[1] {
+			// An empty match right after a previous match is ignored.
+			accept = loc[0] != *prevMatchEnd
+			*pos = loc[1] + re.charWidth(buf, "", loc[1])
+		} else {
+			*pos = loc[1]
+		}
+		*prevMatchEnd = loc[1]
+		if accept && !deliver(loc) {
+			return true
+		}
+	}
+	runtime.KeepAlive(buf)
+	return false
+}
+
+// readAtFull reads len(b) bytes from r at off into b, returning an error if they cannot all
+// be read.
+func readAtFull(r io.ReaderAt, b []byte, off int64) error {
+	n, err := r.ReadAt(b, off)
+	if n == len(b) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readRunes appends runes read from r to b until it is at least n bytes long, or until
+// an error if n is negative, returning the error, including io.EOF.
+func readRunes(b []byte, r io.RuneReader, n int) ([]byte, error) {
+	for n < 0 || len(b) < n {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return b, err
+		}
+		b = utf8.AppendRune(b, c)
+	}
+	return b, nil
+}
+
+// findIndexFrom returns the location of the leftmost match in b starting at or after
+// from, with the text before from as context for assertions like ^ and \b.
+func (re *Regexp) findIndexFrom(b []byte, from int) []int {
+	re = re.startOperation(len(b) + 8)
+	defer re.endOperation()
+
+	cs := newCStringFromBytes(re.abi, b)
+	matchArr := newCStringArray(re.abi, 1)
+
+	var loc []int
+	if matchFrom(re, cs, from, matchArr.ptr, 1) {
+		loc = readMatch(re.abi, cs, matchArr.ptr, nil)
+	}
+	runtime.KeepAlive(b)
+	return loc
+}
+
+// MaxMatchLen returns the maximum length in bytes of a match of the expression and
+// true, or false if matches are unbounded, as with the * and + operators, e.g., for
+// sizing buffers or the overlap of windows when searching a stream in chunks. The
+// length is an upper bound that may exceed the longest actual match, for example as
+// any character in a class is assumed to be as wide as the widest in it. Expressions
+// whose width cannot be determined, such as those compiled with Latin1 or using
+// syntax specific to re2, are reported as unbounded.
+func (re *Regexp) MaxMatchLen() (n int, bounded bool) {
+	if re.opts.Latin1 {
+		return 0, false
+	}
+	parsed, err := re.parseSyntax()
+	if err != nil {
+		return 0, false
+	}
+	return maxWidth(parsed)
+}
+
+// AnchoredStart reports whether matches of the expression can only start at the
+// beginning of the text, as when it starts with ^ without the (?m) flag, e.g., for
+// deciding whether a prefix index can be used. The check is syntactic and
+// conservative: it reports false for expressions it cannot tell are anchored, such as
+// those it cannot parse like MaxMatchLen.
+func (re *Regexp) AnchoredStart() bool {
+	parsed, err := re.parseSyntax()
+	return err == nil && anchored(parsed, false)
+}
+
+// AnchoredEnd is like AnchoredStart but reports whether matches of the expression can
+// only end at the end of the text, as when it ends with $ without the (?m) flag.
+func (re *Regexp) AnchoredEnd() bool {
+	parsed, err := re.parseSyntax()
+	return err == nil && anchored(parsed, true)
+}
+
+// parseSyntax parses the expression with the standard library using the flags
+// matching its options.
+func (re *Regexp) parseSyntax() (*syntax.Regexp, error) {
+	flags := syntax.Perl
+	if re.opts.POSIX {
+		flags = syntax.POSIX
+		if re.opts.OneLine {
+			flags |= syntax.OneLine
+		}
+	}
+	if re.opts.CaseInsensitive {
+		flags |= syntax.FoldCase
+	}
+	if re.opts.DotNL {
+		flags |= syntax.DotNL
+	}
+	if re.opts.Literal {
+		flags |= syntax.Literal
+	}
+	return syntax.Parse(re.expr, flags)
+}
+
+// anchored reports whether every match of re starts at the beginning of the text, or
+// ends at its end if atEnd, looking at the first or last element of concatenations.
+func anchored(re *syntax.Regexp, atEnd bool) bool {
+	switch re.Op {
+	case syntax.OpBeginText:
+		return !atEnd
+	case syntax.OpEndText:
+		return atEnd
+	case syntax.OpCapture:
+		return anchored(re.Sub[0], atEnd)
+	case syntax.OpConcat:
+		if len(re.Sub) == 0 {
+			return false
+		}
+		if atEnd {
+			return anchored(re.Sub[len(re.Sub)-1], atEnd)
+		}
+		return anchored(re.Sub[0], atEnd)
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if !anchored(sub, atEnd) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// literalSuffix returns the literal text that ends every match of re, and whether every
+// match is exactly that text, as for literals and, with empty text, assertions.
+func literalSuffix(re *syntax.Regexp) (string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return "", false
+		}
+		return string(re.Rune), true
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText,
+		syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return "", true
+	case syntax.OpCapture:
+		return literalSuffix(re.Sub[0])
+	case syntax.OpPlus:
+		suffix, _ := literalSuffix(re.Sub[0])
+		return suffix, false
+	case syntax.OpRepeat:
+		if re.Min == 0 {
+			return "", false
+		}
+		suffix, _ := literalSuffix(re.Sub[0])
+		return suffix, false
+	case syntax.OpConcat:
+		suffix := ""
+		for i := len(re.Sub) - 1; i >= 0; i-- {
+			s, exact := literalSuffix(re.Sub[i])
+			suffix = s + suffix
+			if !exact {
+				return suffix, false
+			}
+		}
+		return suffix, true
+	case syntax.OpAlternate:
+		suffix, _ := literalSuffix(re.Sub[0])
+		for _, sub := range re.Sub[1:] {
+			s, _ := literalSuffix(sub)
+			n := 0
+			for n < len(suffix) && n < len(s) && suffix[len(suffix)-1-n] == s[len(s)-1-n] {
+				n++
+			}
+			suffix = suffix[len(suffix)-n:]
+		}
+		// Only keep whole characters of a suffix common to different ones.
+		for len(suffix) > 0 && !utf8.RuneStart(suffix[0]) {
+			suffix = suffix[1:]
+		}
+		return suffix, false
+	}
+	return "", false
+}
+
+// maxWidth returns the maximum length in bytes of UTF-8 text matched by re, or false if it
+// is unbounded. The length is not exact, only never lower than the actual maximum.
+func maxWidth(re *syntax.Regexp) (int, bool) {
+	switch re.Op {
+	case syntax.OpNoMatch, syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return 0, true
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			// Case variants of a character may have encodings of different lengths.
+			return utf8.UTFMax * len(re.Rune), true
+		}
+		n := 0
+		for _, c := range re.Rune {
+			n += utf8.RuneLen(c)
+		}
+		return n, true
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return 0, true
+		}
+		// Ranges are sorted, so the last ends with the largest character.
+		switch c := re.Rune[len(re.Rune)-1]; {
+		case c < 0x80:
+			return 1, true
+		case c < 0x800:
+			return 2, true
+		case c < 0x10000:
+			return 3, true
+		}
+		return utf8.UTFMax, true
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return utf8.UTFMax, true
+	case syntax.OpCapture, syntax.OpQuest:
+		return maxWidth(re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat:
+		n, ok := maxWidth(re.Sub[0])
+		if !ok || n == 0 {
+			return n, ok
+		}
+		if re.Op != syntax.OpRepeat || re.Max < 0 {
+			return 0, false
+		}
+		return n * re.Max, true
+	case syntax.OpConcat, syntax.OpAlternate:
+		total := 0
+		for _, sub := range re.Sub {
+			n, ok := maxWidth(sub)
+			if !ok {
+				return 0, false
+			}
+			if re.Op == syntax.OpConcat {
+				total += n
+			} else if n > total {
+				total = n
+			}
+		}
+		return total, true
+	}
+	return 0, false
+}
+
 // MatchString reports whether the string s
 // contains any match of the regular expression re.
 func (re *Regexp) MatchString(s string) bool {
-	re.abi.startOperation(len(s))
-	defer re.abi.endOperation()
+	re = re.startOperation(len(s))
+	defer re.endOperation()
 
 	cs := newCString(re.abi, s)
 	res := match(re, cs, 0, 0)
@@ -813,11 +2211,272 @@ func (re *Regexp) MatchString(s string) bool {
 	return res
 }
 
+// MatchStringAny reports whether any of inputs contains a match of the expression,
+// stopping at the first that does. It is like calling MatchString for each in turn but
+// without starting an operation for each, which is cheaper for many short inputs.
+func (re *Regexp) MatchStringAny(inputs []string) bool {
+	return re.matchStrings(inputs, true)
+}
+
+// MatchStringAll reports whether all of inputs contain a match of the expression,
+// stopping at the first that does not, like MatchStringAny. It returns true if inputs is
+// empty.
+func (re *Regexp) MatchStringAll(inputs []string) bool {
+	return !re.matchStrings(inputs, false)
+}
+
+// matchStrings matches inputs in turn in a single operation until one whose result is
+// stop, returning whether there was one.
+func (re *Regexp) matchStrings(inputs []string, stop bool) bool {
+	maxLen := 0
+	for _, s := range inputs {
+		if len(s) > maxLen {
+			maxLen = len(s)
+		}
+	}
+	re = re.startOperation(maxLen)
+	defer re.endOperation()
+
+	for _, s := range inputs {
+		re.abi.resetMemory()
+		cs := newCString(re.abi, s)
+		res := match(re, cs, 0, 0)
+		runtime.KeepAlive(s)
+		if res == stop {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchStringContext is like MatchString but returns ctx.Err() if ctx is done
+// before the match completes, for example to enforce a deadline when matching
+// untrusted input.
+//
+// With wazero, a match that has started is interrupted when ctx is done, by closing
+// the WebAssembly module it runs in. Matches with a context therefore run in an
+// instance of the expression in a module of its own, compiled on first use and again
+// after a match was interrupted, so that other matches, including later ones with a
+// context, are not affected. The module is instantiated in a runtime of its own, as
+// checking for done contexts slows down execution, unless one is configured with
+// SetRuntime. With cgo, a match that has started cannot be interrupted and runs to
+// completion before MatchStringContext returns.
+//
+// Unlike MatchString, failures of the WebAssembly module while matching, e.g.,
+// running out of memory, are returned as an error rather than a panic.
+func (re *Regexp) MatchStringContext(ctx context.Context, s string) (matched bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	for {
+		inst, transient, err := re.contextInstance()
+		if err != nil {
+			return false, err
+		}
+		if transient {
+			defer release(inst)
+		}
+		err = inst.abi.startOperationContext(ctx, len(s))
+		if errors.Is(err, errModuleDropped) {
+			// A match interrupted while waiting for the instance closed it, so use the
+			// instance that replaces it.
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return inst.matchStringContext(ctx, s)
+	}
+}
+
+func (re *Regexp) matchStringContext(ctx context.Context, s string) (matched bool, err error) {
+	defer re.endOperation()
+	defer recoverWasmError(&err)
+
+	cs := newCString(re.abi, s)
+	matched, err = matchContext(ctx, re, cs)
+	runtime.KeepAlive(s)
+	return matched, err
+}
+
+// contextInstance returns the instance of the expression for MatchStringContext to match
+// with, which is re itself unless matchContext interrupts matches. A spare, which has no
+// spares of its own to keep the instance in, is matched with a transient instance to be
+// released after the match.
+func (re *Regexp) contextInstance() (inst *Regexp, transient bool, err error) {
+	if re.abi == nil {
+		panic(errClosed)
+	}
+	if !contextInterrupts {
+		return re, false, nil
+	}
+	if re.spares == nil {
+		inst, err := re.compileInterruptible()
+		return inst, true, err
+	}
+
+	re.spares.mu.Lock()
+	defer re.spares.mu.Unlock()
+
+	if inst := re.spares.interruptible; inst != nil && !inst.abi.isDropped() {
+		return inst, false, nil
+	}
+	// A replaced instance needs no release as its module is already closed.
+	if inst, err = re.compileInterruptible(); err != nil {
+		return nil, false, err
+	}
+	re.spares.interruptible = inst
+	return inst, false, nil
+}
+
+// compileInterruptible compiles an instance of the expression into a module of its own
+// for contextInstance.
+func (re *Regexp) compileInterruptible() (*Regexp, error) {
+	abi, err := acquireInterruptibleABI()
+	if err != nil {
+		return nil, fmt.Errorf("re2: failed to instantiate module: %w", err)
+	}
+	return compileInstance(re.expr, re.opts, abi)
+}
+
+// MatchStringTimeout is like MatchStringContext with a context that is done after d,
+// returning context.DeadlineExceeded if the match does not complete in time. With
+// wazero, a match that times out is interrupted, so later calls never wait for it.
+func (re *Regexp) MatchStringTimeout(s string, d time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return re.MatchStringContext(ctx, s)
+}
+
+// Close frees the native resources held by re, including its WebAssembly module.
+// A Regexp is freed automatically when it is garbage collected, so calling Close is
+// only needed to release the memory deterministically, for example when compiling
+// many medium-lived expressions. Calling Close more than once is a no-op, while
+// using the Regexp in any other way after Close panics. Close must not be called
+// concurrently with other methods.
+func (re *Regexp) Close() error {
+	if !atomic.CompareAndSwapUint32(&re.released, 0, 1) {
+		return nil
+	}
+	if owner := re.owner; owner != nil {
+		re.owner = nil
+		re.abi = nil
+		return owner.Close()
+	}
+	runtime.SetFinalizer(re, nil)
+
+	err := re.releaseSpares()
+	if relErr := release(re); err == nil {
+		err = relErr
+	}
+	re.abi = nil
+	return err
+}
+
 func (re *Regexp) release() {
 	if !atomic.CompareAndSwapUint32(&re.released, 0, 1) {
 		return
 	}
-	release(re)
+	// There is no one to report errors to when finalizing, Close returns them instead.
+	_ = re.releaseSpares()
+	_ = release(re)
+}
+
+// startOperation starts an operation for matching with re, waiting for it to be
+// available if needed, and returns the instance of the expression to use for it,
+// which may be a spare.
+func (re *Regexp) startOperation(memorySize int) *Regexp {
+	inst, err := re.tryStartOperation(memorySize)
+	if err != nil {
+		panic(err)
+	}
+	if inst != nil {
+		return inst
+	}
+	re.abi.startOperation(memorySize)
+	return re
+}
+
+// tryStartOperation starts an operation on re if it is available or otherwise on a spare,
+// compiling a new one if under the limit. It returns nil if no instance is available and
+// an error if re is available but memory for the operation cannot be reserved.
+func (re *Regexp) tryStartOperation(memorySize int) (*Regexp, error) {
+	if ok, err := re.abi.tryStartOperation(memorySize); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return re, nil
+	}
+	if re.spares == nil {
+		return nil, nil
+	}
+
+	re.spares.mu.Lock()
+	defer re.spares.mu.Unlock()
+
+	// Spares have memory of their own, so one that is out of memory is skipped like a
+	// busy one, leaving it to re to report the error if it also runs out.
+	for _, spare := range re.spares.instances {
+		if ok, _ := spare.abi.tryStartOperation(memorySize); ok {
+			return spare, nil
+		}
+	}
+	if len(re.spares.instances) >= re.parallelism()-1 {
+		return nil, nil
+	}
+
+	abi, err := acquireSpareABI()
+	if err != nil {
+		return nil, nil
+	}
+	spare, err := compileInstance(re.expr, re.opts, abi)
+	if err != nil {
+		// The expression compiled before so this is likely running out of memory, don't
+		// fail the match and just wait for re instead.
+		return nil, nil
+	}
+	re.spares.instances = append(re.spares.instances, spare)
+	if ok, _ := spare.abi.tryStartOperation(memorySize); ok {
+		return spare, nil
+	}
+	return nil, nil
+}
+
+func (re *Regexp) endOperation() {
+	re.abi.endOperation()
+}
+
+// parallelism returns the maximum number of instances of the expression, including re.
+func (re *Regexp) parallelism() int {
+	if re.opts.Parallelism > 0 {
+		return re.opts.Parallelism
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// releaseSpares releases the spare instances of re, returning the first error.
+func (re *Regexp) releaseSpares() error {
+	if re.spares == nil {
+		return nil
+	}
+
+	re.spares.mu.Lock()
+	defer re.spares.mu.Unlock()
+
+	var err error
+	for _, spare := range re.spares.instances {
+		if relErr := release(spare); err == nil {
+			err = relErr
+		}
+	}
+	re.spares.instances = nil
+	if inst := re.spares.interruptible; inst != nil {
+		if relErr := release(inst); err == nil {
+			err = relErr
+		}
+		re.spares.interruptible = nil
+	}
+	return err
 }
 
 // ReplaceAll returns a copy of src, replacing matches of the Regexp
@@ -826,34 +2485,215 @@ func (re *Regexp) release() {
 func (re *Regexp) ReplaceAll(src, repl []byte) []byte {
 	// TODO: See if it's worth not converting repl to string here, the stdlib does it
 	// so follow suit for now.
-	replRE2 := convertReplacement(string(repl), re.subexpNames)
+	template := string(repl)
+	replRE2, ok := convertReplacement(template, re.subexpNames)
+	if !ok {
+		return re.replaceAllFunc(src, "", true, func(dst []byte, match []int) []byte {
+			return re.expand(dst, template, src, "", match)
+		})
+	}
 
-	re.abi.startOperation(len(src) + len(replRE2) + 16)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(src) + len(replRE2) + 16)
+	defer re.endOperation()
 
 	srcCS := newCStringFromBytes(re.abi, src)
 
 	res, matched := re.replaceAll(srcCS, replRE2)
 	if !matched {
-		return src
+		return append([]byte(nil), src...)
 	}
 	return res
 }
 
+// AppendReplaceAll appends to dst a copy of src, replacing matches of the Regexp with
+// the replacement text repl, interpreted as in ReplaceAll, and returns the extended
+// slice. Unlike ReplaceAll, the result is built in Go from the matches of the expression
+// rather than by re2, so that reusing dst across calls, e.g., for a streaming rewrite,
+// avoids allocating the result.
+//
+// Finding each match is a call into the WebAssembly module, which allocates a little
+// itself, so for inputs with many matches ReplaceAll allocates less in total, though it
+// is slower.
+func (re *Regexp) AppendReplaceAll(dst, src, repl []byte) []byte {
+	return re.appendReplaceAll(dst, src, "", repl, replTemplate(repl))
+}
+
+// replaceChunkSize is the size of the chunks ReplaceAllTo writes.
+const replaceChunkSize = 32 * 1024
+
+// ReplaceAllTo writes to w a copy of src, replacing matches of the Regexp with the
+// replacement text repl, interpreted as in ReplaceAll, and returns the number of bytes
+// written. The result is written in chunks as matches are found rather than built in
+// memory, e.g., for transforming large files. The first error writing stops finding
+// matches and is returned with the number of bytes written before it.
+//
+// src is copied into the WebAssembly module of the expression once, and the module is
+// released while writing each chunk, so a slow w doesn't delay other expressions sharing
+// it and w may use the Regexp. An error is returned if src does not fit in the memory of
+// the module.
+func (re *Regexp) ReplaceAllTo(w io.Writer, src, repl []byte) (int, error) {
+	template := replTemplate(repl)
+
+	re.abi.startOperation(0)
+	cs, err := newSourceText(re.abi, src)
+	re.endOperation()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// The text went with the module if it was dropped.
+		if re.abi.isDropped() {
+			return
+		}
+		re.abi.startOperation(0)
+		defer re.endOperation()
+		freeSourceText(re.abi, cs)
+		runtime.KeepAlive(src)
+	}()
+
+	written := 0
+	write := func(p []byte) error {
+		if len(p) == 0 {
+			return nil
+		}
+		n, err := w.Write(p)
+		written += n
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	}
+
+	c := replaceChunk{src: src, repl: repl, template: template, st: findState{prevMatchEnd: -1}}
+	for !c.st.done {
+		re.nextReplaceChunk(&c, cs)
+		for _, p := range [][]byte{c.buf, c.gap, c.tail} {
+			if err := write(p); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, write(src[c.lastMatchEnd:])
+}
+
+// replaceChunk is a chunk of the output of ReplaceAllTo and the state of finding the
+// matches for the next one.
+type replaceChunk struct {
+	src, repl []byte
+	template  string
+
+	st           findState
+	lastMatchEnd int
+
+	// buf is the replaced text of the chunk, followed by text between matches too large
+	// to copy into it, written from src as gap, and the replacement of the match after it.
+	buf, gap, tail []byte
+}
+
+// nextReplaceChunk finds the matches for the next chunk of c in src, already in the memory
+// of the module as cs, in an operation of its own.
+func (re *Regexp) nextReplaceChunk(c *replaceChunk, cs cString) {
+	re.abi.startOperation(8*len(re.subexpNames) + 8)
+	defer re.endOperation()
+
+	c.buf, c.gap, c.tail = c.buf[:0], nil, c.tail[:0]
+	expand := func(dst []byte, match []int) []byte {
+		if c.template == "" {
+			return append(dst, c.repl...)
+		}
+		return re.expand(dst, c.template, c.src, "", match)
+	}
+	replace := func(match []int) bool {
+		gap := c.src[c.lastMatchEnd:match[0]]
+		c.lastMatchEnd = match[1]
+		if len(c.buf)+len(gap) >= replaceChunkSize {
+			c.gap, c.tail = gap, expand(c.tail, match)
+			return false
+		}
+		c.buf = expand(append(c.buf, gap...), match)
+		return len(c.buf) < replaceChunkSize
+	}
+	if c.template == "" {
+		re.findAllFrom(cs, c.src, "", -1, &c.st, replace)
+	} else {
+		re.findAllSubmatchFrom(cs, c.src, "", -1, &c.st, replace)
+	}
+}
+
+// replTemplate returns repl as a template to expand, or an empty string if it contains no
+// $ and is substituted verbatim.
+func replTemplate(repl []byte) string {
+	if bytes.IndexByte(repl, '$') < 0 {
+		return ""
+	}
+	return string(repl)
+}
+
+// appendReplaceAll appends to dst the copy of bsrc, or of src if bsrc is nil, with matches
+// replaced by the expansion of template, or by repl verbatim if template is empty.
+func (re *Regexp) appendReplaceAll(dst []byte, bsrc []byte, src string, repl []byte, template string) []byte {
+	re = re.startOperation(len(bsrc) + len(src) + 8*len(re.subexpNames) + 8)
+	defer re.endOperation()
+
+	var cs cString
+	if bsrc != nil {
+		cs = newCStringFromBytes(re.abi, bsrc)
+	} else {
+		cs = newCString(re.abi, src)
+	}
+
+	lastMatchEnd := 0
+	appendUnmatched := func(end int) {
+		if bsrc != nil {
+			dst = append(dst, bsrc[lastMatchEnd:end]...)
+		} else {
+			dst = append(dst, src[lastMatchEnd:end]...)
+		}
+	}
+	if template == "" {
+		re.findAll(cs, bsrc, src, -1, func(match []int) {
+			appendUnmatched(match[0])
+			dst = append(dst, repl...)
+			lastMatchEnd = match[1]
+		})
+	} else {
+		re.findAllSubmatch(cs, bsrc, src, -1, func(match []int) {
+			appendUnmatched(match[0])
+			dst = re.expand(dst, template, bsrc, src, match)
+			lastMatchEnd = match[1]
+		})
+	}
+	appendUnmatched(cs.length)
+
+	runtime.KeepAlive(bsrc)
+	runtime.KeepAlive(src)
+	return dst
+}
+
+// ReplaceAllFunc returns a copy of src in which all matches of the
+// Regexp have been replaced by the return value of function repl applied
+// to the matched byte slice. The replacement returned by repl is substituted
+// directly, without using Expand.
+func (re *Regexp) ReplaceAllFunc(src []byte, repl func([]byte) []byte) []byte {
+	return re.replaceAllFunc(src, "", false, func(dst []byte, match []int) []byte {
+		return append(dst, repl(src[match[0]:match[1]])...)
+	})
+}
+
 // ReplaceAllLiteral returns a copy of src, replacing matches of the Regexp
 // with the replacement bytes repl. The replacement repl is substituted directly,
 // without using Expand.
 func (re *Regexp) ReplaceAllLiteral(src, repl []byte) []byte {
 	replRE2 := []byte(escapeReplacement(string(repl)))
 
-	re.abi.startOperation(len(src) + len(replRE2) + 16)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(src) + len(replRE2) + 16)
+	defer re.endOperation()
 
 	srcCS := newCStringFromBytes(re.abi, src)
 
 	res, matched := re.replaceAll(srcCS, replRE2)
 	if !matched {
-		return src
+		return append([]byte(nil), src...)
 	}
 
 	return res
@@ -865,8 +2705,8 @@ func (re *Regexp) ReplaceAllLiteral(src, repl []byte) []byte {
 func (re *Regexp) ReplaceAllLiteralString(src, repl string) string {
 	replRE2 := []byte(escapeReplacement(repl))
 
-	re.abi.startOperation(len(src) + len(replRE2) + 16)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(src) + len(replRE2) + 16)
+	defer re.endOperation()
 
 	srcCS := newCString(re.abi, src)
 
@@ -882,10 +2722,16 @@ func (re *Regexp) ReplaceAllLiteralString(src, repl string) string {
 // with the replacement string repl. Inside repl, $ signs are interpreted as
 // in Expand, so for instance $1 represents the text of the first submatch.
 func (re *Regexp) ReplaceAllString(src, repl string) string {
-	replRE2 := convertReplacement(repl, re.subexpNames)
+	replRE2, ok := convertReplacement(repl, re.subexpNames)
+	if !ok {
+		b := re.replaceAllFunc(nil, src, true, func(dst []byte, match []int) []byte {
+			return re.expand(dst, repl, nil, src, match)
+		})
+		return string(b)
+	}
 
-	re.abi.startOperation(len(src) + len(replRE2) + 16)
-	defer re.abi.endOperation()
+	re = re.startOperation(len(src) + len(replRE2) + 16)
+	defer re.endOperation()
 
 	srcCS := newCString(re.abi, src)
 
@@ -897,6 +2743,109 @@ func (re *Regexp) ReplaceAllString(src, repl string) string {
 	return string(res)
 }
 
+// TryReplaceAll is like ReplaceAll but returns an error instead of panicking if the
+// WebAssembly module fails, e.g., wrapping ErrOutOfMemory when src does not fit in its
+// memory, for replacing in untrusted input. The result is built in Go as with
+// AppendReplaceAll, so unlike with ReplaceAll, replacements growing the text past the
+// memory of the module succeed, as re2 would fail without recovering while building it.
+func (re *Regexp) TryReplaceAll(src, repl []byte) (res []byte, err error) {
+	defer recoverWasmError(&err)
+	return re.appendReplaceAll(nil, src, "", repl, replTemplate(repl)), nil
+}
+
+// TryReplaceAllString is like ReplaceAllString but returns an error instead of
+// panicking if the WebAssembly module fails, as TryReplaceAll.
+func (re *Regexp) TryReplaceAllString(src, repl string) (res string, err error) {
+	defer recoverWasmError(&err)
+	template := ""
+	if strings.IndexByte(repl, '$') >= 0 {
+		template = repl
+	}
+	return string(re.appendReplaceAll(nil, nil, src, []byte(repl), template)), nil
+}
+
+// ReplaceAllStringFunc returns a copy of src in which all matches of the
+// Regexp have been replaced by the return value of function repl applied
+// to the matched substring. The replacement returned by repl is substituted
+// directly, without using Expand.
+func (re *Regexp) ReplaceAllStringFunc(src string, repl func(string) string) string {
+	b := re.replaceAllFunc(nil, src, false, func(dst []byte, match []int) []byte {
+		return append(dst, repl(src[match[0]:match[1]])...)
+	})
+	return string(b)
+}
+
+// ReplaceAllStringFuncIndex returns a copy of src in which all matches of the
+// Regexp have been replaced by the return value of function repl applied to the
+// start and end offsets of the match in src, e.g., for building a list of edits.
+// The replacement returned by repl is substituted directly, without using Expand.
+func (re *Regexp) ReplaceAllStringFuncIndex(src string, repl func(start, end int) string) string {
+	b := re.replaceAllFunc(nil, src, false, func(dst []byte, match []int) []byte {
+		return append(dst, repl(match[0], match[1])...)
+	})
+	return string(b)
+}
+
+// ReplaceAllStringSubmatchFunc returns a copy of src in which all matches of
+// the Regexp have been replaced by the return value of function repl applied
+// to the submatches of the match. groups[0] is the text of the whole match and
+// groups[i] the text of the ith parenthesized subexpression, or "" if it did
+// not participate, as in FindStringSubmatch. The replacement returned by repl
+// is substituted directly, without using Expand.
+func (re *Regexp) ReplaceAllStringSubmatchFunc(src string, repl func(groups []string) string) string {
+	b := re.replaceAllFunc(nil, src, true, func(dst []byte, match []int) []byte {
+		groups := make([]string, len(match)/2)
+		for i := range groups {
+			if match[2*i] >= 0 {
+				groups[i] = src[match[2*i]:match[2*i+1]]
+			}
+		}
+		return append(dst, repl(groups)...)
+	})
+	return string(b)
+}
+
+// replaceAllFunc builds the replacement of all matches in the input, which is bsrc if
+// non-nil and src otherwise, appending the output of repl for each match. re2 cannot
+// call back into Go during a global replace, so all the matches are found first and
+// replaced outside of the wasm operation, which also allows repl to use the Regexp.
+// If submatch is true, repl is passed the indexes of submatches too.
+func (re *Regexp) replaceAllFunc(bsrc []byte, src string, submatch bool, repl func(dst []byte, match []int) []byte) []byte {
+	var matches [][]int
+	switch {
+	case bsrc != nil && submatch:
+		matches = re.FindAllSubmatchIndex(bsrc, -1)
+	case bsrc != nil:
+		matches = re.FindAllIndex(bsrc, -1)
+	case submatch:
+		matches = re.FindAllStringSubmatchIndex(src, -1)
+	default:
+		matches = re.FindAllStringIndex(src, -1)
+	}
+
+	var buf []byte
+	lastMatchEnd := 0
+	for _, match := range matches {
+		// Copy the unmatched characters before this match.
+		if bsrc != nil {
+			buf = append(buf, bsrc[lastMatchEnd:match[0]]...)
+		} else {
+			buf = append(buf, src[lastMatchEnd:match[0]]...)
+		}
+		buf = repl(buf, match)
+		lastMatchEnd = match[1]
+	}
+
+	// Copy the unmatched characters after the last match.
+	if bsrc != nil {
+		buf = append(buf, bsrc[lastMatchEnd:]...)
+	} else {
+		buf = append(buf, src[lastMatchEnd:]...)
+	}
+
+	return buf
+}
+
 func (re *Regexp) replaceAll(srcCS cString, repl []byte) ([]byte, bool) {
 	replCS := newCStringFromBytes(re.abi, repl)
 
@@ -915,6 +2864,149 @@ func (re *Regexp) String() string {
 	return re.expr
 }
 
+// MarshalText implements encoding.TextMarshaler. The output matches that of calling
+// the String method.
+//
+// Note that the output is lossy in some cases: it does not indicate the options the
+// expression was compiled with, such as with CompilePOSIX or CompileWith, or whether
+// the Longest method has been called. MarshalBinary preserves them.
+func (re *Regexp) MarshalText() ([]byte, error) {
+	return []byte(re.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler by calling Compile on the encoded
+// value, returning its error if it does not compile. Each unmarshaled expression is
+// compiled like one from Compile, with the same cost. An expression previously held by
+// re is closed. UnmarshalText must not be called concurrently with other methods.
+func (re *Regexp) UnmarshalText(text []byte) error {
+	compiled, err := Compile(string(text))
+	if err != nil {
+		return err
+	}
+	return re.assign(compiled)
+}
+
+// binaryVersion is the version of the encoding of MarshalBinary. Options added later are
+// encoded as further flags, so that data encoded before remains readable, and the version
+// only changes if the layout does.
+const binaryVersion = 1
+
+// binaryFlags are the boolean options encoded by MarshalBinary, in the order of their bits.
+// New options must only be appended.
+func binaryFlags(opts *Options) []*bool {
+	return []*bool{
+		&opts.CaseInsensitive, &opts.Latin1, &opts.NeverNL, &opts.DotNL, &opts.Literal,
+		&opts.Longest, &opts.POSIX, &opts.NeverCapture, &opts.WordBoundary, &opts.OneLine,
+		&opts.LogErrors,
+	}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, and so encoding/gob, encoding the
+// expression together with the options it was compiled with, including whether the
+// Longest method has been called, for UnmarshalBinary to compile it the same way.
+// MaxProgramSize, Parallelism and Unsynchronized, which do not change how it matches, are
+// not encoded.
+func (re *Regexp) MarshalBinary() ([]byte, error) {
+	opts := re.opts
+	var flags uint64
+	for i, f := range binaryFlags(&opts) {
+		if *f {
+			flags |= 1 << i
+		}
+	}
+
+	buf := make([]byte, 1+2*binary.MaxVarintLen64, 1+2*binary.MaxVarintLen64+len(re.expr))
+	buf[0] = binaryVersion
+	n := 1
+	n += binary.PutVarint(buf[n:], opts.MaxMem)
+	n += binary.PutUvarint(buf[n:], flags)
+	return append(buf[:n], re.expr...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, and so encoding/gob, by calling
+// CompileWith with the expression and options encoded by MarshalBinary. It returns an
+// error if data is not a valid encoding or the expression does not compile, e.g., as
+// data was encoded by a later version of this package with options not known to this
+// one. As with UnmarshalText, an expression previously held by re is closed.
+func (re *Regexp) UnmarshalBinary(data []byte) error {
+	expr, opts, err := decodeBinary(data)
+	if err != nil {
+		return err
+	}
+	compiled, err := CompileWith(expr, opts)
+	if err != nil {
+		return err
+	}
+	return re.assign(compiled)
+}
+
+// Program returns an encoding of the compiled expression to be loaded with
+// CompileFromProgram, e.g., to store the expressions of a large rule set.
+//
+// re2 cannot serialize its compiled programs, so the encoding is that of MarshalBinary,
+// the expression with its options, and CompileFromProgram parses and compiles the
+// expression again. Loading does not skip any compilation work.
+func (re *Regexp) Program() ([]byte, error) {
+	return re.MarshalBinary()
+}
+
+// CompileFromProgram compiles an expression encoded by Program, with the options it was
+// compiled with, returning an error if program is not a valid encoding or the expression
+// does not compile.
+func CompileFromProgram(program []byte) (*Regexp, error) {
+	expr, opts, err := decodeBinary(program)
+	if err != nil {
+		return nil, err
+	}
+	return CompileWith(expr, opts)
+}
+
+// decodeBinary decodes the expression and options encoded by MarshalBinary.
+func decodeBinary(data []byte) (string, Options, error) {
+	var opts Options
+	if len(data) == 0 {
+		return "", opts, errors.New("re2: invalid encoding of Regexp: empty data")
+	}
+	if data[0] != binaryVersion {
+		return "", opts, fmt.Errorf("re2: invalid encoding of Regexp: unknown version %d", data[0])
+	}
+	data = data[1:]
+
+	maxMem, n := binary.Varint(data)
+	if n <= 0 {
+		return "", opts, errors.New("re2: invalid encoding of Regexp: bad MaxMem")
+	}
+	data = data[n:]
+	opts.MaxMem = maxMem
+
+	flags, n := binary.Uvarint(data)
+	if n <= 0 {
+		return "", opts, errors.New("re2: invalid encoding of Regexp: bad options")
+	}
+	data = data[n:]
+	for i, f := range binaryFlags(&opts) {
+		*f = flags&(1<<i) != 0
+		flags &^= 1 << i
+	}
+	if flags != 0 {
+		return "", opts, fmt.Errorf("re2: invalid encoding of Regexp: unknown options %#x", flags)
+	}
+
+	return string(data), opts, nil
+}
+
+// assign replaces the expression held by re, if any, with compiled, which becomes
+// its owner.
+func (re *Regexp) assign(compiled *Regexp) error {
+	var err error
+	if re.abi != nil {
+		err = re.Close()
+	}
+	*re = *compiled
+	re.owner = compiled
+	return err
+}
+
 func subexpNames(abi *libre2ABI, rePtr uintptr) []string {
 	// Does not include whole expression match, e.g. $0
 	numGroups := numCapturingGroups(abi, rePtr)
@@ -935,10 +3027,16 @@ func subexpNames(abi *libre2ABI, rePtr uintptr) []string {
 	return res
 }
 
+// maxRewriteGroup is the highest group a re2 rewrite string can refer to, as its
+// backreferences are a single digit.
+const maxRewriteGroup = 9
+
 // Copied from
 // https://github.com/golang/go/blob/0fd7be7ee5f36215b5d6b8f23f35d60bf749805a/src/regexp/regexp.go#L932
 // except expansion from regex results is replaced with conversion to re2 replacement syntax.
-func convertReplacement(template string, subexpNames []string) []byte {
+// If the template refers to a group that re2 cannot, it returns false and the replacement
+// must be expanded in Go instead.
+func convertReplacement(template string, subexpNames []string) ([]byte, bool) {
 	var dst []byte
 
 	template = escapeReplacement(template)
@@ -971,6 +3069,9 @@ func convertReplacement(template string, subexpNames []string) []byte {
 			// can match at the same time.
 			for i, s := range subexpNames {
 				if s != "" && name == s {
+					if i > maxRewriteGroup {
+						return nil, false
+					}
 					dst = append(dst, '\\')
 					dst = strconv.AppendUint(dst, uint64(i), 10)
 				}
@@ -981,11 +3082,14 @@ func convertReplacement(template string, subexpNames []string) []byte {
 			// Not present numbered group, drop it.
 			continue
 		}
+		if num > maxRewriteGroup {
+			return nil, false
+		}
 		dst = append(dst, '\\')
 		dst = strconv.AppendUint(dst, uint64(num), 10)
 	}
 	dst = append(dst, template...)
-	return dst
+	return dst, true
 }
 
 // extract returns the name from a leading "name" or "{name}" in str.
@@ -1046,6 +3150,28 @@ func escapeReplacement(repl string) string {
 	return strings.ReplaceAll(repl, `\`, `\\`)
 }
 
+// charWidth returns the width of the character starting at pos in the input, which is b
+// if non-nil and s otherwise. Iteration after an empty match skips this many bytes so that
+// matches never start in the middle of a UTF-8 sequence.
+func (re *Regexp) charWidth(b []byte, s string, pos int) int {
+	if re.opts.Latin1 {
+		// Every byte is a character.
+		return 1
+	}
+
+	var width int
+	if b != nil {
+		_, width = utf8.DecodeRune(b[pos:])
+	} else {
+		_, width = utf8.DecodeRuneInString(s[pos:])
+	}
+	if width == 0 {
+		// End of input, step past it to finish iterating.
+		return 1
+	}
+	return width
+}
+
 func matchedBytes(s []byte, match []int) []byte {
 	if match == nil || match[0] == -1 {
 		return nil
@@ -0,0 +1,1267 @@
+package re2
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
+)
+
+func TestMatchStringContext(t *testing.T) {
+	re := MustCompile(`a+b`)
+
+	for _, s := range []string{"aab", "ab", "b", ""} {
+		matched, err := re.MatchStringContext(context.Background(), s)
+		if err != nil {
+			t.Errorf("MatchStringContext(%q): unexpected error: %v", s, err)
+		}
+		if want := re.MatchString(s); matched != want {
+			t.Errorf("MatchStringContext(%q) = %t; want %t", s, matched, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := re.MatchStringContext(ctx, "aab"); !errors.Is(err, context.Canceled) {
+		t.Errorf("MatchStringContext with cancelled context: err = %v; want %v", err, context.Canceled)
+	}
+
+	// The Regexp remains usable after a cancelled match.
+	if !re.MatchString("aab") {
+		t.Errorf("MatchString(%q) = false after cancelled match; want true", "aab")
+	}
+}
+
+func TestMatchStringTimeout(t *testing.T) {
+	re := MustCompile(`(a+)+\d{13}x`)
+
+	matched, err := re.MatchStringTimeout("aaa1234567890123x", time.Minute)
+	if err != nil || !matched {
+		t.Errorf("MatchStringTimeout = %t, %v; want true, nil", matched, err)
+	}
+
+	if _, err := re.MatchStringTimeout("aaa1234567890123x", 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MatchStringTimeout with zero timeout: err = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	// Matching this takes far longer than the timeout.
+	long := strings.Repeat("a", 16<<20)
+	if _, err := re.MatchStringTimeout(long, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MatchStringTimeout of %d bytes: err = %v; want %v", len(long), err, context.DeadlineExceeded)
+	}
+
+	// The Regexp remains usable after a timed out match.
+	if !re.MatchString("aaa1234567890123x") {
+		t.Errorf("MatchString = false after timed out match; want true")
+	}
+	if re.MatchString(long[:1024]) {
+		t.Errorf("MatchString of only a = true after timed out match; want false")
+	}
+}
+
+func TestCompileWithMaxMem(t *testing.T) {
+	const pattern = `(abc|def|ghi){100}`
+
+	if _, err := CompileWith(pattern, Options{}); err != nil {
+		t.Fatalf("CompileWith(%#q) with default MaxMem: unexpected error: %v", pattern, err)
+	}
+
+	_, err := CompileWith(pattern, Options{MaxMem: 1 << 10})
+	if err == nil {
+		t.Fatalf("CompileWith(%#q) with MaxMem 1KiB: expected error", pattern)
+	}
+	if want := "error parsing regexp: expression too large: `" + pattern + "`"; err.Error() != want {
+		t.Errorf("CompileWith(%#q) with MaxMem 1KiB: err = %q; want %q", pattern, err, want)
+	}
+
+	re, err := CompileWith(pattern, Options{MaxMem: 64 << 20})
+	if err != nil {
+		t.Fatalf("CompileWith(%#q) with MaxMem 64MiB: unexpected error: %v", pattern, err)
+	}
+	if !re.MatchString(strings.Repeat("abc", 100)) {
+		t.Errorf("%#q.MatchString: expected match", pattern)
+	}
+}
+
+func TestCompileBatch(t *testing.T) {
+	patterns := []string{`a+b`, `a(`, `(?i)cd`, `x**`, `e$`}
+	res, err := CompileBatch(patterns, Options{})
+	if err == nil {
+		t.Fatalf("CompileBatch: expected error")
+	}
+	_, firstErr := Compile(`a(`)
+	if want := "re2: 2 of 5 patterns failed to compile, first at index 1: " + firstErr.Error(); err.Error() != want {
+		t.Errorf("CompileBatch: err = %q; want %q", err, want)
+	}
+	if len(res) != len(patterns) {
+		t.Fatalf("CompileBatch returned %d expressions; want %d", len(res), len(patterns))
+	}
+	for i, re := range res {
+		if failed := i == 1 || i == 3; failed != (re == nil) {
+			t.Errorf("CompileBatch: expression %d is %v", i, re)
+		}
+	}
+	if !res[2].MatchString("xCDx") {
+		t.Errorf("%#q.MatchString(%q) = false; want true", patterns[2], "xCDx")
+	}
+
+	res, err = CompileBatch([]string{`a+b`, `cd`}, Options{CaseInsensitive: true})
+	if err != nil {
+		t.Fatalf("CompileBatch: unexpected error: %v", err)
+	}
+	if !res[0].MatchString("AB") || !res[1].MatchString("Cd") {
+		t.Errorf("CompileBatch with CaseInsensitive: expressions do not match case-insensitively")
+	}
+}
+
+func TestCompileWithCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want bool
+	}{
+		{Options{}, false},
+		{Options{CaseInsensitive: true}, true},
+	}
+
+	for _, tc := range tests {
+		re, err := CompileWith(`ABC`, tc.opts)
+		if err != nil {
+			t.Fatalf("CompileWith(%#q, %+v): unexpected error: %v", `ABC`, tc.opts, err)
+		}
+		if got := re.MatchString("abc"); got != tc.want {
+			t.Errorf("CompileWith(%#q, %+v).MatchString(%q) = %t; want %t", `ABC`, tc.opts, "abc", got, tc.want)
+		}
+		if !re.MatchString("ABC") {
+			t.Errorf("CompileWith(%#q, %+v).MatchString(%q) = false; want true", `ABC`, tc.opts, "ABC")
+		}
+	}
+}
+
+func TestCompilePOSIX(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+	}{
+		{`a|ab`, "ab"},
+		{`ab|a`, "ab"},
+		{`(a|ab)(c|bcd)`, "abcd"},
+		{`(a+|b+)|(a+b+)`, "xaabbx"},
+		{`x*|xy`, "xyxy"},
+		{`[a-c]+|abcd`, "abcdabc"},
+	}
+
+	for _, tc := range tests {
+		re := MustCompilePOSIX(tc.pattern)
+		want := regexp.MustCompilePOSIX(tc.pattern)
+
+		if got, want := re.FindString(tc.input), want.FindString(tc.input); got != want {
+			t.Errorf("%#q.FindString(%q) = %q; want %q", tc.pattern, tc.input, got, want)
+		}
+		if got, want := re.FindAllStringIndex(tc.input, -1), want.FindAllStringIndex(tc.input, -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("%#q.FindAllStringIndex(%q) = %v; want %v", tc.pattern, tc.input, got, want)
+		}
+	}
+
+	// Leftmost-first semantics are restored when not compiling in POSIX mode.
+	if got := MustCompile(`a|ab`).FindString("ab"); got != "a" {
+		t.Errorf("Compile(%#q).FindString(%q) = %q; want %q", `a|ab`, "ab", got, "a")
+	}
+}
+
+func TestClose(t *testing.T) {
+	re := MustCompile(`a+b`)
+	if err := re.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if err := re.Close(); err != nil {
+		t.Errorf("second Close: unexpected error: %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r != errClosed {
+			t.Errorf("MatchString after Close: recovered %v; want %v", r, errClosed)
+		}
+	}()
+	re.MatchString("aab")
+}
+
+func TestCloseFreesMemory(t *testing.T) {
+	compileAndClose := func(n int) {
+		for i := 0; i < n; i++ {
+			re := MustCompile(`(foo|bar)+\d{1,8}[a-z]*`)
+			if err := re.Close(); err != nil {
+				t.Fatalf("Close: unexpected error: %v", err)
+			}
+		}
+	}
+
+	heapInUse := func() uint64 {
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return ms.HeapInuse
+	}
+
+	// Warm up so that one-time allocations are not counted as growth.
+	compileAndClose(10)
+	before := heapInUse()
+	compileAndClose(200)
+	after := heapInUse()
+
+	if after > before && after-before > 16<<20 {
+		t.Errorf("heap in use grew by %d bytes after compiling and closing 200 expressions", after-before)
+	}
+}
+
+type errRuneReader struct {
+	r   io.RuneReader
+	err error
+}
+
+func (r *errRuneReader) ReadRune() (rune, int, error) {
+	c, size, err := r.r.ReadRune()
+	if err == io.EOF {
+		return 0, 0, r.err
+	}
+	return c, size, err
+}
+
+func TestMatchReader(t *testing.T) {
+	re := MustCompile(`a+b|日本`)
+
+	for _, s := range []string{"", "aab", "xxab", "b", "語日本", "日x本"} {
+		if got, want := re.MatchReader(strings.NewReader(s)), re.MatchString(s); got != want {
+			t.Errorf("MatchReader(%q) = %t; want %t", s, got, want)
+		}
+		matched, err := MatchReader(`a+b|日本`, strings.NewReader(s))
+		if err != nil {
+			t.Errorf("package MatchReader(%q): unexpected error: %v", s, err)
+		}
+		if want := re.MatchString(s); matched != want {
+			t.Errorf("package MatchReader(%q) = %t; want %t", s, matched, want)
+		}
+	}
+
+	readErr := errors.New("read failed")
+	if re.MatchReader(&errRuneReader{r: strings.NewReader("aab"), err: readErr}) {
+		t.Errorf("MatchReader with read error = true; want false")
+	}
+	matched, err := MatchReader(`a+b`, &errRuneReader{r: strings.NewReader("aab"), err: readErr})
+	if matched || err != readErr {
+		t.Errorf("package MatchReader with read error = %t, %v; want false, %v", matched, err, readErr)
+	}
+}
+
+// compileWithOrSkip compiles the expression, skipping the test if the options are not
+// supported by the embedded libcre2.
+func compileWithOrSkip(t *testing.T, expr string, opts Options) *Regexp {
+	t.Helper()
+	re, err := CompileWith(expr, opts)
+	if errors.Is(err, errUnsupportedOption) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("CompileWith(%#q, %+v): unexpected error: %v", expr, opts, err)
+	}
+	return re
+}
+
+func TestCompileWithLatin1(t *testing.T) {
+	re := compileWithOrSkip(t, `^.\xff.$`, Options{Latin1: true})
+
+	// Invalid UTF-8, where every byte is a character.
+	input := []byte{0x80, 0xff, 0xfe}
+	if !re.Match(input) {
+		t.Errorf("%#q.Match(%q) = false; want true", `^.\xff.$`, input)
+	}
+	if got, want := re.FindIndex(input), []int{0, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%#q.FindIndex(%q) = %v; want %v", `^.\xff.$`, input, got, want)
+	}
+
+	// Without Latin1, the same bytes are not characters and can't be matched by '.'.
+	if MustCompile(`^.\xff.$`).Match(input) {
+		t.Errorf("UTF-8 %#q.Match(%q) = true; want false", `^.\xff.$`, input)
+	}
+
+	// Empty matches advance by one byte rather than one UTF-8 sequence.
+	empty := compileWithOrSkip(t, `x*`, Options{Latin1: true})
+	if got, want := empty.FindAllIndex([]byte("日"), -1), [][]int{{0, 0}, {1, 1}, {2, 2}, {3, 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Latin-1 %#q.FindAllIndex(%q) = %v; want %v", `x*`, "日", got, want)
+	}
+
+	dot := compileWithOrSkip(t, `.`, Options{Latin1: true})
+	for c := 0x80; c <= 0xff; c++ {
+		if got := dot.Find([]byte{byte(c)}); len(got) != 1 {
+			t.Errorf("Latin-1 %#q.Find(%#x) = %q; want a single byte", `.`, c, got)
+		}
+	}
+}
+
+func TestCompileWithNeverNL(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		want    bool
+	}{
+		{`a.b`, "a\nb", false},
+		{`a[^x]b`, "a\nb", false},
+		{`a\nb`, "a\nb", false},
+		{`a\sb`, "a\nb", false},
+		{`a.b`, "axb", true},
+		// Matches never span lines but are still found within one.
+		{`b.c`, "a\nbxc\nd", true},
+		{`a.*d`, "a\nbxc\nd", false},
+	}
+	for _, tc := range tests {
+		re := compileWithOrSkip(t, tc.pattern, Options{NeverNL: true})
+		if got := re.MatchString(tc.input); got != tc.want {
+			t.Errorf("NeverNL %#q.MatchString(%q) = %t; want %t", tc.pattern, tc.input, got, tc.want)
+		}
+	}
+
+	// Without NeverNL, newlines can be matched explicitly.
+	if !MustCompile(`a[^x]b`).MatchString("a\nb") {
+		t.Errorf("%#q.MatchString(%q) = false; want true", `a[^x]b`, "a\nb")
+	}
+}
+
+func TestCompileWithDotNL(t *testing.T) {
+	re := compileWithOrSkip(t, `a.b`, Options{DotNL: true})
+	if !re.MatchString("a\nb") {
+		t.Errorf("DotNL %#q.MatchString(%q) = false; want true", `a.b`, "a\nb")
+	}
+	if prefix, complete := re.LiteralPrefix(); prefix != "a" || complete {
+		t.Errorf("DotNL %#q.LiteralPrefix() = %q, %t; want %q, false", `a.b`, prefix, complete, "a")
+	}
+	if MustCompile(`a.b`).MatchString("a\nb") {
+		t.Errorf("%#q.MatchString(%q) = true; want false", `a.b`, "a\nb")
+	}
+
+	if _, err := CompileWith(`a.b`, Options{DotNL: true, NeverNL: true}); err == nil {
+		t.Errorf("CompileWith with DotNL and NeverNL: expected error")
+	}
+}
+
+func TestCompileWithLiteral(t *testing.T) {
+	re := compileWithOrSkip(t, `a.b`, Options{Literal: true})
+	for _, tc := range []struct {
+		input string
+		want  bool
+	}{
+		{"a.b", true},
+		{"xa.by", true},
+		{"axb", false},
+	} {
+		if got := re.MatchString(tc.input); got != tc.want {
+			t.Errorf("Literal %#q.MatchString(%q) = %t; want %t", `a.b`, tc.input, got, tc.want)
+		}
+	}
+	if prefix, complete := re.LiteralPrefix(); prefix != "a.b" || !complete {
+		t.Errorf("Literal %#q.LiteralPrefix() = %q, %t; want %q, true", `a.b`, prefix, complete, "a.b")
+	}
+
+	// Expressions that are invalid or have groups as regular expressions are literals too.
+	group := compileWithOrSkip(t, `(a+`, Options{Literal: true})
+	if n := group.NumSubexp(); n != 0 {
+		t.Errorf("Literal %#q.NumSubexp() = %d; want 0", `(a+`, n)
+	}
+	if got, want := group.FindAllString("(a+(aa(a+", -1), []string{"(a+", "(a+"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Literal %#q.FindAllString = %q; want %q", `(a+`, got, want)
+	}
+
+	fold := compileWithOrSkip(t, `A.B`, Options{Literal: true, CaseInsensitive: true})
+	if !fold.MatchString("a.b") || fold.MatchString("axb") {
+		t.Errorf("case-insensitive Literal %#q does not match only %q", `A.B`, "a.b")
+	}
+}
+
+func TestCompileWithMaxProgramSize(t *testing.T) {
+	opts := Options{MaxProgramSize: 100}
+	re := compileWithOrSkip(t, `a+b`, opts)
+	if !re.MatchString("aab") {
+		t.Errorf("%#q.MatchString(%q) = false; want true", re, "aab")
+	}
+
+	// a{1000}{1000} suggests itself but is rejected by the parser as a nested repetition.
+	if re, err := CompileWith(`a{1000}`, opts); err == nil || re != nil {
+		t.Errorf("CompileWith(%#q, %+v) = %v, %v; want nil, error", `a{1000}`, opts, re, err)
+	}
+	if _, err := CompileWith(`a{1000}`, Options{}); err != nil {
+		t.Errorf("CompileWith(%#q) without MaxProgramSize: unexpected error: %v", `a{1000}`, err)
+	}
+}
+
+func TestCompileWithNeverCapture(t *testing.T) {
+	re := compileWithOrSkip(t, `(\w+)=(\w+)`, Options{NeverCapture: true})
+	if n := re.NumSubexp(); n != 0 {
+		t.Errorf("NeverCapture NumSubexp() = %d; want 0", n)
+	}
+	if got, want := re.FindStringSubmatch("x a=1 y"), []string{"a=1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NeverCapture FindStringSubmatch = %q; want %q", got, want)
+	}
+
+	ab := compileWithOrSkip(t, `(a)(b)`, Options{NeverCapture: true})
+	if !ab.MatchString("ab") {
+		t.Errorf("NeverCapture %#q.MatchString(%q) = false; want true", `(a)(b)`, "ab")
+	}
+	if got, want := ab.FindStringSubmatch("xab"), []string{"ab"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NeverCapture %#q.FindStringSubmatch = %q; want %q", `(a)(b)`, got, want)
+	}
+	if got, want := ab.FindAllSubmatchIndex([]byte("abab"), -1), [][]int{{0, 2}, {2, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NeverCapture %#q.FindAllSubmatchIndex = %v; want %v", `(a)(b)`, got, want)
+	}
+	if got, want := ab.ReplaceAllString("xab", "[$0$1]"), "x[ab]"; got != want {
+		t.Errorf("NeverCapture %#q.ReplaceAllString = %q; want %q", `(a)(b)`, got, want)
+	}
+
+	named := compileWithOrSkip(t, `(?P<key>\w+)=(\w+)`, Options{NeverCapture: true})
+	if names := named.SubexpNames(); !reflect.DeepEqual(names, []string{"", "key"}) {
+		t.Errorf("NeverCapture SubexpNames() = %q; want %q", names, []string{"", "key"})
+	}
+	if got, want := named.FindStringSubmatch("x a=1 y"), []string{"a=1", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NeverCapture FindStringSubmatch = %q; want %q", got, want)
+	}
+}
+
+func TestCompileWithPOSIXOptions(t *testing.T) {
+	longest, err := CompileWith(`a+?`, Options{Longest: true})
+	if err != nil {
+		t.Fatalf("Longest %#q: unexpected error: %v", `a+?`, err)
+	}
+	if got := longest.FindString("aaa"); got != "aaa" {
+		t.Errorf("Longest %#q.FindString(%q) = %q; want %q", `a+?`, "aaa", got, "aaa")
+	}
+
+	if _, err := CompileWith(`\bab`, Options{POSIX: true}); err == nil {
+		t.Errorf("POSIX %#q: expected error", `\bab`)
+	}
+	re, err := CompileWith(`^b`, Options{POSIX: true})
+	if err != nil {
+		t.Fatalf("POSIX %#q: unexpected error: %v", `^b`, err)
+	}
+	if !re.MatchString("a\nb") {
+		t.Errorf("POSIX %#q.MatchString(%q) = false; want true", `^b`, "a\nb")
+	}
+
+	word := compileWithOrSkip(t, `\bab`, Options{POSIX: true, WordBoundary: true})
+	if !word.MatchString("x ab") || word.MatchString("xab") {
+		t.Errorf("POSIX with WordBoundary %#q does not match only at word boundaries", `\bab`)
+	}
+
+	oneLine := compileWithOrSkip(t, `^b`, Options{POSIX: true, OneLine: true})
+	if oneLine.MatchString("a\nb") || !oneLine.MatchString("b") {
+		t.Errorf("POSIX with OneLine %#q does not match only at the start of text", `^b`)
+	}
+
+	for _, tc := range []struct {
+		opts Options
+		want bool
+	}{
+		{Options{}, false},
+		{Options{POSIX: true}, true},
+		{Options{POSIX: true, OneLine: true}, false},
+	} {
+		re := compileWithOrSkip(t, `a$`, tc.opts)
+		if got := re.MatchString("a\nb"); got != tc.want {
+			t.Errorf("%#q with %+v: MatchString(%q) = %t; want %t", `a$`, tc.opts, "a\nb", got, tc.want)
+		}
+	}
+
+	// Without POSIX, ^ only matches at the start of text anyway.
+	perl := compileWithOrSkip(t, `^b`, Options{OneLine: true})
+	if perl.MatchString("a\nb") {
+		t.Errorf("%#q.MatchString(%q) = true; want false", `^b`, "a\nb")
+	}
+}
+
+func TestLongest(t *testing.T) {
+	re := MustCompile(`a|ab`)
+	defer re.Close()
+	if got, want := re.FindString("xab"), "a"; got != want {
+		t.Errorf("%#q.FindString(%q) = %q; want %q", re, "xab", got, want)
+	}
+
+	re.Longest()
+	if got, want := re.FindString("xab"), "ab"; got != want {
+		t.Errorf("%#q.FindString(%q) after Longest = %q; want %q", re, "xab", got, want)
+	}
+	if got, want := re.String(), `a|ab`; got != want {
+		t.Errorf("String() after Longest = %#q; want %#q", got, want)
+	}
+
+	re.Longest()
+	if got, want := re.FindString("xab"), "ab"; got != want {
+		t.Errorf("%#q.FindString(%q) after second Longest = %q; want %q", re, "xab", got, want)
+	}
+}
+
+func TestString(t *testing.T) {
+	for _, expr := range []string{``, `(?i)a+b`, `(?U)(?P<x>a*)\d{2,}$`, "日本\\x{8a9e}\n"} {
+		re := MustCompile(expr)
+		if got := fmt.Sprintf("%s", re); got != expr {
+			t.Errorf("Sprintf(%%s, %#q) = %#q; want %#q", expr, got, expr)
+		}
+		if got := re.Copy().String(); got != expr {
+			t.Errorf("%#q.Copy().String() = %#q; want %#q", expr, got, expr)
+		}
+		re.Longest()
+		if got := re.String(); got != expr {
+			t.Errorf("%#q.String() after Longest = %#q; want %#q", expr, got, expr)
+		}
+	}
+
+	// Options are not reflected in the source text.
+	re, err := CompileWith(`a+b`, Options{CaseInsensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := re.String(); got != `a+b` {
+		t.Errorf("case-insensitive %#q.String() = %#q; want %#q", `a+b`, got, `a+b`)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	re, err := CompileWith(`(a+)(B*)`, Options{CaseInsensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	re.Longest()
+	c := re.Copy()
+	defer c.Close()
+	if c.ptr == re.ptr && c.abi == re.abi {
+		t.Errorf("copy shares the compiled expression of the original")
+	}
+
+	inputs := []string{"", "xAab", "aaBBcAb", "bbb"}
+	for _, input := range inputs {
+		if got, want := c.FindAllStringSubmatchIndex(input, -1), re.FindAllStringSubmatchIndex(input, -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("copy FindAllStringSubmatchIndex(%q) = %v; want %v", input, got, want)
+		}
+	}
+
+	// The copy remains usable after the original is closed.
+	want := re.FindStringSubmatch("xAAbB")
+	if err := re.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.FindStringSubmatch("xAAbB"); !reflect.DeepEqual(got, want) {
+		t.Errorf("copy FindStringSubmatch after closing original = %q; want %q", got, want)
+	}
+}
+
+func TestRecoverWasmError(t *testing.T) {
+	for _, wasmErr := range wasmErrors {
+		wrapped := fmt.Errorf("%w: details", wasmErr)
+		err := func() (err error) {
+			defer recoverWasmError(&err)
+			panic(wrapped)
+		}()
+		if err != wrapped {
+			t.Errorf("recovered error %v; want %v", err, wrapped)
+		}
+	}
+
+	// Other panics, e.g. from bugs, are not turned into errors.
+	defer func() {
+		if r := recover(); r != errClosed {
+			t.Errorf("recovered %v; want panic with %v", r, errClosed)
+		}
+	}()
+	func() (err error) {
+		defer recoverWasmError(&err)
+		panic(errClosed)
+	}()
+}
+
+// countingRuneReader counts the bytes read from r.
+type countingRuneReader struct {
+	r io.RuneReader
+	n int
+}
+
+func (r *countingRuneReader) ReadRune() (rune, int, error) {
+	c, size, err := r.r.ReadRune()
+	r.n += size
+	return c, size, err
+}
+
+func TestFindReaderIndex(t *testing.T) {
+	patterns := []string{
+		`foo\d{3}bar`,
+		`(?i)FOO\d{3}Bar`,
+		`\bfoo`,
+		`^foo`,
+		`bar$`,
+		`o\d|3b`,
+		`日本\d?語`,
+		// Unbounded matches read all of the text.
+		`fo+\d+`,
+	}
+	filler := strings.Repeat("z", 3*readerChunkSize)
+	var inputs []string
+	for _, pos := range []int{0, 10, readerChunkSize - 7, readerChunkSize - 1, readerChunkSize, 2*readerChunkSize - 3, len(filler) - 9} {
+		inputs = append(inputs, filler[:pos]+"foo123bar"+filler[pos:])
+		inputs = append(inputs, filler[:pos]+"日本1語"+filler[pos:])
+	}
+	inputs = append(inputs, filler, "", "foo123bar")
+
+	for _, pattern := range patterns {
+		re := MustCompile(pattern)
+		std := regexp.MustCompile(pattern)
+		for i, input := range inputs {
+			got := re.FindReaderIndex(strings.NewReader(input))
+			want := std.FindReaderIndex(strings.NewReader(input))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q.FindReaderIndex(inputs[%d]) = %v; want %v", pattern, i, got, want)
+			}
+		}
+	}
+
+	// A bounded match is found without reading all of the text.
+	r := &countingRuneReader{r: strings.NewReader("foo123bar" + filler)}
+	if got, want := MustCompile(`foo\d{3}bar`).FindReaderIndex(r), []int{0, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindReaderIndex = %v; want %v", got, want)
+	}
+	if r.n >= len(filler) {
+		t.Errorf("FindReaderIndex read %d bytes; want less than the %d of the text", r.n, len(filler)+9)
+	}
+
+	if loc := MustCompile(`a+b`).FindReaderIndex(&errRuneReader{r: strings.NewReader("aab"), err: errors.New("read failed")}); loc != nil {
+		t.Errorf("FindReaderIndex with read error = %v; want nil", loc)
+	}
+}
+
+func TestMaxMatchLen(t *testing.T) {
+	tests := []struct {
+		pattern string
+		opts    Options
+		width   int
+		ok      bool
+	}{
+		{`abc`, Options{}, 3, true},
+		{`日本`, Options{}, 6, true},
+		{`a{2,5}`, Options{}, 5, true},
+		{`(ab|c)?d`, Options{}, 3, true},
+		{`[a-z\x{e9}]`, Options{}, 2, true},
+		{`.`, Options{}, utf8.UTFMax, true},
+		{`^\bx$`, Options{}, 1, true},
+		// Case variants of k include the 3-byte Kelvin sign.
+		{`k`, Options{CaseInsensitive: true}, utf8.UTFMax, true},
+		{`a.*`, Options{Literal: true}, 3, true},
+		{`(a|\b)*`, Options{}, 0, false},
+		{`a+`, Options{}, 0, false},
+		{`a{2,}`, Options{}, 0, false},
+		{`\C`, Options{}, 0, false},
+	}
+	for _, tc := range tests {
+		re := &Regexp{expr: tc.pattern, opts: tc.opts}
+		if width, ok := re.MaxMatchLen(); width != tc.width || ok != tc.ok {
+			t.Errorf("MaxMatchLen(%#q, %+v) = %d, %t; want %d, %t", tc.pattern, tc.opts, width, ok, tc.width, tc.ok)
+		}
+	}
+}
+
+func TestAnchored(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		opts       Options
+		start, end bool
+	}{
+		{`foo`, Options{}, false, false},
+		{`^foo`, Options{}, true, false},
+		{`foo$`, Options{}, false, true},
+		{`^foo$`, Options{}, true, true},
+		{`\Afoo\z`, Options{}, true, true},
+		{`^(foo|bar)$`, Options{}, true, true},
+		{`^foo|^bar$`, Options{}, true, false},
+		{`^foo|bar`, Options{}, false, false},
+		{`(?m)^foo$`, Options{}, false, false},
+		{`^foo$`, Options{Literal: true}, false, false},
+		{`^foo$`, Options{POSIX: true}, false, false},
+		{`^foo$`, Options{POSIX: true, OneLine: true}, true, true},
+	}
+	for _, tc := range tests {
+		re := &Regexp{expr: tc.pattern, opts: tc.opts}
+		if start, end := re.AnchoredStart(), re.AnchoredEnd(); start != tc.start || end != tc.end {
+			t.Errorf("Anchored(%#q, %+v) = %t, %t; want %t, %t", tc.pattern, tc.opts, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	dockerfile, err := os.ReadFile(filepath.Join("buildtools", "re2", "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ARG RE2_COMMIT=" + Version() + "\n"; !strings.Contains(string(dockerfile), want) {
+		t.Errorf("Version() = %q, not the RE2_COMMIT the bundled library is built from", Version())
+	}
+}
+
+func TestReplaceAllStringSubmatchFunc(t *testing.T) {
+	tests := []struct {
+		pattern, input, output string
+	}{
+		{`(\w+)=(\w+)`, "a=1 b=2", "1:a 2:b"},
+		{`(a)|(b)`, "xabx", "x[a,][,b]x"},
+		{`(x*)`, "日ax", "[]日[]a[x]"},
+		{`b`, "", ""},
+		{`(y)?`, "ab", "[]a[]b[]"},
+	}
+	for _, tc := range tests {
+		re := MustCompile(tc.pattern)
+		actual := re.ReplaceAllStringSubmatchFunc(tc.input, func(groups []string) string {
+			if len(groups) == 3 && tc.pattern == `(\w+)=(\w+)` {
+				return groups[2] + ":" + groups[1]
+			}
+			return "[" + strings.Join(groups[1:], ",") + "]"
+		})
+		if actual != tc.output {
+			t.Errorf("%q.ReplaceAllStringSubmatchFunc(%q, fn) = %q; want %q", tc.pattern, tc.input, actual, tc.output)
+		}
+
+		// The number and positions of replacements match ReplaceAllStringFunc.
+		std := regexp.MustCompile(tc.pattern).ReplaceAllStringFunc(tc.input, func(string) string { return "-" })
+		if got := re.ReplaceAllStringSubmatchFunc(tc.input, func([]string) string { return "-" }); got != std {
+			t.Errorf("%q.ReplaceAllStringSubmatchFunc(%q, fn) = %q; stdlib replaces as %q", tc.pattern, tc.input, got, std)
+		}
+	}
+}
+
+func TestReplaceAllStringFuncIndex(t *testing.T) {
+	tests := []struct {
+		pattern, input string
+		spans          [][2]int
+		output         string
+	}{
+		{`b+`, "abbcb", [][2]int{{1, 3}, {4, 5}}, "a<1:3>c<4:5>"},
+		{`x*`, "日a", [][2]int{{0, 0}, {3, 3}, {4, 4}}, "<0:0>日<3:3>a<4:4>"},
+		{`ab|`, "abc", [][2]int{{0, 2}, {3, 3}}, "<0:2>c<3:3>"},
+		{`z`, "abc", nil, "abc"},
+	}
+	for _, tc := range tests {
+		re := MustCompile(tc.pattern)
+		var spans [][2]int
+		actual := re.ReplaceAllStringFuncIndex(tc.input, func(start, end int) string {
+			spans = append(spans, [2]int{start, end})
+			return fmt.Sprintf("<%d:%d>", start, end)
+		})
+		if actual != tc.output {
+			t.Errorf("%#q.ReplaceAllStringFuncIndex(%q, fn) = %q; want %q", tc.pattern, tc.input, actual, tc.output)
+		}
+		if !reflect.DeepEqual(spans, tc.spans) {
+			t.Errorf("%#q.ReplaceAllStringFuncIndex(%q, fn) called with %v; want %v", tc.pattern, tc.input, spans, tc.spans)
+		}
+	}
+}
+
+// failingWriter accepts up to limit bytes, failing the write that exceeds it.
+type failingWriter struct {
+	buf          bytes.Buffer
+	limit        int
+	failed       bool
+	writtenAfter bool
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		w.writtenAfter = true
+	}
+	if w.buf.Len()+len(p) > w.limit {
+		w.failed = true
+		n := w.limit - w.buf.Len()
+		w.buf.Write(p[:n])
+		return n, errWriteFailed
+	}
+	return w.buf.Write(p)
+}
+
+func TestReplaceAllTo(t *testing.T) {
+	src := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 5000) + strings.Repeat("x", 100000) + " end")
+	for _, repl := range []string{"[$1]", "-", ""} {
+		re := MustCompile(`(\w+) (\w+)`)
+		want := regexp.MustCompile(`(\w+) (\w+)`).ReplaceAll(src, []byte(repl))
+
+		var buf bytes.Buffer
+		n, err := re.ReplaceAllTo(&buf, src, []byte(repl))
+		if err != nil {
+			t.Fatalf("ReplaceAllTo(%q): unexpected error: %v", repl, err)
+		}
+		if n != len(want) || !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("ReplaceAllTo(%q) wrote %d bytes, different from ReplaceAll's %d", repl, n, len(want))
+		}
+
+		w := &failingWriter{limit: len(want) / 3}
+		n, err = re.ReplaceAllTo(w, src, []byte(repl))
+		if !errors.Is(err, errWriteFailed) {
+			t.Errorf("ReplaceAllTo(%q) to failing writer: err = %v; want %v", repl, err, errWriteFailed)
+		}
+		if n != w.limit || !bytes.Equal(w.buf.Bytes(), want[:w.limit]) {
+			t.Errorf("ReplaceAllTo(%q) to failing writer = %d bytes; want the first %d", repl, n, w.limit)
+		}
+		if w.writtenAfter {
+			t.Errorf("ReplaceAllTo(%q) kept writing after the writer failed", repl)
+		}
+	}
+
+	var buf bytes.Buffer
+	if n, err := MustCompile(`a`).ReplaceAllTo(&buf, nil, []byte("b")); n != 0 || err != nil || buf.Len() != 0 {
+		t.Errorf("ReplaceAllTo of empty input = %d, %v, %q; want 0, nil, empty", n, err, buf.String())
+	}
+
+	// The writer can use the Regexp, even without spares to match with while writing.
+	re := MustCompileWith(`(\w+) (\w+)`, Options{Parallelism: 1})
+	w := &usingWriter{re: re}
+	if _, err := re.ReplaceAllTo(w, src, []byte("[$2]")); err != nil {
+		t.Fatalf("ReplaceAllTo to a writer using the Regexp: unexpected error: %v", err)
+	}
+	if want := re.ReplaceAll(src, []byte("[$2]")); !bytes.Equal(w.buf.Bytes(), want) {
+		t.Errorf("ReplaceAllTo to a writer using the Regexp wrote %d bytes, different from ReplaceAll's %d", w.buf.Len(), len(want))
+	}
+}
+
+// usingWriter matches re for each write.
+type usingWriter struct {
+	buf bytes.Buffer
+	re  *Regexp
+}
+
+func (w *usingWriter) Write(p []byte) (int, error) {
+	w.re.Match(p)
+	return w.buf.Write(p)
+}
+
+func TestMatchAnchored(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		want    [3]bool // Unanchored, AnchorStart, AnchorBoth
+	}{
+		{`a+b`, "aab", [3]bool{true, true, true}},
+		{`a+b`, "aabc", [3]bool{true, true, false}},
+		{`a+b`, "xaab", [3]bool{true, false, false}},
+		{`a+b`, "xaabx", [3]bool{true, false, false}},
+		{`a+b`, "xyz", [3]bool{false, false, false}},
+		{`a|ab`, "ab", [3]bool{true, true, true}},
+		{`x*`, "", [3]bool{true, true, true}},
+		{`x*`, "y", [3]bool{true, true, false}},
+		{`b$`, "ab", [3]bool{true, false, false}},
+	}
+	for _, tc := range tests {
+		re := MustCompile(tc.pattern)
+		for i, anchor := range []Anchor{Unanchored, AnchorStart, AnchorBoth} {
+			if got := re.MatchStringAnchored(tc.input, anchor); got != tc.want[i] {
+				t.Errorf("%#q.MatchStringAnchored(%q, %d) = %t; want %t", tc.pattern, tc.input, anchor, got, tc.want[i])
+			}
+			if got := re.MatchAnchored([]byte(tc.input), anchor); got != tc.want[i] {
+				t.Errorf("%#q.MatchAnchored(%q, %d) = %t; want %t", tc.pattern, tc.input, anchor, got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestMatchStringAnyAll(t *testing.T) {
+	re := MustCompile(`a+b`)
+	defer re.Close()
+	// Inputs larger than the memory reserved by default check that each reuses it.
+	large := strings.Repeat("x", 3000) + "aab"
+	tests := []struct {
+		inputs   []string
+		any, all bool
+	}{
+		{nil, false, true},
+		{[]string{"xyz"}, false, false},
+		{[]string{"aab"}, true, true},
+		{[]string{"xyz", "", "ab"}, true, false},
+		{[]string{"ab", large, "xaabx"}, true, true},
+		{[]string{large, strings.Repeat("y", 4000), "ab"}, true, false},
+	}
+	for _, tc := range tests {
+		if got := re.MatchStringAny(tc.inputs); got != tc.any {
+			t.Errorf("MatchStringAny(%.10q) = %t; want %t", tc.inputs, got, tc.any)
+		}
+		if got := re.MatchStringAll(tc.inputs); got != tc.all {
+			t.Errorf("MatchStringAll(%.10q) = %t; want %t", tc.inputs, got, tc.all)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		pattern string
+		opts    Options
+		maxMem  int64
+	}{
+		{`abc`, Options{}, 8 << 20},
+		{`(a)(?P<b>b)(?:c)`, Options{}, 8 << 20},
+		{`(\w+)@(\w+)\.com`, Options{MaxMem: 1 << 20}, 1 << 20},
+		{`(a)(b)`, Options{NeverCapture: true}, 8 << 20},
+	}
+	for _, tc := range tests {
+		t.Run(tc.pattern, func(t *testing.T) {
+			re := compileWithOrSkip(t, tc.pattern, tc.opts)
+			defer re.Close()
+			stats := re.Stats()
+			if stats.NumCaptureGroups != re.NumSubexp() {
+				t.Errorf("Stats().NumCaptureGroups = %d; want NumSubexp() = %d", stats.NumCaptureGroups, re.NumSubexp())
+			}
+			if stats.MaxMem != tc.maxMem {
+				t.Errorf("Stats().MaxMem = %d; want %d", stats.MaxMem, tc.maxMem)
+			}
+		})
+	}
+}
+
+func TestStatsProgramSize(t *testing.T) {
+	small, large := MustCompile(`a`), MustCompile(`[a-z]{10}\w+`)
+	defer small.Close()
+	defer large.Close()
+	s, l := small.Stats().ProgramSize, large.Stats().ProgramSize
+	if s == -1 {
+		t.Skip("program size not supported by the embedded libcre2, which needs to be rebuilt to export cre2_program_size")
+	}
+	if s <= 0 {
+		t.Errorf("ProgramSize of %#q = %d; want positive", `a`, s)
+	}
+	if s >= l {
+		t.Errorf("ProgramSize of %#q = %d; want less than %d of %#q", `a`, s, l, `[a-z]{10}\w+`)
+	}
+}
+
+func TestFullMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		want    bool
+	}{
+		{`a|ab`, "ab", true},
+		{`a|ab`, "abc", false},
+		{`a|ab`, "a", true},
+		{`a|ab`, "xab", false},
+		{`x*`, "", true},
+		{`\d+`, "123\n", false},
+	}
+	for _, tc := range tests {
+		re := MustCompile(tc.pattern)
+		if got := re.FullMatchString(tc.input); got != tc.want {
+			t.Errorf("%#q.FullMatchString(%q) = %t; want %t", tc.pattern, tc.input, got, tc.want)
+		}
+		if got := re.FullMatch([]byte(tc.input)); got != tc.want {
+			t.Errorf("%#q.FullMatch(%q) = %t; want %t", tc.pattern, tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestNUL(t *testing.T) {
+	for _, pattern := range []string{`a\x00b`, "a\x00b", `a[\x00-\x01]b`, "(?P<g>a\x00)b"} {
+		re := MustCompile(pattern)
+		if !re.MatchString("a\x00b") || re.MatchString("ab") {
+			t.Errorf("%+q does not match only %+q", pattern, "a\x00b")
+		}
+		if got, want := re.FindStringIndex("\x00xa\x00b\x00"), []int{2, 5}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%+q.FindStringIndex = %v; want %v", pattern, got, want)
+		}
+		if got, want := re.FindAll([]byte("a\x00ba\x00b"), -1), [][]byte{[]byte("a\x00b"), []byte("a\x00b")}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%+q.FindAll = %+q; want %+q", pattern, got, want)
+		}
+		if got, want := re.ReplaceAllString("x\x00a\x00b", "\x00$0\x00"), "x\x00\x00a\x00b\x00"; got != want {
+			t.Errorf("%+q.ReplaceAllString = %+q; want %+q", pattern, got, want)
+		}
+		if got, want := re.String(), pattern; got != want {
+			t.Errorf("String() = %+q; want %+q", got, want)
+		}
+	}
+
+	re := MustCompile("(?P<g>a\x00*)(b)")
+	if got, want := re.FindStringSubmatch("a\x00\x00b"), []string{"a\x00\x00b", "a\x00\x00", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindStringSubmatch = %+q; want %+q", got, want)
+	}
+	if got, want := re.SubexpNames(), []string{"", "g", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SubexpNames() = %q; want %q", got, want)
+	}
+	if got, want := re.Split("xa\x00by\x00", -1), []string{"x", "y\x00"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Split = %+q; want %+q", got, want)
+	}
+
+	if _, err := Compile("(?P<a\x00>x)"); err == nil {
+		t.Errorf("Compile(%+q): expected error for NUL in group name", "(?P<a\x00>x)")
+	}
+
+	// Errors report the full pattern, not just up to the NUL.
+	_, err := Compile("a\x00(")
+	if _, want := regexp.Compile("a\x00("); err == nil || err.Error() != want.Error() {
+		t.Errorf("Compile(%+q): err = %+q; want %+q", "a\x00(", err, want)
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	type config struct {
+		Ptr   *Regexp
+		Value Regexp
+	}
+	const data = `{"Ptr":"a+b","Value":"(?i)x\\d+?"}`
+
+	var cfg config
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	if !cfg.Ptr.MatchString("xaab") || !cfg.Value.MatchString("X1") {
+		t.Errorf("unmarshaled expressions do not match")
+	}
+	out, err := json.Marshal(&cfg)
+	if err != nil {
+		t.Fatalf("Marshal: unexpected error: %v", err)
+	}
+	if string(out) != data {
+		t.Errorf("Marshal = %s; want %s", out, data)
+	}
+
+	// Expressions unmarshaled in place are released only once.
+	cfg.Value.Longest()
+	if got := cfg.Value.FindString("x12"); got != "x12" {
+		t.Errorf("FindString after Longest = %q; want %q", got, "x12")
+	}
+	if err := cfg.Value.UnmarshalText([]byte("y+")); err != nil {
+		t.Fatalf("UnmarshalText: unexpected error: %v", err)
+	}
+	if got := cfg.Value.FindString("xyyy"); got != "yyy" {
+		t.Errorf("FindString after second UnmarshalText = %q; want %q", got, "yyy")
+	}
+	if err := cfg.Value.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if err := cfg.Value.Close(); err != nil {
+		t.Errorf("second Close: unexpected error: %v", err)
+	}
+	runtime.GC()
+
+	var re Regexp
+	err = re.UnmarshalText([]byte("a("))
+	_, want := Compile("a(")
+	if err == nil || err.Error() != want.Error() {
+		t.Errorf("UnmarshalText(%q): err = %v; want %v", "a(", err, want)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	type config struct {
+		Rules []*Regexp
+	}
+	opts := []Options{
+		{},
+		{CaseInsensitive: true, MaxMem: 1 << 20},
+		{POSIX: true},
+	}
+	var cfg config
+	for _, o := range opts {
+		cfg.Rules = append(cfg.Rules, compileWithOrSkip(t, `a|ab`, o))
+	}
+	longest := MustCompile(`b+?`)
+	longest.Longest()
+	cfg.Rules = append(cfg.Rules, longest)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cfg); err != nil {
+		t.Fatalf("Encode: unexpected error: %v", err)
+	}
+	var decoded config
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatalf("Decode: unexpected error: %v", err)
+	}
+	for i, re := range decoded.Rules {
+		if re.opts != cfg.Rules[i].opts || re.String() != cfg.Rules[i].String() {
+			t.Errorf("decoded %#q with %+v; want %#q with %+v", re, re.opts, cfg.Rules[i], cfg.Rules[i].opts)
+		}
+		for _, s := range []string{"AB", "xab", "bbb"} {
+			if got, want := re.FindString(s), cfg.Rules[i].FindString(s); got != want {
+				t.Errorf("decoded %#q.FindString(%q) = %q; want %q", re, s, got, want)
+			}
+		}
+	}
+
+	// The encoding is stable so that stored data remains readable.
+	got, err := cfg.Rules[1].MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: unexpected error: %v", err)
+	}
+	if want := []byte("\x01\x80\x80\x80\x01\x01a|ab"); !bytes.Equal(got, want) {
+		t.Errorf("MarshalBinary = %q; want %q", got, want)
+	}
+
+	for _, data := range []string{
+		"",
+		"\x02\x00\x00a",
+		"\x01\x80",
+		"\x01\x00\x80",
+		"\x01\x00\x80\x20a",
+		"\x01\x00\x00a(",
+	} {
+		var re Regexp
+		if err := re.UnmarshalBinary([]byte(data)); err == nil {
+			t.Errorf("UnmarshalBinary(%q): expected error", data)
+		}
+	}
+}
+
+func TestCompileFromProgram(t *testing.T) {
+	re := MustCompile(`(?i)a+b`)
+	re.Longest()
+	prog, err := re.Program()
+	if err != nil {
+		t.Fatalf("Program: unexpected error: %v", err)
+	}
+	loaded, err := CompileFromProgram(prog)
+	if err != nil {
+		t.Fatalf("CompileFromProgram: unexpected error: %v", err)
+	}
+	if loaded.opts != re.opts || loaded.String() != re.String() {
+		t.Errorf("loaded %#q with %+v; want %#q with %+v", loaded, loaded.opts, re, re.opts)
+	}
+	if got, want := loaded.FindString("xAaBb"), "AaB"; got != want {
+		t.Errorf("loaded FindString = %q; want %q", got, want)
+	}
+
+	for _, prog := range []string{"", "\x02\x00\x00a", "\x01\x00\x00a("} {
+		if re, err := CompileFromProgram([]byte(prog)); err == nil || re != nil {
+			t.Errorf("CompileFromProgram(%q) = %v, %v; want nil, error", prog, re, err)
+		}
+	}
+}
+
+func TestCompileErrorsStdlib(t *testing.T) {
+	for _, pattern := range []string{
+		`(`, `)`, `a(b`, `a)b`, `[a`, `[z-a]`, `a**`, `a++`, `*`, `+a`,
+		`?`, `a{2,1}`, `a{1001}`, `x{1,1001}`, `\`, `a\`, `\8`, `\q`, `\pX`, `\p{Foo}`,
+		`[[:foo:]]`, `(?P<>a)`, `(?P<a!>x)`, `(?<`, `(?i`, `(?z)`, `(?=a)`, `(?!a)`, `\1`, "a\xffb",
+		`[\Q]\E`, `(?P=n)`, `\Z`, `[a-\d]`, `x{2}{3}`, `(?:)**`,
+	} {
+		re, stdlibOK, err := CompileCompat(pattern)
+		if re != nil || stdlibOK {
+			t.Errorf("CompileCompat(%+q) = %v, %t; want nil, false", pattern, re, stdlibOK)
+		}
+		_, want := regexp.Compile(pattern)
+		var syntaxErr *syntax.Error
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Compile(%+q): err = %v; want *syntax.Error", pattern, err)
+			continue
+		}
+		if err.Error() != want.Error() {
+			t.Errorf("Compile(%+q): err = %+q; want %+q", pattern, err, want)
+		}
+	}
+
+	// GAP: re2 accepts \C, matching any byte, which the standard library rejects.
+	if re, stdlibOK, err := CompileCompat(`a\C`); err != nil || re == nil || stdlibOK {
+		t.Errorf("CompileCompat(%#q) = %v, %t, %v; want non-nil, false, nil", `a\C`, re, stdlibOK, err)
+	}
+	// GAP: since Go 1.22, the standard library parses (?< as a named group, re2 as a Perl operator.
+	if _, err := Compile(`(?<=a)`); !errors.Is(err, ErrBadPerlOp) {
+		t.Errorf("Compile(%#q): err = %v; want %v", `(?<=a)`, err, ErrBadPerlOp)
+	}
+	if re, stdlibOK, err := CompileCompat(`a+b`); err != nil || re == nil || !stdlibOK {
+		t.Errorf("CompileCompat(%#q) = %v, %t, %v; want non-nil, true, nil", `a+b`, re, stdlibOK, err)
+	}
+}
+
+func TestCompileErrorCodes(t *testing.T) {
+	seen := map[error]int{}
+	for i, c := range compileErrorCodes {
+		code := i + 1
+		err := compileError(code, "x", "x")
+		if !errors.Is(err, c.err) {
+			t.Errorf("compileError(%d) = %v; want errors.Is %v", code, err, c.err)
+		}
+		var syntaxErr *syntax.Error
+		if !errors.As(err, &syntaxErr) || syntaxErr.Code != c.code {
+			t.Errorf("compileError(%d) = %v; want *syntax.Error with code %v", code, err, c.code)
+		}
+		if prev, ok := seen[c.err]; ok {
+			t.Errorf("error codes %d and %d both map to %v", prev, code, c.err)
+		}
+		seen[c.err] = code
+	}
+
+	tests := []struct {
+		pattern string
+		want    error
+	}{
+		{`\8`, ErrBadEscape},
+		{`[[:foo:]]`, ErrBadCharRange},
+		{`[z-a]`, ErrBadCharRange},
+		{`[a`, ErrMissingBracket},
+		{`a(b`, ErrMissingParen},
+		{`a)b`, ErrUnexpectedParen},
+		{`a\`, ErrTrailingBackslash},
+		{`*`, ErrRepeatArgument},
+		{`a{1001}`, ErrRepeatSize},
+		{`a**`, ErrRepeatOp},
+		{`(?z)`, ErrBadPerlOp},
+		{"a\xffb", ErrBadUTF8},
+		{`(?P<a!>x)`, ErrBadNamedCapture},
+	}
+	for _, tc := range tests {
+		_, err := Compile(tc.pattern)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("Compile(%+q): err = %v; want errors.Is %v", tc.pattern, err, tc.want)
+		}
+		for _, c := range compileErrorCodes {
+			if c.err != tc.want && errors.Is(err, c.err) {
+				t.Errorf("Compile(%+q): err = %v; unexpectedly errors.Is %v", tc.pattern, err, c.err)
+			}
+		}
+	}
+}
+
+func TestCompileReader(t *testing.T) {
+	re, err := CompileReader(strings.NewReader(`a+b`))
+	if err != nil {
+		t.Fatalf("CompileReader: unexpected error: %v", err)
+	}
+	if re.String() != `a+b` || !re.MatchString("xaab") {
+		t.Errorf("CompileReader = %#q; want %#q", re, `a+b`)
+	}
+
+	errRead := errors.New("read failed")
+	if _, err := CompileReader(io.MultiReader(strings.NewReader(`a+`), iotest.ErrReader(errRead))); !errors.Is(err, errRead) {
+		t.Errorf("CompileReader with failing reader: err = %v; want %v", err, errRead)
+	}
+
+	if _, err := CompileReader(strings.NewReader(`a(`)); !errors.Is(err, ErrMissingParen) {
+		t.Errorf("CompileReader(%#q): err = %v; want %v", `a(`, err, ErrMissingParen)
+	}
+
+	long := strings.NewReader(strings.Repeat("a", 2*maxReaderExprSize))
+	if _, err := CompileReader(long); !errors.Is(err, ErrPatternTooLarge) || long.Len() == 0 {
+		t.Errorf("CompileReader with too long expression: err = %v; want %v", err, ErrPatternTooLarge)
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, pattern := range []string{``, `a+b`, `(?P<name>x)|\d{3}`} {
+		if err := Valid(pattern); err != nil {
+			t.Errorf("Valid(%#q) = %v; want nil", pattern, err)
+		}
+	}
+	for _, pattern := range []string{`a(b`, `*`, `(?z)`} {
+		_, want := Compile(pattern)
+		if err := Valid(pattern); err == nil || err.Error() != want.Error() {
+			t.Errorf("Valid(%#q) = %v; want %v", pattern, err, want)
+		}
+	}
+}
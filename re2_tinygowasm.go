@@ -3,6 +3,7 @@
 package re2
 
 import (
+	"context"
 	"reflect"
 	"unsafe"
 
@@ -11,30 +12,123 @@ import (
 
 type libre2ABI struct{}
 
-func newABI() *libre2ABI {
-	return &libre2ABI{}
+// contextInterrupts is whether matchContext interrupts a match when its context is done,
+// which native code cannot be.
+const contextInterrupts = false
+
+// Warmup prepares re2 ahead of the first compilation of an expression. re2 is linked
+// natively in this build, so there is nothing to prepare and it only reports a done ctx.
+func Warmup(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func acquireABI() (*libre2ABI, error) {
+	return &libre2ABI{}, nil
+}
+
+func acquireBatchABIs(n int) ([]*libre2ABI, error) {
+	abis := make([]*libre2ABI, n)
+	for i := range abis {
+		abis[i], _ = acquireABI()
+	}
+	return abis, nil
+}
+
+func acquireSpareABI() (*libre2ABI, error) {
+	return acquireABI()
+}
+
+func acquireInterruptibleABI() (*libre2ABI, error) {
+	return acquireABI()
+}
+
+func acquireScratchABI() (*libre2ABI, error) {
+	return acquireABI()
+}
+
+func acquireUnsynchronizedABI() (*libre2ABI, error) {
+	return acquireABI()
 }
 
 func (abi *libre2ABI) startOperation(memorySize int) {
+	if abi == nil {
+		panic(errClosed)
+	}
+}
+
+func (abi *libre2ABI) tryStartOperation(memorySize int) (bool, error) {
+	if abi == nil {
+		panic(errClosed)
+	}
+	return true, nil
+}
+
+func (abi *libre2ABI) startOperationContext(ctx context.Context, memorySize int) error {
+	if abi == nil {
+		panic(errClosed)
+	}
+	return ctx.Err()
 }
 
 func (abi *libre2ABI) endOperation() {
 }
 
-func newRE(abi *libre2ABI, pattern cString, longest bool, posix bool, caseInsensitive bool) uintptr {
-	opt := cre2.NewOpt()
+func (abi *libre2ABI) isDropped() bool {
+	return false
+}
+
+func (abi *libre2ABI) resetMemory() {
+}
+
+func checkOptions(_ *libre2ABI, _ Options) error {
+	return nil
+}
+
+func newRE(abi *libre2ABI, pattern cString, opts Options) uintptr {
+	opt := newOpt(opts)
 	defer cre2.DeleteOpt(opt)
-	cre2.OptSetLogErrors(opt, false)
-	if longest {
+	return uintptr(cre2.New(unsafe.Pointer(uintptr(pattern.ptr)), int(pattern.length), opt))
+}
+
+// newOpt returns new options of re2 set from opts, to be deleted with cre2.DeleteOpt.
+func newOpt(opts Options) unsafe.Pointer {
+	opt := cre2.NewOpt()
+	cre2.OptSetLogErrors(opt, opts.LogErrors)
+	if opts.MaxMem > 0 {
+		cre2.OptSetMaxMem(opt, opts.MaxMem)
+	}
+	// POSIX syntax always implies leftmost-longest semantics, as in the standard library.
+	if opts.Longest || opts.POSIX {
 		cre2.OptSetLongestMatch(opt, true)
 	}
-	if posix {
+	if opts.POSIX {
 		cre2.OptSetPosixSyntax(opt, true)
 	}
-	if caseInsensitive {
+	if opts.CaseInsensitive {
 		cre2.OptSetCaseSensitive(opt, false)
 	}
-	return uintptr(cre2.New(unsafe.Pointer(uintptr(pattern.ptr)), int(pattern.length), opt))
+	if opts.Latin1 {
+		cre2.OptSetEncoding(opt, encodingLatin1)
+	}
+	if opts.NeverNL {
+		cre2.OptSetNeverNL(opt, true)
+	}
+	if opts.DotNL {
+		cre2.OptSetDotNL(opt, true)
+	}
+	if opts.Literal {
+		cre2.OptSetLiteral(opt, true)
+	}
+	if opts.NeverCapture {
+		cre2.OptSetNeverCapture(opt, true)
+	}
+	if opts.WordBoundary {
+		cre2.OptSetWordBoundary(opt, true)
+	}
+	if opts.OneLine {
+		cre2.OptSetOneLine(opt, true)
+	}
+	return opt
 }
 
 func reError(abi *libre2ABI, rePtr uintptr) (int, string) {
@@ -53,22 +147,73 @@ func numCapturingGroups(abi *libre2ABI, rePtr uintptr) int {
 	return cre2.NumCapturingGroups(unsafe.Pointer(rePtr))
 }
 
+func programSize(_ *libre2ABI, rePtr uintptr) int {
+	return cre2.ProgramSize(unsafe.Pointer(rePtr))
+}
+
 func deleteRE(_ *libre2ABI, rePtr uintptr) {
 	cre2.Delete(unsafe.Pointer(rePtr))
 }
 
-func release(re *Regexp) {
+func setSupported(_ *libre2ABI) bool {
+	return true
+}
+
+func newSet(_ *libre2ABI, opts Options) uintptr {
+	opt := newOpt(opts)
+	defer cre2.DeleteOpt(opt)
+	return uintptr(cre2.SetNew(opt, int(Unanchored)))
+}
+
+func setAdd(_ *libre2ABI, setPtr uintptr, pattern cString) int {
+	return cre2.SetAdd(unsafe.Pointer(setPtr), unsafe.Pointer(pattern.ptr), pattern.length)
+}
+
+func setCompile(_ *libre2ABI, setPtr uintptr) bool {
+	return cre2.SetCompile(unsafe.Pointer(setPtr))
+}
+
+func setMatch(_ *libre2ABI, setPtr uintptr, text cString, n int) []int {
+	matches := make([]int32, n)
+	matched := cre2.SetMatch(unsafe.Pointer(setPtr), unsafe.Pointer(text.ptr), text.length, matches)
+	if matched > n {
+		matched = n
+	}
+	res := make([]int, matched)
+	for i := range res {
+		res[i] = int(matches[i])
+	}
+	return res
+}
+
+func releaseSet(_ *libre2ABI, setPtr uintptr) error {
+	cre2.SetDelete(unsafe.Pointer(setPtr))
+	return nil
+}
+
+func release(re *Regexp) error {
 	deleteRE(re.abi, re.ptr)
+	return nil
+}
+
+func releaseABI(_ *libre2ABI) {
 }
 
 func match(re *Regexp, s cString, matchesPtr uintptr, nMatches uint32) bool {
-	return cre2.Match(unsafe.Pointer(re.ptr), unsafe.Pointer(s.ptr),
-		int(s.length), 0, int(s.length), 0, unsafe.Pointer(matchesPtr), int(nMatches))
+	return matchAnchored(re, s, 0, Unanchored, matchesPtr, nMatches)
 }
 
 func matchFrom(re *Regexp, s cString, startPos int, matchesPtr uintptr, nMatches uint32) bool {
+	return matchAnchored(re, s, startPos, Unanchored, matchesPtr, nMatches)
+}
+
+func matchAnchored(re *Regexp, s cString, startPos int, anchor Anchor, matchesPtr uintptr, nMatches uint32) bool {
 	return cre2.Match(unsafe.Pointer(re.ptr), unsafe.Pointer(s.ptr),
-		int(s.length), startPos, int(s.length), 0, unsafe.Pointer(matchesPtr), int(nMatches))
+		int(s.length), startPos, int(s.length), int(anchor), unsafe.Pointer(matchesPtr), int(nMatches))
+}
+
+func matchContext(_ context.Context, re *Regexp, s cString) (bool, error) {
+	return match(re, s, 0, 0), nil
 }
 
 type cString struct {
@@ -99,6 +244,19 @@ func newCStringFromBytes(_ *libre2ABI, s []byte) cString {
 	}
 }
 
+// newSourceText returns b as is for a Source, Replacer or ReplaceAllTo, which keeps it
+// alive, since re2 matches Go memory directly.
+func newSourceText(abi *libre2ABI, b []byte) (cString, error) {
+	if len(b) == 0 {
+		// As in newCString, avoid a null pointer for empty text.
+		b = []byte("a")[0:0]
+	}
+	return newCStringFromBytes(abi, b), nil
+}
+
+func freeSourceText(_ *libre2ABI, _ cString) {
+}
+
 func newCStringPtr(_ *libre2ABI, cs cString) pointer {
 	return pointer{ptr: uintptr(unsafe.Pointer(&cs))}
 }
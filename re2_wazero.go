@@ -8,6 +8,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/bits"
+	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,21 +19,12 @@ import (
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
-)
-
-var (
-	errFailedWrite = errors.New("failed to read from wasm memory")
-	errFailedRead  = errors.New("failed to read from wasm memory")
+	"github.com/tetratelabs/wazero/sys"
 )
 
 //go:embed wasm/libcre2.so
 var libre2 []byte
 
-var (
-	wasmRT       wazero.Runtime
-	wasmCompiled wazero.CompiledModule
-)
-
 type libre2ABI struct {
 	cre2New                   api.Function
 	cre2Delete                api.Function
@@ -38,6 +32,7 @@ type libre2ABI struct {
 	cre2PartialMatch          api.Function
 	cre2FindAndConsume        api.Function
 	cre2NumCapturingGroups    api.Function
+	cre2ProgramSize           api.Function
 	cre2ErrorCode             api.Function
 	cre2ErrorArg              api.Function
 	cre2NamedGroupsIterNew    api.Function
@@ -46,10 +41,23 @@ type libre2ABI struct {
 	cre2GlobalReplace         api.Function
 	cre2OptNew                api.Function
 	cre2OptDelete             api.Function
+	cre2OptSetMaxMem          api.Function
+	cre2OptSetEncoding        api.Function
+	cre2OptSetNeverNL         api.Function
+	cre2OptSetDotNL           api.Function
+	cre2OptSetLiteral         api.Function
+	cre2OptSetNeverCapture    api.Function
+	cre2OptSetWordBoundary    api.Function
+	cre2OptSetOneLine         api.Function
 	cre2OptSetLogErrors       api.Function
 	cre2OptSetLongestMatch    api.Function
 	cre2OptSetPosixSyntax     api.Function
 	cre2OptSetCaseSensitive   api.Function
+	cre2SetNew                api.Function
+	cre2SetDelete             api.Function
+	cre2SetAdd                api.Function
+	cre2SetCompile            api.Function
+	cre2SetMatch              api.Function
 
 	malloc api.Function
 	free   api.Function
@@ -59,33 +67,283 @@ type libre2ABI struct {
 	mod api.Module
 
 	memory sharedMemory
-	mu     sync.Mutex
+
+	// lock guards use of the module. It is a channel of capacity one rather than a mutex
+	// so that waiting for it can be abandoned when a context is done.
+	lock chan struct{}
+
+	// unsynchronized skips lock for a module hosting a single expression compiled with
+	// Options.Unsynchronized.
+	unsynchronized bool
+
+	// refs is the number of expressions currently compiled into the module and hosted
+	// the number ever compiled into it. Both are guarded by modulePool.mu.
+	refs   int
+	hosted int
+
+	// dropped is set atomically, with modulePool.mu held, when the module was closed by
+	// dropABI.
+	dropped uint32
 }
 
-func init() {
-	ctx := context.Background()
-	rt := wazero.NewRuntime(ctx)
+// contextInterrupts is whether matchContext interrupts a match when its context is done,
+// which closes the module it runs in.
+const contextInterrupts = true
+
+// regexpsPerModule is the number of expressions compiled into a module before a new one
+// is instantiated for further expressions. As a module's memory never shrinks, this
+// bounds how much memory a long-lived module can retain for expressions that are gone.
+const regexpsPerModule = 64
+
+// modulePool holds the modules new expressions are compiled into. Instantiating a module
+// per expression is expensive in both time and memory when compiling many expressions, so
+// they share modules instead. Expressions are assigned to modules round-robin so that
+// expressions compiled in sequence, e.g., copies of one expression, can still be matched
+// in parallel.
+var modulePool struct {
+	mu   sync.Mutex
+	open []*libre2ABI
+	next int
+
+	// rt is the runtime modules are instantiated in and compiled is libre2 compiled
+	// into it, both initialized on first use unless configured with SetRuntime.
+	rt       wazero.Runtime
+	compiled wazero.CompiledModule
+
+	// defaultRT and defaultCompiled are the runtime created by this package, kept for
+	// when SetRuntime restores it, and defaultConfig the configuration to create it with.
+	defaultRT       wazero.Runtime
+	defaultCompiled wazero.CompiledModule
+	defaultConfig   wazero.RuntimeConfig
+
+	// interruptibleRT is created like defaultRT but closes a module when the context of
+	// a call into it is done, for MatchStringContext, as doing so slows down all calls.
+	// interruptibleCompiled is libre2 compiled into it. Both are initialized on first use.
+	interruptibleRT       wazero.Runtime
+	interruptibleCompiled wazero.CompiledModule
+
+	// scratch is the module Valid compiles expressions into, kept open between calls
+	// by a reference of the pool and not counted as hosting them.
+	scratch *libre2ABI
+
+	// live is the number of modules instantiated and not closed yet, limited to maxModules
+	// if positive.
+	live       int
+	maxModules int
+}
+
+// SetRuntime configures the wazero runtime that expressions compiled after the call are
+// instantiated in, for applications that already manage one, e.g., to share its compilation
+// cache or memory limits. libre2 is compiled into rt when first needed, instantiating WASI
+// into it if not already present. A nil rt restores the runtime created by this package.
+//
+// Expressions compiled before the call keep using the runtime they were compiled with, which
+// must not be closed while they are in use. MatchStringContext only interrupts a match when
+// its context is done if rt is configured with RuntimeConfig.WithCloseOnContextDone.
+func SetRuntime(rt wazero.Runtime) {
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	if rt == nil {
+		rt = modulePool.defaultRT
+	}
+	if rt == modulePool.rt {
+		return
+	}
+
+	modulePool.rt = rt
+	modulePool.compiled = nil
+	if rt != nil && rt == modulePool.defaultRT {
+		modulePool.compiled = modulePool.defaultCompiled
+	}
+	// Existing modules belong to the previous runtime, so don't compile new expressions into them.
+	modulePool.open = nil
+	releaseScratchLocked()
+}
+
+// SetCompilationCacheDir configures the runtime created by this package to persist the
+// compiled re2 module in dir, so that later runs of the process can load it instead of
+// compiling it again, which otherwise takes a noticeable amount of time on the first
+// compilation of an expression. It must be called before compiling any expression and
+// returns an error if called after or if dir cannot be used as a cache directory.
+//
+// The cache is not used by a runtime configured with SetRuntime, which can instead be
+// created with its own compilation cache.
+func SetCompilationCacheDir(dir string) error {
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	if modulePool.defaultRT != nil {
+		return errors.New("re2: SetCompilationCacheDir called after compiling an expression")
+	}
 
-	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		return fmt.Errorf("re2: failed to open compilation cache: %w", err)
+	}
+	modulePool.defaultConfig = defaultRuntimeConfig().WithCompilationCache(cache)
+	return nil
+}
+
+// SetMaxWasmMemoryPages configures the runtime created by this package to limit the memory
+// of each module to pages of 64KiB, so that an expression or input needing more fails
+// instead of growing memory without bound. Compile returns an error when the limit is
+// reached, as do MatchStringContext and the package-level Match functions, while other
+// methods panic with it. It must be called before compiling any expression and returns an
+// error if called after or if pages exceeds the maximum of 65536 pages, i.e., 4GiB.
+//
+// The limit is not used by a runtime configured with SetRuntime, which can instead be
+// created with its own memory limit.
+func SetMaxWasmMemoryPages(pages uint32) error {
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	if modulePool.defaultRT != nil {
+		return errors.New("re2: SetMaxWasmMemoryPages called after compiling an expression")
+	}
+	if pages > maxWasmMemoryPages {
+		return fmt.Errorf("re2: memory limit of %d pages exceeds the maximum of %d", pages, maxWasmMemoryPages)
+	}
+
+	modulePool.defaultConfig = defaultRuntimeConfig().WithMemoryLimitPages(pages)
+	return nil
+}
+
+// SetMaxModules limits the number of WebAssembly modules instantiated at the same time to
+// n, bounding the memory used by applications compiling many expressions, e.g., from user
+// rules. A module hosts up to 64 expressions, or a single one for spares and expressions
+// compiled with Options.Unsynchronized, and is closed when all of them are closed or
+// garbage collected. Once the limit is reached, compiling an expression that needs a new
+// module returns an error wrapping ErrTooManyModules, and matching waits for a busy
+// expression instead of compiling a spare of it. A limit that is not positive, the default,
+// allows any number of modules. Lowering the limit doesn't close modules already open.
+func SetMaxModules(n int) {
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	modulePool.maxModules = n
+}
+
+// Warmup compiles the re2 module ahead of the first compilation of an expression, which
+// otherwise pays for it, so that the cost can be paid at a controlled time such as during
+// startup. The module is never compiled by merely importing the package. Configuration of
+// the runtime created by this package, such as SetCompilationCacheDir, must happen before
+// Warmup. Calling it again, or after compiling an expression, does nothing.
+func Warmup(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	if modulePool.compiled != nil {
+		return nil
+	}
+	if err := compileModule(ctx); err != nil {
+		return fmt.Errorf("re2: failed to compile module: %w", err)
+	}
+	return nil
+}
+
+const (
+	// maxWasmMemoryPages is the number of pages addressable by 32-bit WebAssembly.
+	maxWasmMemoryPages = 65536
+
+	// wasmPageSize is the size in bytes of a page of WebAssembly memory.
+	wasmPageSize = 65536
+)
+
+// defaultRuntimeConfig returns the configuration to create the default runtime with so far,
+// for further configuration. It must be called with modulePool.mu held.
+func defaultRuntimeConfig() wazero.RuntimeConfig {
+	if cfg := modulePool.defaultConfig; cfg != nil {
+		return cfg
+	}
+	return wazero.NewRuntimeConfig()
+}
+
+// compileModule compiles libre2 into the configured runtime, creating a default one if
+// none is configured. It must be called with modulePool.mu held.
+func compileModule(ctx context.Context) error {
+	rt := modulePool.rt
+	if rt == nil {
+		rt = wazero.NewRuntimeWithConfig(ctx, defaultRuntimeConfig())
+		modulePool.defaultRT = rt
+	}
+
+	if rt.Module(wasi_snapshot_preview1.ModuleName) == nil {
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+			return err
+		}
+	}
 
 	code, err := rt.CompileModule(ctx, libre2)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	wasmCompiled = code
 
-	wasmRT = rt
+	modulePool.rt = rt
+	modulePool.compiled = code
+	if rt == modulePool.defaultRT {
+		modulePool.defaultCompiled = code
+	}
+	return nil
+}
+
+// compileInterruptibleModule creates the runtime for modules of interruptible calls and
+// compiles libre2 into it. It must be called with modulePool.mu held.
+func compileInterruptibleModule(ctx context.Context) error {
+	rt := wazero.NewRuntimeWithConfig(ctx, defaultRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		_ = rt.Close(ctx)
+		return err
+	}
+	code, err := rt.CompileModule(ctx, libre2)
+	if err != nil {
+		_ = rt.Close(ctx)
+		return err
+	}
+
+	modulePool.interruptibleRT = rt
+	modulePool.interruptibleCompiled = code
+	return nil
 }
 
 var moduleIdx = uint64(0)
 
-func newABI() *libre2ABI {
+// newABI instantiates a new module, in which calls are interrupted when their context is
+// done if interruptible. It must be called with modulePool.mu held.
+func newABI(interruptible bool) (*libre2ABI, error) {
 	ctx := context.Background()
+	if modulePool.compiled == nil {
+		if err := compileModule(ctx); err != nil {
+			return nil, err
+		}
+	}
+	rt, compiled := modulePool.rt, modulePool.compiled
+	// A runtime configured with SetRuntime is used as is.
+	if interruptible && rt == modulePool.defaultRT {
+		if modulePool.interruptibleCompiled == nil {
+			if err := compileInterruptibleModule(ctx); err != nil {
+				return nil, err
+			}
+		}
+		rt, compiled = modulePool.interruptibleRT, modulePool.interruptibleCompiled
+	}
+
+	if modulePool.maxModules > 0 && modulePool.live >= modulePool.maxModules {
+		return nil, ErrTooManyModules
+	}
+
 	modIdx := atomic.AddUint64(&moduleIdx, 1)
-	mod, err := wasmRT.InstantiateModule(ctx, wasmCompiled, wazero.NewModuleConfig().WithName(strconv.FormatUint(modIdx, 10)))
+	// re2 only writes to stderr to log errors for expressions with Options.LogErrors.
+	cfg := wazero.NewModuleConfig().WithName(strconv.FormatUint(modIdx, 10)).WithStderr(os.Stderr)
+	mod, err := rt.InstantiateModule(ctx, compiled, cfg)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	modulePool.live++
 
 	abi := &libre2ABI{
 		cre2New:                   mod.ExportedFunction("cre2_new"),
@@ -94,6 +352,7 @@ func newABI() *libre2ABI {
 		cre2PartialMatch:          mod.ExportedFunction("cre2_partial_match_re"),
 		cre2FindAndConsume:        mod.ExportedFunction("cre2_find_and_consume_re"),
 		cre2NumCapturingGroups:    mod.ExportedFunction("cre2_num_capturing_groups"),
+		cre2ProgramSize:           mod.ExportedFunction("cre2_program_size"),
 		cre2ErrorCode:             mod.ExportedFunction("cre2_error_code"),
 		cre2ErrorArg:              mod.ExportedFunction("cre2_error_arg"),
 		cre2NamedGroupsIterNew:    mod.ExportedFunction("cre2_named_groups_iter_new"),
@@ -102,75 +361,462 @@ func newABI() *libre2ABI {
 		cre2GlobalReplace:         mod.ExportedFunction("cre2_global_replace_re"),
 		cre2OptNew:                mod.ExportedFunction("cre2_opt_new"),
 		cre2OptDelete:             mod.ExportedFunction("cre2_opt_delete"),
+		cre2OptSetMaxMem:          mod.ExportedFunction("cre2_opt_set_max_mem"),
+		cre2OptSetEncoding:        mod.ExportedFunction("cre2_opt_set_encoding"),
+		cre2OptSetNeverNL:         mod.ExportedFunction("cre2_opt_set_never_nl"),
+		cre2OptSetDotNL:           mod.ExportedFunction("cre2_opt_set_dot_nl"),
+		cre2OptSetLiteral:         mod.ExportedFunction("cre2_opt_set_literal"),
+		cre2OptSetNeverCapture:    mod.ExportedFunction("cre2_opt_set_never_capture"),
+		cre2OptSetWordBoundary:    mod.ExportedFunction("cre2_opt_set_word_boundary"),
+		cre2OptSetOneLine:         mod.ExportedFunction("cre2_opt_set_one_line"),
 		cre2OptSetLogErrors:       mod.ExportedFunction("cre2_opt_set_log_errors"),
 		cre2OptSetLongestMatch:    mod.ExportedFunction("cre2_opt_set_longest_match"),
 		cre2OptSetPosixSyntax:     mod.ExportedFunction("cre2_opt_set_posix_syntax"),
 		cre2OptSetCaseSensitive:   mod.ExportedFunction("cre2_opt_set_case_sensitive"),
+		cre2SetNew:                mod.ExportedFunction("cre2_set_new"),
+		cre2SetDelete:             mod.ExportedFunction("cre2_set_delete"),
+		cre2SetAdd:                mod.ExportedFunction("cre2_set_add"),
+		cre2SetCompile:            mod.ExportedFunction("cre2_set_compile"),
+		cre2SetMatch:              mod.ExportedFunction("cre2_set_match"),
 
 		malloc: mod.ExportedFunction("malloc"),
 		free:   mod.ExportedFunction("free"),
 
 		wasmMemory: mod.Memory(),
 		mod:        mod,
+
+		lock: make(chan struct{}, 1),
+	}
+
+	return abi, nil
+}
+
+// acquireABI returns a module to compile a new expression into, which must be passed to
+// unrefABI when the expression is deleted.
+func acquireABI() (*libre2ABI, error) {
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	if len(modulePool.open) == 0 {
+		modulePool.open = make([]*libre2ABI, runtime.GOMAXPROCS(0))
+	}
+	idx := modulePool.next % len(modulePool.open)
+	modulePool.next++
+
+	abi := modulePool.open[idx]
+	if abi == nil || abi.hosted == regexpsPerModule {
+		var err error
+		if abi, err = newABI(false); err != nil {
+			// At the limit of modules, use any other with room for the expression.
+			if abi = openABIWithRoom(); abi == nil {
+				return nil, err
+			}
+		} else {
+			modulePool.open[idx] = abi
+		}
+	}
+	abi.refs++
+	abi.hosted++
+	return abi, nil
+}
+
+// acquireBatchABIs returns the modules to compile n expressions into together, each to
+// be passed to unrefABI like one from acquireABI when its expression is deleted. New
+// modules are filled with regexpsPerModule expressions each, and once no more can be
+// instantiated, remaining expressions go into open modules with room. The modules of
+// expressions for which there is none are nil, with the error instantiating a module.
+func acquireBatchABIs(n int) ([]*libre2ABI, error) {
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	abis := make([]*libre2ABI, n)
+	var abi *libre2ABI
+	var abiErr error
+	for i := range abis {
+		if abi == nil || abi.hosted == regexpsPerModule {
+			if abiErr == nil {
+				abi, abiErr = newABI(false)
+			}
+			if abiErr != nil {
+				// At the limit of modules, use any other with room for the expression.
+				if abi = openABIWithRoom(); abi == nil {
+					return abis, abiErr
+				}
+			}
+		}
+		abi.refs++
+		abi.hosted++
+		abis[i] = abi
+	}
+	return abis, nil
+}
+
+// openABIWithRoom returns an open module that can host another expression, or nil. It must
+// be called with modulePool.mu held.
+func openABIWithRoom() *libre2ABI {
+	for _, abi := range modulePool.open {
+		if abi != nil && abi.hosted < regexpsPerModule {
+			return abi
+		}
+	}
+	return nil
+}
+
+// acquireSpareABI returns a new module for a spare instance of an expression, to be
+// released with unrefABI like one from acquireABI. It is not shared with other
+// expressions so that matching with the spare never waits for them.
+func acquireSpareABI() (*libre2ABI, error) {
+	return acquirePrivateABI(false)
+}
+
+// acquireInterruptibleABI is like acquireSpareABI but returns a module in which calls are
+// interrupted when their context is done, closing the module.
+func acquireInterruptibleABI() (*libre2ABI, error) {
+	return acquirePrivateABI(true)
+}
+
+func acquirePrivateABI(interruptible bool) (*libre2ABI, error) {
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	abi, err := newABI(interruptible)
+	if err != nil {
+		return nil, err
+	}
+	abi.refs++
+	abi.hosted++
+	return abi, nil
+}
+
+// acquireScratchABI returns the module for validating an expression, which is released
+// with unrefABI like one from acquireABI but reused by later validations instead of
+// counting towards regexpsPerModule.
+func acquireScratchABI() (*libre2ABI, error) {
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+
+	abi := modulePool.scratch
+	if abi == nil || abi.isDropped() {
+		var err error
+		if abi, err = newABI(false); err != nil {
+			return nil, err
+		}
+		// Keeps the module open when no validation is using it.
+		abi.refs++
+		modulePool.scratch = abi
+	}
+	abi.refs++
+	return abi, nil
+}
+
+// releaseScratchLocked releases the reference of the pool to the module for validating
+// expressions, which is closed once validations in progress finish with it. It must be
+// called with modulePool.mu held.
+func releaseScratchLocked() {
+	abi := modulePool.scratch
+	if abi == nil {
+		return
+	}
+	modulePool.scratch = nil
+	abi.refs--
+	if abi.refs > 0 || abi.isDropped() {
+		return
 	}
+	closeABILocked(abi)
+	_ = abi.mod.Close(context.Background())
+}
 
-	return abi
+// acquireUnsynchronizedABI is like acquireSpareABI but returns a module whose operations
+// are not synchronized, for an expression compiled with Options.Unsynchronized.
+func acquireUnsynchronizedABI() (*libre2ABI, error) {
+	abi, err := acquireSpareABI()
+	if err != nil {
+		return nil, err
+	}
+	abi.unsynchronized = true
+	return abi, nil
+}
+
+// unrefABI releases a reference acquired with acquireABI, closing the module when no
+// expressions remain in it.
+func unrefABI(abi *libre2ABI) error {
+	modulePool.mu.Lock()
+	abi.refs--
+	if abi.refs > 0 {
+		modulePool.mu.Unlock()
+		return nil
+	}
+	if abi.isDropped() {
+		modulePool.mu.Unlock()
+		return nil
+	}
+	closeABILocked(abi)
+	modulePool.mu.Unlock()
+
+	return abi.mod.Close(context.Background())
+}
+
+// dropABI closes a module after a call into it failed, e.g., trapped on a failed
+// allocation, which can leave the memory of re2 inconsistent. No further expressions are
+// compiled into it, and the ones in it fail when used until they are closed.
+func dropABI(abi *libre2ABI) {
+	modulePool.mu.Lock()
+	if abi.isDropped() {
+		modulePool.mu.Unlock()
+		return
+	}
+	atomic.StoreUint32(&abi.dropped, 1)
+	closeABILocked(abi)
+	modulePool.mu.Unlock()
+
+	_ = abi.mod.Close(context.Background())
+}
+
+func (abi *libre2ABI) isDropped() bool {
+	return atomic.LoadUint32(&abi.dropped) == 1
+}
+
+// closeABILocked removes a module about to be closed from the pool. It must be called with
+// modulePool.mu held.
+func closeABILocked(abi *libre2ABI) {
+	for i, open := range modulePool.open {
+		if open == abi {
+			modulePool.open[i] = nil
+		}
+	}
+	modulePool.live--
 }
 
 func (abi *libre2ABI) startOperation(memorySize int) {
-	abi.mu.Lock()
-	abi.memory.reserve(abi, uint32(memorySize))
+	if abi == nil {
+		panic(errClosed)
+	}
+	if !abi.unsynchronized {
+		abi.lock <- struct{}{}
+	}
+	if err := abi.started(memorySize); err != nil {
+		panic(err)
+	}
 }
 
+// tryStartOperation is like startOperation but returns false instead of waiting if
+// the module is in use, and an error if memory for the operation cannot be reserved.
+func (abi *libre2ABI) tryStartOperation(memorySize int) (bool, error) {
+	if abi == nil {
+		panic(errClosed)
+	}
+	if !abi.unsynchronized {
+		select {
+		case abi.lock <- struct{}{}:
+		default:
+			return false, nil
+		}
+	}
+	if err := abi.started(memorySize); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// startOperationContext is like startOperation but stops waiting for the module if
+// ctx is done first, returning its error.
+func (abi *libre2ABI) startOperationContext(ctx context.Context, memorySize int) error {
+	if abi == nil {
+		panic(errClosed)
+	}
+	if abi.unsynchronized {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	} else {
+		select {
+		case abi.lock <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return abi.started(memorySize)
+}
+
+// endOperation ends the operation started with one of the startOperation functions,
+// which callers defer so that it ends even if the operation panics. Ending an operation
+// that was not started panics rather than blocking forever.
 func (abi *libre2ABI) endOperation() {
-	abi.mu.Unlock()
+	if abi.unsynchronized {
+		return
+	}
+	select {
+	case <-abi.lock:
+	default:
+		panic("re2: endOperation called without an operation in progress")
+	}
+}
+
+// resetMemory frees the shared memory allocated so far in the current operation, for
+// operations that process several inputs in turn, each fitting in the reserved size.
+func (abi *libre2ABI) resetMemory() {
+	abi.memory.nextIdx = 0
+}
+
+// started checks that the module of an operation that was just started was not dropped
+// while waiting for it and reserves the memory for the operation, ending it on failure.
+func (abi *libre2ABI) started(memorySize int) error {
+	if abi.isDropped() {
+		abi.endOperation()
+		return errModuleDropped
+	}
+	return abi.reserve(memorySize)
 }
 
-func newRE(abi *libre2ABI, pattern cString, longest bool, posix bool, caseInsensitive bool) uintptr {
+// reserve reserves the shared memory for an operation that was just started, ending
+// the operation if the memory cannot be allocated.
+func (abi *libre2ABI) reserve(memorySize int) error {
+	if err := abi.memory.reserve(abi, uint32(memorySize)); err != nil {
+		abi.endOperation()
+		return err
+	}
+	return nil
+}
+
+// checkOptions returns an error if opts need a function that is not exported by the
+// embedded libcre2, i.e., it was built before support for the option was added and
+// needs to be rebuilt with mage updateLibs.
+func checkOptions(abi *libre2ABI, opts Options) error {
+	if opts.Latin1 && abi.cre2OptSetEncoding == nil {
+		return fmt.Errorf("re2: Latin1 is %w to export cre2_opt_set_encoding", errUnsupportedOption)
+	}
+	if opts.NeverNL && abi.cre2OptSetNeverNL == nil {
+		return fmt.Errorf("re2: NeverNL is %w to export cre2_opt_set_never_nl", errUnsupportedOption)
+	}
+	if opts.DotNL && abi.cre2OptSetDotNL == nil {
+		return fmt.Errorf("re2: DotNL is %w to export cre2_opt_set_dot_nl", errUnsupportedOption)
+	}
+	if opts.Literal && abi.cre2OptSetLiteral == nil {
+		return fmt.Errorf("re2: Literal is %w to export cre2_opt_set_literal", errUnsupportedOption)
+	}
+	if opts.NeverCapture && abi.cre2OptSetNeverCapture == nil {
+		return fmt.Errorf("re2: NeverCapture is %w to export cre2_opt_set_never_capture", errUnsupportedOption)
+	}
+	if opts.WordBoundary && abi.cre2OptSetWordBoundary == nil {
+		return fmt.Errorf("re2: WordBoundary is %w to export cre2_opt_set_word_boundary", errUnsupportedOption)
+	}
+	if opts.OneLine && abi.cre2OptSetOneLine == nil {
+		return fmt.Errorf("re2: OneLine is %w to export cre2_opt_set_one_line", errUnsupportedOption)
+	}
+	if opts.MaxProgramSize > 0 && abi.cre2ProgramSize == nil {
+		return fmt.Errorf("re2: MaxProgramSize is %w to export cre2_program_size", errUnsupportedOption)
+	}
+	return nil
+}
+
+func newRE(abi *libre2ABI, pattern cString, opts Options) uintptr {
+	optPtr := newOpt(abi, opts)
+	defer deleteOpt(abi, optPtr)
+	res, err := abi.cre2New.Call(context.Background(), uint64(pattern.ptr), uint64(pattern.length), uint64(optPtr))
+	if err != nil {
+		panic(callError(abi, err))
+	}
+	return uintptr(res[0])
+}
+
+// newOpt returns new options of re2 set from opts, to be deleted with deleteOpt.
+func newOpt(abi *libre2ABI, opts Options) uintptr {
 	ctx := context.Background()
 	res, err := abi.cre2OptNew.Call(ctx)
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 	optPtr := uintptr(res[0])
-	defer func() {
-		if _, err := abi.cre2OptDelete.Call(ctx, uint64(optPtr)); err != nil {
-			panic(err)
+	if !opts.LogErrors {
+		if _, err := abi.cre2OptSetLogErrors.Call(ctx, uint64(optPtr), 0); err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	if opts.MaxMem > 0 {
+		_, err = abi.cre2OptSetMaxMem.Call(ctx, uint64(optPtr), uint64(opts.MaxMem))
+		if err != nil {
+			panic(callError(abi, err))
 		}
-	}()
-	if _, err := abi.cre2OptSetLogErrors.Call(ctx, uint64(optPtr), 0); err != nil {
-		panic(err)
 	}
-	if longest {
+	// POSIX syntax always implies leftmost-longest semantics, as in the standard library.
+	if opts.Longest || opts.POSIX {
 		_, err = abi.cre2OptSetLongestMatch.Call(ctx, uint64(optPtr), 1)
 		if err != nil {
-			panic(err)
+			panic(callError(abi, err))
 		}
 	}
-	if posix {
+	if opts.POSIX {
 		_, err = abi.cre2OptSetPosixSyntax.Call(ctx, uint64(optPtr), 1)
 		if err != nil {
-			panic(err)
+			panic(callError(abi, err))
 		}
 	}
-	if caseInsensitive {
+	if opts.CaseInsensitive {
 		_, err = abi.cre2OptSetCaseSensitive.Call(ctx, uint64(optPtr), 0)
 		if err != nil {
-			panic(err)
+			panic(callError(abi, err))
 		}
 	}
-	res, err = abi.cre2New.Call(ctx, uint64(pattern.ptr), uint64(pattern.length), uint64(optPtr))
-	if err != nil {
-		panic(err)
+	if opts.Latin1 {
+		_, err = abi.cre2OptSetEncoding.Call(ctx, uint64(optPtr), encodingLatin1)
+		if err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	if opts.NeverNL {
+		_, err = abi.cre2OptSetNeverNL.Call(ctx, uint64(optPtr), 1)
+		if err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	if opts.DotNL {
+		_, err = abi.cre2OptSetDotNL.Call(ctx, uint64(optPtr), 1)
+		if err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	if opts.Literal {
+		_, err = abi.cre2OptSetLiteral.Call(ctx, uint64(optPtr), 1)
+		if err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	if opts.NeverCapture {
+		_, err = abi.cre2OptSetNeverCapture.Call(ctx, uint64(optPtr), 1)
+		if err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	if opts.WordBoundary {
+		_, err = abi.cre2OptSetWordBoundary.Call(ctx, uint64(optPtr), 1)
+		if err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	if opts.OneLine {
+		_, err = abi.cre2OptSetOneLine.Call(ctx, uint64(optPtr), 1)
+		if err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	return optPtr
+}
+
+func deleteOpt(abi *libre2ABI, optPtr uintptr) {
+	// The options went with the module if it failed compiling the expression.
+	if abi.isDropped() {
+		return
+	}
+	if _, err := abi.cre2OptDelete.Call(context.Background(), uint64(optPtr)); err != nil {
+		panic(callError(abi, err))
 	}
-	return uintptr(res[0])
 }
 
 func reError(abi *libre2ABI, rePtr uintptr) (int, string) {
 	ctx := context.Background()
 	res, err := abi.cre2ErrorCode.Call(ctx, uint64(rePtr))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 	code := int(res[0])
 	if code == 0 {
@@ -180,7 +826,7 @@ func reError(abi *libre2ABI, rePtr uintptr) (int, string) {
 	argPtr := newCStringArray(abi, 1)
 	_, err = abi.cre2ErrorArg.Call(ctx, uint64(rePtr), uint64(argPtr.ptr))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 	sPtr := binary.LittleEndian.Uint32(abi.memory.read(abi, argPtr.ptr, 4))
 	sLen := binary.LittleEndian.Uint32(abi.memory.read(abi, argPtr.ptr+4, 4))
@@ -192,53 +838,182 @@ func numCapturingGroups(abi *libre2ABI, rePtr uintptr) int {
 	ctx := context.Background()
 	res, err := abi.cre2NumCapturingGroups.Call(ctx, uint64(rePtr))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 	return int(res[0])
 }
 
+func programSize(abi *libre2ABI, rePtr uintptr) int {
+	if abi.cre2ProgramSize == nil {
+		return -1
+	}
+	ctx := context.Background()
+	res, err := abi.cre2ProgramSize.Call(ctx, uint64(rePtr))
+	if err != nil {
+		panic(callError(abi, err))
+	}
+	return int(int32(res[0]))
+}
+
 func deleteRE(abi *libre2ABI, rePtr uintptr) {
 	ctx := context.Background()
 	if _, err := abi.cre2Delete.Call(ctx, uint64(rePtr)); err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 }
 
-func release(re *Regexp) {
-	ctx := context.Background()
-	deleteRE(re.abi, re.ptr)
-	if err := re.abi.mod.Close(ctx); err != nil {
-		fmt.Printf("error closing wazero module: %v", err)
+// setSupported reports whether the embedded libcre2 exports the native set of re2, which
+// it does if built after support for sets was added, and otherwise needs to be
+// rebuilt with mage updateLibs.
+func setSupported(abi *libre2ABI) bool {
+	return abi.cre2SetNew != nil && abi.cre2SetDelete != nil && abi.cre2SetAdd != nil &&
+		abi.cre2SetCompile != nil && abi.cre2SetMatch != nil
+}
+
+func newSet(abi *libre2ABI, opts Options) uintptr {
+	optPtr := newOpt(abi, opts)
+	defer deleteOpt(abi, optPtr)
+	res, err := abi.cre2SetNew.Call(context.Background(), uint64(optPtr), uint64(Unanchored))
+	if err != nil {
+		panic(callError(abi, err))
 	}
+	return uintptr(res[0])
 }
 
-func match(re *Regexp, s cString, matchesPtr uintptr, nMatches uint32) bool {
-	ctx := context.Background()
-	res, err := re.abi.cre2Match.Call(ctx, uint64(re.ptr), uint64(s.ptr), uint64(s.length), 0, uint64(s.length), 0, uint64(matchesPtr), uint64(nMatches))
+func setAdd(abi *libre2ABI, setPtr uintptr, pattern cString) int {
+	res, err := abi.cre2SetAdd.Call(context.Background(), uint64(setPtr), uint64(pattern.ptr), uint64(pattern.length), 0, 0)
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
+	return int(int32(res[0]))
+}
 
+func setCompile(abi *libre2ABI, setPtr uintptr) bool {
+	res, err := abi.cre2SetCompile.Call(context.Background(), uint64(setPtr))
+	if err != nil {
+		panic(callError(abi, err))
+	}
 	return res[0] == 1
 }
 
+// setMatch returns the indexes of the patterns of the set with n patterns that match
+// text. It allocates 4*n bytes of shared memory for them.
+func setMatch(abi *libre2ABI, setPtr uintptr, text cString, n int) []int {
+	matchesPtr := abi.memory.allocate(uint32(n * 4))
+	res, err := abi.cre2SetMatch.Call(context.Background(), uint64(setPtr), uint64(text.ptr), uint64(text.length), uint64(matchesPtr), uint64(n))
+	if err != nil {
+		panic(callError(abi, err))
+	}
+	matched := int(uint32(res[0]))
+	if matched > n {
+		matched = n
+	}
+	buf := abi.memory.read(abi, matchesPtr, matched*4)
+	matches := make([]int, matched)
+	for i := range matches {
+		matches[i] = int(int32(binary.LittleEndian.Uint32(buf[i*4:])))
+	}
+	return matches
+}
+
+// releaseSet deletes a set created with newSet and releases its module, as release does
+// for an expression.
+func releaseSet(abi *libre2ABI, setPtr uintptr) error {
+	if abi.isDropped() {
+		return unrefABI(abi)
+	}
+
+	abi.startOperation(0)
+	defer abi.endOperation()
+
+	_, err := abi.cre2SetDelete.Call(context.Background(), uint64(setPtr))
+	var exitErr *sys.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		panic(callError(abi, err))
+	}
+
+	return unrefABI(abi)
+}
+
+func release(re *Regexp) error {
+	if re.abi.isDropped() {
+		// The expression went with the memory of the module.
+		return unrefABI(re.abi)
+	}
+
+	// Other expressions in the module may be in use concurrently.
+	re.abi.startOperation(0)
+	defer re.abi.endOperation()
+
+	// The module is already closed if the application closed a runtime configured with
+	// SetRuntime before its expressions were finalized, and there is nothing left to free.
+	_, err := re.abi.cre2Delete.Call(context.Background(), uint64(re.ptr))
+	var exitErr *sys.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		panic(callError(re.abi, err))
+	}
+
+	return unrefABI(re.abi)
+}
+
+// releaseABI releases abi after failing to use it, where the error of the failure is
+// the one to report rather than any closing the module.
+func releaseABI(abi *libre2ABI) {
+	_ = unrefABI(abi)
+}
+
+func match(re *Regexp, s cString, matchesPtr uintptr, nMatches uint32) bool {
+	return matchAnchored(re, s, 0, Unanchored, matchesPtr, nMatches)
+}
+
 func matchFrom(re *Regexp, s cString, startPos int, matchesPtr uintptr, nMatches uint32) bool {
+	return matchAnchored(re, s, startPos, Unanchored, matchesPtr, nMatches)
+}
+
+func matchAnchored(re *Regexp, s cString, startPos int, anchor Anchor, matchesPtr uintptr, nMatches uint32) bool {
 	ctx := context.Background()
-	res, err := re.abi.cre2Match.Call(ctx, uint64(re.ptr), uint64(s.ptr), uint64(s.length), uint64(startPos), uint64(s.length), 0, uint64(matchesPtr), uint64(nMatches))
+	res, err := re.abi.cre2Match.Call(ctx, uint64(re.ptr), uint64(s.ptr), uint64(s.length), uint64(startPos), uint64(s.length), uint64(anchor), uint64(matchesPtr), uint64(nMatches))
 	if err != nil {
-		panic(err)
+		panic(callError(re.abi, err))
 	}
 
 	return res[0] == 1
 }
 
+// matchContext is like match but interrupts the match when ctx is done, returning its
+// error, if re is in a module from acquireInterruptibleABI. The call is interrupted by
+// closing the module, which is dropped.
+func matchContext(ctx context.Context, re *Regexp, s cString) (bool, error) {
+	res, err := re.abi.cre2Match.Call(ctx, uint64(re.ptr), uint64(s.ptr), uint64(s.length), 0, uint64(s.length), uint64(Unanchored), 0, 0)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			dropABI(re.abi)
+			return false, ctxErr
+		}
+		panic(callError(re.abi, err))
+	}
+
+	return res[0] == 1, nil
+}
+
 func readMatch(abi *libre2ABI, cs cString, matchPtr uintptr, dstCap []int) []int {
 	matchBuf := abi.memory.read(abi, matchPtr, 8)
 	subStrPtr := uintptr(binary.LittleEndian.Uint32(matchBuf))
 	sLen := uintptr(binary.LittleEndian.Uint32(matchBuf[4:]))
-	sIdx := subStrPtr - cs.ptr
 
-	return append(dstCap, int(sIdx), int(sIdx+sLen))
+	start, end := matchOffsets(cs, subStrPtr, sLen)
+	return append(dstCap, start, end)
+}
+
+// matchOffsets returns the offsets in cs of a match of sLen bytes at subStrPtr, which re2
+// always places within the input.
+func matchOffsets(cs cString, subStrPtr uintptr, sLen uintptr) (int, int) {
+	if subStrPtr < cs.ptr || subStrPtr-cs.ptr+sLen > uintptr(cs.length) {
+		start := int64(subStrPtr) - int64(cs.ptr)
+		panic(fmt.Errorf("%w: [%d:%d] for input of %d bytes", ErrCorruptMatch, start, start+int64(sLen), cs.length))
+	}
+	sIdx := int(subStrPtr - cs.ptr)
+	return sIdx, sIdx + int(sLen)
 }
 
 func readMatches(abi *libre2ABI, cs cString, matchesPtr uintptr, n int, deliver func([]int)) {
@@ -252,34 +1027,41 @@ func readMatches(abi *libre2ABI, cs cString, matchesPtr uintptr, n int, deliver
 			continue
 		}
 		sLen := uintptr(binary.LittleEndian.Uint32(matchesBuf[8*i+4:]))
-		sIdx := subStrPtr - cs.ptr
-		deliver(append(dstCap[:0], int(sIdx), int(sIdx+sLen)))
+		start, end := matchOffsets(cs, subStrPtr, sLen)
+		deliver(append(dstCap[:0], start, end))
 	}
 }
 
-func namedGroupsIter(abi *libre2ABI, rePtr uintptr) uintptr {
+// namedGroupsIterator is an iterator over the named groups of an expression, with the
+// cells namedGroupsIterNext has it write the name and index of each group to.
+type namedGroupsIterator struct {
+	ptr     uintptr
+	scratch uintptr
+}
+
+// namedGroupsIter returns an iterator over the named groups of the expression, allocating
+// its cells from the shared memory of the operation in progress, which must have 8 bytes
+// left, so that iterating doesn't call malloc and free for each group.
+func namedGroupsIter(abi *libre2ABI, rePtr uintptr) namedGroupsIterator {
 	ctx := context.Background()
 
 	res, err := abi.cre2NamedGroupsIterNew.Call(ctx, uint64(rePtr))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 
-	return uintptr(res[0])
+	return namedGroupsIterator{ptr: uintptr(res[0]), scratch: abi.memory.allocate(8)}
 }
 
-func namedGroupsIterNext(abi *libre2ABI, iterPtr uintptr) (string, int, bool) {
+func namedGroupsIterNext(abi *libre2ABI, iter namedGroupsIterator) (string, int, bool) {
 	ctx := context.Background()
 
-	// Not on the hot path so don't bother optimizing this yet.
-	ptrs := malloc(abi, 8)
-	defer free(abi, ptrs)
-	namePtrPtr := ptrs
+	namePtrPtr := iter.scratch
 	indexPtr := namePtrPtr + 4
 
-	res, err := abi.cre2NamedGroupsIterNext.Call(ctx, uint64(iterPtr), uint64(namePtrPtr), uint64(indexPtr))
+	res, err := abi.cre2NamedGroupsIterNext.Call(ctx, uint64(iter.ptr), uint64(namePtrPtr), uint64(indexPtr))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 
 	if res[0] == 0 {
@@ -291,7 +1073,8 @@ func namedGroupsIterNext(abi *libre2ABI, iterPtr uintptr) (string, int, bool) {
 		panic(errFailedRead)
 	}
 
-	// C-string, read content until NULL.
+	// C-string, read content until NULL. Names of groups only consist of word
+	// characters, so unlike input and patterns they cannot contain NUL.
 	name := strings.Builder{}
 	for {
 		b, ok := abi.wasmMemory.ReadByte(namePtr)
@@ -313,12 +1096,12 @@ func namedGroupsIterNext(abi *libre2ABI, iterPtr uintptr) (string, int, bool) {
 	return name.String(), int(index), true
 }
 
-func namedGroupsIterDelete(abi *libre2ABI, iterPtr uintptr) {
+func namedGroupsIterDelete(abi *libre2ABI, iter namedGroupsIterator) {
 	ctx := context.Background()
 
-	_, err := abi.cre2NamedGroupsIterDelete.Call(ctx, uint64(iterPtr))
+	_, err := abi.cre2NamedGroupsIterDelete.Call(ctx, uint64(iter.ptr))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 }
 
@@ -327,11 +1110,11 @@ func globalReplace(re *Regexp, textAndTargetPtr uintptr, rewritePtr uintptr) ([]
 
 	res, err := re.abi.cre2GlobalReplace.Call(ctx, uint64(re.ptr), uint64(textAndTargetPtr), uint64(rewritePtr))
 	if err != nil {
-		panic(err)
+		panic(callError(re.abi, err))
 	}
 
 	if int64(res[0]) == -1 {
-		panic("out of memory")
+		panic(ErrOutOfMemory)
 	}
 
 	if res[0] == 0 {
@@ -360,6 +1143,22 @@ func globalReplace(re *Regexp, textAndTargetPtr uintptr, rewritePtr uintptr) ([]
 	return append([]byte{}, str...), true
 }
 
+// callError returns the error for a failed call into the module, reporting it as running
+// out of memory if the module's memory is at its limit, as re2 doesn't check allocations and
+// traps when one fails. The module is dropped as it cannot be used safely after the call.
+func callError(abi *libre2ABI, err error) error {
+	if abi.isDropped() {
+		return fmt.Errorf("%w: %v", errModuleDropped, err)
+	}
+	defer dropABI(abi)
+	// Max is the limit of the runtime even when the module doesn't declare one.
+	maxPages, _ := abi.wasmMemory.Definition().Max()
+	if uint64(abi.wasmMemory.Size())+wasmPageSize > uint64(maxPages)*wasmPageSize {
+		return fmt.Errorf("%w: %v", ErrOutOfMemory, err)
+	}
+	return err
+}
+
 type cString struct {
 	ptr    uintptr
 	length int
@@ -381,6 +1180,34 @@ func newCStringFromBytes(abi *libre2ABI, s []byte) cString {
 	}
 }
 
+// newSourceText copies b into memory of the module allocated apart from the shared
+// memory, where it stays until the module is closed or it is freed with freeSourceText,
+// for a Source, Replacer or ReplaceAllTo. It must be called within an operation.
+func newSourceText(abi *libre2ABI, b []byte) (cString, error) {
+	size := len(b)
+	if size == 0 {
+		// malloc may return a null pointer for zero bytes.
+		size = 1
+	}
+	res, err := abi.malloc.Call(context.Background(), uint64(size))
+	if err != nil {
+		panic(callError(abi, err))
+	}
+	if res[0] == 0 {
+		return cString{}, fmt.Errorf("%w: reserving %d bytes", ErrOutOfMemory, len(b))
+	}
+	if !abi.wasmMemory.Write(uint32(res[0]), b) {
+		panic(errFailedWrite)
+	}
+	return cString{ptr: uintptr(res[0]), length: len(b)}, nil
+}
+
+// freeSourceText frees text returned by newSourceText. It must be called within an
+// operation.
+func freeSourceText(abi *libre2ABI, text cString) {
+	free(abi, text.ptr)
+}
+
 func newCStringPtr(abi *libre2ABI, cs cString) pointer {
 	ptr := abi.memory.allocate(8)
 	if !abi.wasmMemory.WriteUint32Le(uint32(ptr), uint32(cs.ptr)) {
@@ -409,7 +1236,10 @@ type pointer struct {
 func malloc(abi *libre2ABI, size uint32) uintptr {
 	res, err := abi.malloc.Call(context.Background(), uint64(size))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
+	}
+	if res[0] == 0 {
+		panic(fmt.Errorf("%w: allocating %d bytes", ErrOutOfMemory, size))
 	}
 	return uintptr(res[0])
 }
@@ -417,37 +1247,91 @@ func malloc(abi *libre2ABI, size uint32) uintptr {
 func free(abi *libre2ABI, ptr uintptr) {
 	_, err := abi.free.Call(context.Background(), uint64(ptr))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
 	}
 }
 
+// sharedMemory is a buffer in the module that operations allocate their arguments from.
+// It grows in powers of two so that inputs of varying sizes rarely need a new buffer, and
+// is only shrunk after it has been mostly unused for a while, e.g., after a large one-off
+// input, so that such an input does not keep the memory reserved.
 type sharedMemory struct {
 	size    uint32
 	bufPtr  uint32
 	nextIdx uint32
+
+	// underused is the number of consecutive operations that used at most a quarter of
+	// a buffer larger than the minimum size.
+	underused int
 }
 
-func (m *sharedMemory) reserve(abi *libre2ABI, size uint32) {
+const (
+	// minSharedMemorySize is the smallest buffer reserved, enough for common expressions
+	// and inputs to never need another.
+	minSharedMemorySize = 1024
+
+	// sharedMemoryShrinkAfter is the number of underused operations after which the buffer
+	// is shrunk to the size needed.
+	sharedMemoryShrinkAfter = 64
+)
+
+func (m *sharedMemory) reserve(abi *libre2ABI, size uint32) error {
 	m.nextIdx = 0
 	if m.size >= size {
-		return
+		if m.size > minSharedMemorySize && size <= m.size/4 {
+			m.underused++
+		} else {
+			m.underused = 0
+		}
+		if m.underused < sharedMemoryShrinkAfter {
+			return nil
+		}
 	}
+	m.underused = 0
 
 	ctx := context.Background()
 	if m.bufPtr != 0 {
 		_, err := abi.free.Call(ctx, uint64(m.bufPtr))
 		if err != nil {
-			panic(err)
+			panic(callError(abi, err))
 		}
+		m.size = 0
+		m.bufPtr = 0
 	}
 
-	res, err := abi.malloc.Call(ctx, uint64(size))
+	bufSize := sharedMemorySize(size)
+	res, err := abi.malloc.Call(ctx, uint64(bufSize))
 	if err != nil {
-		panic(err)
+		panic(callError(abi, err))
+	}
+	if res[0] == 0 && bufSize > size {
+		// Near the memory limit, the exact size may still fit.
+		bufSize = size
+		res, err = abi.malloc.Call(ctx, uint64(bufSize))
+		if err != nil {
+			panic(callError(abi, err))
+		}
+	}
+	// malloc fails when memory cannot grow further, e.g., past SetMaxWasmMemoryPages.
+	if res[0] == 0 {
+		return fmt.Errorf("%w: reserving %d bytes", ErrOutOfMemory, size)
 	}
 
-	m.size = size
+	m.size = bufSize
 	m.bufPtr = uint32(res[0])
+	return nil
+}
+
+// sharedMemorySize returns the size of the buffer to reserve for an operation needing size
+// bytes, the next power of two of at least minSharedMemorySize.
+func sharedMemorySize(size uint32) uint32 {
+	if size <= minSharedMemorySize {
+		return minSharedMemorySize
+	}
+	if size > 1<<31 {
+		return size
+	}
+	return 1 << bits.Len32(size-1)
 }
 
 func (m *sharedMemory) allocate(size uint32) uintptr {
@@ -470,12 +1354,16 @@ func (m *sharedMemory) read(abi *libre2ABI, ptr uintptr, size int) []byte {
 
 func (m *sharedMemory) write(abi *libre2ABI, b []byte) uintptr {
 	ptr := m.allocate(uint32(len(b)))
-	abi.wasmMemory.Write(uint32(ptr), b)
+	if !abi.wasmMemory.Write(uint32(ptr), b) {
+		panic(errFailedWrite)
+	}
 	return ptr
 }
 
 func (m *sharedMemory) writeString(abi *libre2ABI, s string) uintptr {
 	ptr := m.allocate(uint32(len(s)))
-	abi.wasmMemory.WriteString(uint32(ptr), s)
+	if !abi.wasmMemory.WriteString(uint32(ptr), s) {
+		panic(errFailedWrite)
+	}
 	return ptr
 }
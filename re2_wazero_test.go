@@ -0,0 +1,1213 @@
+//go:build !tinygo.wasm && !re2_cgo
+
+package re2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+)
+
+func TestModulePool(t *testing.T) {
+	var res []*Regexp
+	defer func() {
+		for _, re := range res {
+			_ = re.Close()
+		}
+	}()
+
+	n := runtime.GOMAXPROCS(0) * (regexpsPerModule + 1)
+	modules := map[*libre2ABI]int{}
+	for i := 0; i < n; i++ {
+		re := MustCompile(`a+b`)
+		res = append(res, re)
+		modules[re.abi]++
+	}
+
+	for abi, count := range modules {
+		if count > regexpsPerModule {
+			t.Errorf("module hosts %d expressions; want at most %d", count, regexpsPerModule)
+		}
+		// Other expressions, e.g., package variables in tests, may share the modules too.
+		if abi.refs < count {
+			t.Errorf("module has %d references; want at least %d", abi.refs, count)
+		}
+	}
+	if len(modules) >= n/2 {
+		t.Errorf("%d expressions were compiled into %d modules; want them to share modules", n, len(modules))
+	}
+
+	// Expressions in a shared module remain usable as others are closed.
+	last := res[len(res)-1]
+	for _, re := range res[:len(res)-1] {
+		if err := re.Close(); err != nil {
+			t.Fatalf("Close: unexpected error: %v", err)
+		}
+	}
+	if !last.MatchString("aab") {
+		t.Errorf("%#q.MatchString(%q) = false; want true", `a+b`, "aab")
+	}
+
+	res = nil
+	if err := last.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+}
+
+func TestModulePoolCloseLast(t *testing.T) {
+	// A runtime of its own guarantees no other expressions share the module.
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	re1 := MustCompile(`a+b`)
+	// Modules are assigned round-robin, so keep compiling until one shares the module.
+	var re2 *Regexp
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		re := MustCompile(`c+d`)
+		if re.abi == re1.abi {
+			re2 = re
+			break
+		}
+		defer re.Close()
+	}
+	if re2 == nil {
+		t.Fatalf("no expression shares a module with the first")
+	}
+	abi := re1.abi
+	if abi.refs != 2 {
+		t.Errorf("module has %d references; want 2", abi.refs)
+	}
+
+	if err := re1.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if rt.Module(abi.mod.Name()) == nil {
+		t.Fatalf("module closed while an expression still uses it")
+	}
+	if !re2.MatchString("ccd") {
+		t.Errorf("%#q.MatchString(%q) = false; want true", `c+d`, "ccd")
+	}
+
+	if err := re2.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if rt.Module(abi.mod.Name()) != nil {
+		t.Errorf("module still open after closing the last expression using it")
+	}
+	for _, open := range modulePool.open {
+		if open == abi {
+			t.Errorf("closed module is still open for new expressions")
+		}
+	}
+}
+
+func TestSetRuntime(t *testing.T) {
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+
+	before := MustCompile(`a+b`)
+	defer before.Close()
+
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	re := MustCompile(`a+b`)
+	defer re.Close()
+	if rt.Module(re.abi.mod.Name()) == nil {
+		t.Errorf("expression compiled after SetRuntime is not in the configured runtime")
+	}
+	if !re.MatchString("aab") {
+		t.Errorf("%#q.MatchString(%q) = false; want true", `a+b`, "aab")
+	}
+
+	// Expressions compiled before keep working with the previous runtime.
+	if rt.Module(before.abi.mod.Name()) != nil {
+		t.Errorf("expression compiled before SetRuntime moved to the configured runtime")
+	}
+	if !before.MatchString("aab") {
+		t.Errorf("%#q.MatchString(%q) = false; want true", `a+b`, "aab")
+	}
+}
+
+func TestSetRuntimeConcurrent(t *testing.T) {
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	defer SetRuntime(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if i%2 == 0 {
+					SetRuntime(rt)
+				} else {
+					SetRuntime(nil)
+				}
+				re := MustCompile(`a+b`)
+				if !re.MatchString("aab") {
+					t.Errorf("%#q.MatchString(%q) = false; want true", `a+b`, "aab")
+				}
+				_ = re.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// resetDefaultRuntime makes the package behave as if no expression has been compiled yet,
+// restoring its state when the test completes.
+func resetDefaultRuntime(t *testing.T) {
+	t.Helper()
+
+	modulePool.mu.Lock()
+	rt, compiled := modulePool.rt, modulePool.compiled
+	defaultRT, defaultCompiled, defaultConfig := modulePool.defaultRT, modulePool.defaultCompiled, modulePool.defaultConfig
+	modulePool.rt, modulePool.compiled, modulePool.open = nil, nil, nil
+	modulePool.defaultRT, modulePool.defaultCompiled, modulePool.defaultConfig = nil, nil, nil
+	interruptibleRT, interruptibleCompiled := modulePool.interruptibleRT, modulePool.interruptibleCompiled
+	modulePool.interruptibleRT, modulePool.interruptibleCompiled = nil, nil
+	scratch := modulePool.scratch
+	modulePool.scratch = nil
+	modulePool.mu.Unlock()
+
+	t.Cleanup(func() {
+		modulePool.mu.Lock()
+		defer modulePool.mu.Unlock()
+		if modulePool.defaultRT != nil {
+			_ = modulePool.defaultRT.Close(context.Background())
+		}
+		if modulePool.interruptibleRT != nil {
+			_ = modulePool.interruptibleRT.Close(context.Background())
+		}
+		// Modules open before may have been closed meanwhile without being removed from
+		// open, which only holds the modules of the test, so new expressions get new ones.
+		modulePool.rt, modulePool.compiled, modulePool.open = rt, compiled, nil
+		modulePool.defaultRT, modulePool.defaultCompiled, modulePool.defaultConfig = defaultRT, defaultCompiled, defaultConfig
+		modulePool.interruptibleRT, modulePool.interruptibleCompiled = interruptibleRT, interruptibleCompiled
+		// The scratch module of the test went with its runtime.
+		modulePool.scratch = scratch
+	})
+}
+
+func TestSetCompilationCacheDir(t *testing.T) {
+	dir := t.TempDir()
+
+	cached := func() map[string]int64 {
+		files := map[string]int64{}
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				files[path] = info.ModTime().UnixNano()
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	compileWithCache := func(t *testing.T) {
+		resetDefaultRuntime(t)
+		if err := SetCompilationCacheDir(dir); err != nil {
+			t.Fatalf("SetCompilationCacheDir: unexpected error: %v", err)
+		}
+		re := MustCompile(`a+b`)
+		defer re.Close()
+		if !re.MatchString("aab") {
+			t.Errorf("%#q.MatchString(%q) = false; want true", `a+b`, "aab")
+		}
+	}
+
+	t.Run("first run", compileWithCache)
+	first := cached()
+	if len(first) == 0 {
+		t.Fatalf("no compiled module written to cache directory")
+	}
+
+	t.Run("second run", compileWithCache)
+	second := cached()
+	if len(second) != len(first) {
+		t.Errorf("cache has %d files after second run; want %d", len(second), len(first))
+	}
+	for path, mod := range first {
+		if second[path] != mod {
+			t.Errorf("cache file %s was rewritten instead of read", path)
+		}
+	}
+}
+
+func TestSetCompilationCacheDirErrors(t *testing.T) {
+	t.Run("not a directory", func(t *testing.T) {
+		resetDefaultRuntime(t)
+		file := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(file, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetCompilationCacheDir(file); err == nil {
+			t.Errorf("SetCompilationCacheDir(%q): expected error", file)
+		}
+		// Compilation still works without the cache.
+		if !MustCompile(`a+b`).MatchString("aab") {
+			t.Errorf("%#q.MatchString(%q) = false; want true", `a+b`, "aab")
+		}
+	})
+
+	t.Run("after first use", func(t *testing.T) {
+		resetDefaultRuntime(t)
+		MustCompile(`a+b`).Close()
+		if err := SetCompilationCacheDir(t.TempDir()); err == nil {
+			t.Errorf("SetCompilationCacheDir after compiling: expected error")
+		}
+	})
+}
+
+func TestWarmup(t *testing.T) {
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	if modulePool.compiled != nil {
+		t.Fatalf("module compiled before Warmup")
+	}
+	if err := Warmup(ctx); err != nil {
+		t.Fatalf("Warmup: unexpected error: %v", err)
+	}
+	compiled := modulePool.compiled
+	if compiled == nil {
+		t.Fatalf("module not compiled by Warmup")
+	}
+
+	if err := Warmup(ctx); err != nil {
+		t.Fatalf("second Warmup: unexpected error: %v", err)
+	}
+	re := MustCompile(`a+b`)
+	defer re.Close()
+	if modulePool.compiled != compiled {
+		t.Errorf("module compiled again after Warmup")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := Warmup(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Warmup with canceled context = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestReleaseAfterRuntimeClosed(t *testing.T) {
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	re := MustCompile(`a+b`)
+	if err := rt.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// As done by the finalizer, which must not panic.
+	re.release()
+}
+
+func TestFinalizerReleasesModules(t *testing.T) {
+	// A runtime of its own guarantees no other expressions share the modules.
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	names := map[string]struct{}{}
+	n := 2 * runtime.GOMAXPROCS(0) * regexpsPerModule
+	for i := 0; i < n; i++ {
+		re := MustCompile(`a+b`)
+		names[re.abi.mod.Name()] = struct{}{}
+		// Closing some explicitly must not release them again when collected.
+		if i%2 == 0 {
+			if err := re.Close(); err != nil {
+				t.Fatalf("Close: unexpected error: %v", err)
+			}
+		}
+	}
+
+	open := func() int {
+		count := 0
+		for name := range names {
+			if rt.Module(name) != nil {
+				count++
+			}
+		}
+		return count
+	}
+	// Finalizers run asynchronously after a collection, so allow a few.
+	for i := 0; i < 10 && open() > 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := open(); count > 0 {
+		t.Errorf("%d of %d modules still open after dropped expressions were collected", count, len(names))
+	}
+}
+
+func TestSetFinalizerReleasesModules(t *testing.T) {
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	names := map[string]struct{}{}
+	for i := 0; i < 2*regexpsPerModule; i++ {
+		s := NewSet(Options{})
+		if _, err := s.Add(`a+b`); err != nil {
+			t.Fatalf("Add: unexpected error: %v", err)
+		}
+		skipWithoutNativeSet(t, s)
+		names[s.abi.mod.Name()] = struct{}{}
+		// Closing some explicitly must not release them again when collected.
+		if i%2 == 0 {
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close: unexpected error: %v", err)
+			}
+		}
+	}
+
+	open := func() int {
+		count := 0
+		for name := range names {
+			if rt.Module(name) != nil {
+				count++
+			}
+		}
+		return count
+	}
+	for i := 0; i < 10 && open() > 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := open(); count > 0 {
+		t.Errorf("%d of %d modules still open after dropped sets were collected", count, len(names))
+	}
+}
+
+func TestUnmarshalTextReleasesModules(t *testing.T) {
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	// Expressions unmarshaled into fields can't have finalizers of their own.
+	type config struct {
+		n  int
+		re Regexp
+	}
+	names := map[string]struct{}{}
+	for i := 0; i < 2*regexpsPerModule; i++ {
+		cfg := &config{n: i}
+		if err := cfg.re.UnmarshalText([]byte(`a+b`)); err != nil {
+			t.Fatalf("UnmarshalText: unexpected error: %v", err)
+		}
+		names[cfg.re.abi.mod.Name()] = struct{}{}
+	}
+
+	open := func() int {
+		count := 0
+		for name := range names {
+			if rt.Module(name) != nil {
+				count++
+			}
+		}
+		return count
+	}
+	for i := 0; i < 10 && open() > 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := open(); count > 0 {
+		t.Errorf("%d of %d modules still open after unmarshaled expressions were collected", count, len(names))
+	}
+}
+
+func TestSpares(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	re := MustCompile(`(\w+)@(\w+)\.com`)
+	defer re.Close()
+
+	// Hold the primary instance so that matches must use spares. With no more goroutines
+	// than spares allowed, each always finds a spare rather than waiting for the primary.
+	re.abi.startOperation(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if got, want := re.FindStringSubmatch("mail foo@bar.com now"), []string{"foo@bar.com", "foo", "bar"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("FindStringSubmatch = %q; want %q", got, want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	re.abi.endOperation()
+
+	re.spares.mu.Lock()
+	n := len(re.spares.instances)
+	re.spares.mu.Unlock()
+	if n == 0 || n > 3 {
+		t.Errorf("%d spares created; want between 1 and GOMAXPROCS-1 = 3", n)
+	}
+	for _, spare := range re.spares.instances {
+		if spare.abi == re.abi {
+			t.Errorf("spare compiled into the same module as the primary instance")
+		}
+	}
+
+	// Longest recompiles the expression, dropping spares compiled without it.
+	re.Longest()
+	if len(re.spares.instances) != 0 {
+		t.Errorf("%d spares after Longest; want 0", len(re.spares.instances))
+	}
+}
+
+func TestUnsynchronized(t *testing.T) {
+	const pattern, text = `(\w+)@(\w+)\.com`, "user@example.com, other@example.org and ab@cd.com"
+
+	re, err := CompileWith(pattern, Options{Unsynchronized: true})
+	if err != nil {
+		t.Fatalf("CompileWith: unexpected error: %v", err)
+	}
+	defer re.Close()
+	modulePool.mu.Lock()
+	for _, open := range modulePool.open {
+		if open == re.abi {
+			t.Errorf("unsynchronized expression shares a module with other expressions")
+		}
+	}
+	modulePool.mu.Unlock()
+
+	// An operation in progress doesn't block another, which would deadlock if locked.
+	re.abi.startOperation(0)
+	matched := re.MatchString(text)
+	re.abi.endOperation()
+	if !matched {
+		t.Errorf("MatchString(%q) = false; want true", text)
+	}
+
+	synced := MustCompile(pattern)
+	defer synced.Close()
+	for i := 0; i < 1000; i++ {
+		if got, want := re.FindAllStringSubmatch(text, -1), synced.FindAllStringSubmatch(text, -1); !reflect.DeepEqual(got, want) {
+			t.Fatalf("FindAllStringSubmatch(%q) = %q; want %q", text, got, want)
+		}
+	}
+	if n := len(re.spares.instances); n != 0 {
+		t.Errorf("unsynchronized expression has %d spares", n)
+	}
+
+	// Matching with a context compiles an instance in a module of its own only once.
+	var before uint64
+	for i := 0; i < 3; i++ {
+		if matched, err := re.MatchStringContext(context.Background(), text); err != nil || !matched {
+			t.Fatalf("MatchStringContext(%q) = %v, %v; want true, nil", text, matched, err)
+		}
+		if i == 0 {
+			before = atomic.LoadUint64(&moduleIdx)
+		}
+	}
+	if created := atomic.LoadUint64(&moduleIdx) - before; created != 0 {
+		t.Errorf("MatchStringContext instantiated %d modules after the first call; want 0", created)
+	}
+}
+
+func TestSynchronizedConcurrent(t *testing.T) {
+	// Run with -race, the synchronized default must stay safe to use from many goroutines,
+	// including when they share a module.
+	const text = "user@example.com, other@example.org and ab@cd.com"
+	re := MustCompile(`(\w+)@(\w+)\.com`)
+	defer re.Close()
+	other := MustCompile(`\w+`)
+	defer other.Close()
+	want := re.FindAllStringSubmatch(text, -1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := re.FindAllStringSubmatch(text, -1); !reflect.DeepEqual(got, want) {
+					t.Errorf("FindAllStringSubmatch(%q) = %q; want %q", text, got, want)
+					return
+				}
+				other.MatchString(text)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSparesParallelism(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	for _, parallelism := range []int{1, 2} {
+		t.Run(strconv.Itoa(parallelism), func(t *testing.T) {
+			re, err := CompileWith(`a+b`, Options{Parallelism: parallelism})
+			if err != nil {
+				t.Fatalf("CompileWith: unexpected error: %v", err)
+			}
+			defer re.Close()
+
+			re.abi.startOperation(0)
+			done := make(chan bool)
+			go func() {
+				done <- re.MatchString("aab")
+			}()
+
+			if parallelism == 1 {
+				// Without spares, the match waits for the primary instance.
+				select {
+				case <-done:
+					t.Fatalf("match completed while the only instance is busy")
+				case <-time.After(50 * time.Millisecond):
+				}
+				re.abi.endOperation()
+				if !<-done {
+					t.Errorf("MatchString = false; want true")
+				}
+			} else {
+				if !<-done {
+					t.Errorf("MatchString = false; want true")
+				}
+				re.abi.endOperation()
+			}
+
+			re.spares.mu.Lock()
+			defer re.spares.mu.Unlock()
+			if n := len(re.spares.instances); n != parallelism-1 {
+				t.Errorf("%d spares created; want Parallelism-1 = %d", n, parallelism-1)
+			}
+		})
+	}
+}
+
+type panickingWriter struct{}
+
+func (panickingWriter) Write([]byte) (int, error) {
+	panic("write panicked")
+}
+
+func TestOperationEndsOnPanic(t *testing.T) {
+	re := MustCompile(`a+`)
+	defer re.Close()
+
+	mustPanic := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: expected panic", name)
+			}
+		}()
+		f()
+	}
+	// A panic in user code called during an operation, and one from a failed read of
+	// the module's memory.
+	mustPanic("ReplaceAllTo", func() {
+		_, _ = re.ReplaceAllTo(panickingWriter{}, []byte("xaax"), []byte("b"))
+	})
+	mustPanic("read", func() {
+		inst := re.startOperation(0)
+		defer inst.endOperation()
+		inst.abi.memory.read(inst.abi, 1<<31, 8)
+	})
+
+	done := make(chan bool)
+	go func() {
+		done <- re.MatchString("xaax")
+	}()
+	select {
+	case matched := <-done:
+		if !matched {
+			t.Errorf("MatchString after panics = false; want true")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("MatchString after panics deadlocked")
+	}
+
+	mustPanic("endOperation", re.endOperation)
+}
+
+func TestMatchFunctionCloses(t *testing.T) {
+	// A runtime of its own guarantees no other expressions keep modules open.
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	tests := []struct {
+		name  string
+		match func(pattern string) (bool, error)
+	}{
+		{"MatchString", func(pattern string) (bool, error) { return MatchString(pattern, "aab") }},
+		{"Match", func(pattern string) (bool, error) { return Match(pattern, []byte("aab")) }},
+		{"MatchReader", func(pattern string) (bool, error) { return MatchReader(pattern, strings.NewReader("aab")) }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if matched, err := tc.match(`a+b`); !matched || err != nil {
+				t.Errorf("%s(%#q) = %t, %v; want true, nil", tc.name, `a+b`, matched, err)
+			}
+			if _, err := tc.match(`a+(`); err == nil {
+				t.Errorf("%s(%#q): expected error", tc.name, `a+(`)
+			}
+
+			modulePool.mu.Lock()
+			defer modulePool.mu.Unlock()
+			for _, open := range modulePool.open {
+				if open != nil {
+					t.Errorf("module with %d references still open after %s", open.refs, tc.name)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileBatchSharesModules(t *testing.T) {
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+	// Compiling one by one would spread the expressions over a module per CPU.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	patterns := make([]string, 2*regexpsPerModule+1)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf(`a+%d`, i)
+	}
+	before := atomic.LoadUint64(&moduleIdx)
+	res, err := CompileBatch(patterns, Options{})
+	if err != nil {
+		t.Fatalf("CompileBatch: unexpected error: %v", err)
+	}
+	if created := atomic.LoadUint64(&moduleIdx) - before; created != 3 {
+		t.Errorf("CompileBatch of %d patterns instantiated %d modules; want 3", len(patterns), created)
+	}
+	for i, re := range res {
+		if want := res[i/regexpsPerModule*regexpsPerModule].abi; re.abi != want {
+			t.Errorf("expression %d not compiled into the module of expression %d", i, i/regexpsPerModule*regexpsPerModule)
+		}
+		if s := fmt.Sprintf("aa%d", i); !re.MatchString(s) {
+			t.Errorf("%#q.MatchString(%q) = false; want true", re, s)
+		}
+	}
+	for _, re := range res {
+		if err := re.Close(); err != nil {
+			t.Fatalf("Close: unexpected error: %v", err)
+		}
+	}
+}
+
+func TestValidCloses(t *testing.T) {
+	// A runtime of its own guarantees no other expressions keep modules open.
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	for i := 0; i < 2*regexpsPerModule; i++ {
+		if err := Valid(`a+b`); err != nil {
+			t.Fatalf("Valid(%#q) = %v; want nil", `a+b`, err)
+		}
+		if err := Valid(`a+(`); err == nil {
+			t.Fatalf("Valid(%#q): expected error", `a+(`)
+		}
+	}
+
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+	for _, open := range modulePool.open {
+		if open != nil {
+			t.Errorf("module with %d references still open after Valid", open.refs)
+		}
+	}
+}
+
+func TestValidReusesModule(t *testing.T) {
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	if err := Valid(`a+b`); err != nil {
+		t.Fatalf("Valid(%#q) = %v; want nil", `a+b`, err)
+	}
+	modulePool.mu.Lock()
+	live := modulePool.live
+	modulePool.mu.Unlock()
+
+	for i := 0; i < 1000; i++ {
+		if err := Valid(`a+b`); err != nil {
+			t.Fatalf("Valid(%#q) = %v; want nil", `a+b`, err)
+		}
+		if err := Valid(`a+(`); err == nil {
+			t.Fatalf("Valid(%#q): expected error", `a+(`)
+		}
+	}
+
+	modulePool.mu.Lock()
+	defer modulePool.mu.Unlock()
+	if modulePool.live != live {
+		t.Errorf("%d modules live after 1000 calls to Valid; want %d", modulePool.live, live)
+	}
+	if hosted := modulePool.scratch.hosted; hosted != 0 {
+		t.Errorf("module of Valid hosts %d expressions; want 0", hosted)
+	}
+}
+
+func TestLogErrors(t *testing.T) {
+	for _, logErrors := range []bool{false, true} {
+		t.Run(strconv.FormatBool(logErrors), func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			// Modules write to the os.Stderr they are instantiated with, and an
+			// unsynchronized expression is always compiled into a new one.
+			stderr := os.Stderr
+			os.Stderr = w
+			_, err = CompileWith(`a(`, Options{LogErrors: logErrors, Unsynchronized: true})
+			os.Stderr = stderr
+			w.Close()
+
+			if !errors.Is(err, ErrMissingParen) {
+				t.Errorf("CompileWith(%#q): err = %v; want %v", `a(`, err, ErrMissingParen)
+			}
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if logErrors && len(out) == 0 {
+				t.Errorf("nothing written to stderr with LogErrors")
+			}
+			if !logErrors && len(out) != 0 {
+				t.Errorf("written to stderr without LogErrors: %q", out)
+			}
+		})
+	}
+}
+
+func TestSetMaxModules(t *testing.T) {
+	// Allow spares, which are only compiled with GOMAXPROCS above 1.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	// A runtime of its own guarantees no open modules have room for new expressions.
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	SetRuntime(rt)
+	defer SetRuntime(nil)
+
+	modulePool.mu.Lock()
+	live := modulePool.live
+	modulePool.mu.Unlock()
+	SetMaxModules(live + 2)
+	defer SetMaxModules(0)
+
+	// The first two are compiled into modules of their own, assigned round-robin, and the
+	// others into one of them at the limit.
+	shared := make([]*Regexp, 4)
+	for i := range shared {
+		shared[i] = MustCompile(`a+b`)
+		defer shared[i].Close()
+	}
+	if shared[0].abi == shared[1].abi {
+		t.Fatalf("expressions compiled into the same module below the limit")
+	}
+	if _, err := CompileWith(`a+b`, Options{Unsynchronized: true}); !errors.Is(err, ErrTooManyModules) {
+		t.Errorf("CompileWith at the limit: err = %v; want %v", err, ErrTooManyModules)
+	}
+
+	// Busy expressions can't have spares at the limit, so matching waits for them.
+	shared[0].abi.startOperation(0)
+	done := make(chan bool)
+	go func() {
+		done <- shared[0].MatchString("aab")
+	}()
+	select {
+	case <-done:
+		t.Fatalf("match completed while the expression is busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+	shared[0].abi.endOperation()
+	if !<-done {
+		t.Errorf("MatchString = false; want true")
+	}
+
+	// Closing all the expressions of a module frees its slot.
+	for _, re := range shared {
+		if re.abi == shared[1].abi && re != shared[1] {
+			re.Close()
+		}
+	}
+	shared[1].Close()
+	re, err := CompileWith(`a+b`, Options{Unsynchronized: true})
+	if err != nil {
+		t.Fatalf("CompileWith after closing a module: unexpected error: %v", err)
+	}
+	defer re.Close()
+
+	// Copying needs a module of its own too, which isn't available at the limit again.
+	func() {
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrTooManyModules) {
+				t.Errorf("Copy at the limit: panic = %v; want %v", err, ErrTooManyModules)
+			}
+		}()
+		re.Copy()
+	}()
+}
+
+func TestCompileCachedCoalesces(t *testing.T) {
+	defer ClearCache()
+	// Let the calls overlap even with a single CPU.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	// Without any module open, the first compilation instantiates one and others would
+	// instantiate more as they are spread over GOMAXPROCS modules.
+	resetDefaultRuntime(t)
+	opts := Options{}
+	before := atomic.LoadUint64(&moduleIdx)
+	const n = 100
+	res := make([]*Regexp, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			re, err := CompileCached(`coalesce+d`, opts)
+			if err != nil {
+				t.Errorf("CompileCached: unexpected error: %v", err)
+				return
+			}
+			res[i] = re
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if created := atomic.LoadUint64(&moduleIdx) - before; created != 1 {
+		t.Errorf("concurrent CompileCached instantiated %d modules; want 1", created)
+	}
+	for i := 1; i < n; i++ {
+		if res[i] != res[0] {
+			t.Fatalf("concurrent CompileCached returned different Regexps")
+		}
+	}
+}
+
+func TestMatchStringTimeoutInterrupts(t *testing.T) {
+	// Matching this takes far longer than the timeout.
+	long := strings.Repeat("a", 16<<20)
+
+	t.Run("shared", func(t *testing.T) {
+		re := MustCompile(`(a+)+\d{13}x`)
+		defer re.Close()
+
+		if _, err := re.MatchStringTimeout(long, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("MatchStringTimeout of %d bytes: err = %v; want %v", len(long), err, context.DeadlineExceeded)
+		}
+		interrupted := re.spares.interruptible
+		if !interrupted.abi.isDropped() {
+			t.Errorf("module of the timed out match still open")
+		}
+		if re.abi.isDropped() {
+			t.Errorf("module of the Regexp closed by the timed out match")
+		}
+
+		matched, err := re.MatchStringTimeout("aaa1234567890123x", time.Minute)
+		if !matched || err != nil {
+			t.Errorf("MatchStringTimeout after timed out match = %t, %v; want true, nil", matched, err)
+		}
+		if re.spares.interruptible == interrupted {
+			t.Errorf("MatchStringTimeout after timed out match used the interrupted instance")
+		}
+	})
+
+	t.Run("unsynchronized", func(t *testing.T) {
+		re := MustCompileWith(`(a+)+\d{13}x`, Options{Unsynchronized: true})
+		defer re.Close()
+
+		if _, err := re.MatchStringTimeout(long, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("MatchStringTimeout of %d bytes: err = %v; want %v", len(long), err, context.DeadlineExceeded)
+		}
+		if re.abi.isDropped() {
+			t.Errorf("module of the Regexp closed by the timed out match")
+		}
+		if !re.MatchString("aaa1234567890123x") {
+			t.Errorf("MatchString after timed out match = false; want true")
+		}
+	})
+}
+
+func TestSetMaxWasmMemoryPages(t *testing.T) {
+	const pages = 40
+	resetDefaultRuntime(t)
+	if err := SetMaxWasmMemoryPages(pages); err != nil {
+		t.Fatalf("SetMaxWasmMemoryPages: unexpected error: %v", err)
+	}
+
+	re := MustCompile(`(\w+)@(\w+)\.com`)
+	defer re.Close()
+	large := strings.Repeat("a", pages*65536)
+
+	if _, err := re.MatchStringContext(context.Background(), large); !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("MatchStringContext over the limit: got error %v; want %v", err, ErrOutOfMemory)
+	}
+	if _, err := MatchString(`a+b`, large); !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("MatchString over the limit: got error %v; want %v", err, ErrOutOfMemory)
+	}
+	func() {
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrOutOfMemory) {
+				t.Errorf("Regexp.MatchString over the limit: got panic %v; want %v", err, ErrOutOfMemory)
+			}
+		}()
+		re.MatchString(large)
+	}()
+	if size := re.abi.wasmMemory.Size(); size > pages*65536 {
+		t.Errorf("module memory grew to %d bytes; want at most %d", size, pages*65536)
+	}
+
+	// Matching within the limit still works.
+	if matched, err := re.MatchStringContext(context.Background(), "mail foo@bar.com now"); !matched || err != nil {
+		t.Errorf("MatchStringContext = %t, %v; want true, nil", matched, err)
+	}
+}
+
+func TestTryReplaceAllOutOfMemory(t *testing.T) {
+	const pages = 40
+	resetDefaultRuntime(t)
+	if err := SetMaxWasmMemoryPages(pages); err != nil {
+		t.Fatalf("SetMaxWasmMemoryPages: unexpected error: %v", err)
+	}
+
+	re := MustCompile(`a`)
+	defer re.Close()
+
+	large := strings.Repeat("a", pages*65536)
+	if _, err := re.TryReplaceAllString(large, "b"); !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("TryReplaceAllString over the limit: got error %v; want %v", err, ErrOutOfMemory)
+	}
+	if _, err := re.TryReplaceAll([]byte(large), []byte("b")); !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("TryReplaceAll over the limit: got error %v; want %v", err, ErrOutOfMemory)
+	}
+
+	// The input fits but replacing grows it past the limit, which re2 would fail on.
+	src := strings.Repeat("xa", pages*65536/32)
+	want := strings.Repeat("x"+strings.Repeat("b", 64), pages*65536/32)
+	if got, err := re.TryReplaceAllString(src, strings.Repeat("b", 64)); got != want || err != nil {
+		t.Errorf("TryReplaceAllString growing past the limit = %d bytes, %v; want %d bytes, nil", len(got), err, len(want))
+	}
+	if got, err := re.TryReplaceAll([]byte(src), []byte(strings.Repeat("${0}", 32)+strings.Repeat("b", 32))); len(got) != len(want) || err != nil {
+		t.Errorf("TryReplaceAll growing past the limit = %d bytes, %v; want %d bytes, nil", len(got), err, len(want))
+	}
+
+	// The module remains usable.
+	if got, want := re.ReplaceAllString("xax", "b"), "xbx"; got != want {
+		t.Errorf("ReplaceAllString = %q; want %q", got, want)
+	}
+}
+
+func TestTrapDropsModule(t *testing.T) {
+	const pages = 40
+	resetDefaultRuntime(t)
+	if err := SetMaxWasmMemoryPages(pages); err != nil {
+		t.Fatalf("SetMaxWasmMemoryPages: unexpected error: %v", err)
+	}
+
+	re := MustCompile(`a`)
+	defer re.Close()
+	modulePool.mu.Lock()
+	live := modulePool.live
+	modulePool.mu.Unlock()
+
+	// re2 traps when compiling the expression exhausts the memory of the module.
+	if _, err := Compile(strings.Repeat(`(ab)|`, 60000) + "c"); !errors.Is(err, ErrOutOfMemory) {
+		t.Fatalf("Compile over the limit: got error %v; want %v", err, ErrOutOfMemory)
+	}
+	if size := re.abi.wasmMemory.Size(); size > pages*65536 {
+		t.Errorf("module memory grew to %d bytes; want at most %d", size, pages*65536)
+	}
+	modulePool.mu.Lock()
+	if !re.abi.isDropped() || modulePool.live != live-1 {
+		t.Errorf("module of the failed call: dropped = %t with %d live modules; want true with %d", re.abi.isDropped(), modulePool.live, live-1)
+	}
+	modulePool.mu.Unlock()
+
+	// Expressions in the dropped module fail rather than use its memory, while new ones
+	// get a new module.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("MatchString in a dropped module: expected panic")
+			}
+		}()
+		re.MatchString("a")
+	}()
+	re2 := MustCompile(`a`)
+	defer re2.Close()
+	if re2.abi == re.abi {
+		t.Errorf("Compile after dropping a module used the dropped module")
+	}
+	if !re2.MatchString("a") {
+		t.Errorf("MatchString in a new module = false; want true")
+	}
+}
+
+func TestSetMaxWasmMemoryPagesErrors(t *testing.T) {
+	t.Run("too large", func(t *testing.T) {
+		resetDefaultRuntime(t)
+		if err := SetMaxWasmMemoryPages(65537); err == nil {
+			t.Errorf("SetMaxWasmMemoryPages(65537): expected error")
+		}
+	})
+
+	t.Run("after first use", func(t *testing.T) {
+		resetDefaultRuntime(t)
+		MustCompile(`a+b`).Close()
+		if err := SetMaxWasmMemoryPages(100); err == nil {
+			t.Errorf("SetMaxWasmMemoryPages after compiling: expected error")
+		}
+	})
+
+	t.Run("below module minimum", func(t *testing.T) {
+		resetDefaultRuntime(t)
+		if err := SetMaxWasmMemoryPages(1); err != nil {
+			t.Fatalf("SetMaxWasmMemoryPages: unexpected error: %v", err)
+		}
+		if _, err := Compile(`a+b`); err == nil {
+			t.Errorf("Compile with a limit below the module's memory: expected error")
+		}
+	})
+}
+
+func TestSharedMemoryReserve(t *testing.T) {
+	re := MustCompile(`a+b`)
+	defer re.Close()
+	abi := re.abi
+	abi.startOperation(0)
+	defer abi.endOperation()
+	m := &abi.memory
+
+	reserve := func(size uint32) {
+		t.Helper()
+		if err := m.reserve(abi, size); err != nil {
+			t.Fatalf("reserve(%d): unexpected error: %v", size, err)
+		}
+		if m.size < size {
+			t.Fatalf("reserve(%d) reserved %d bytes", size, m.size)
+		}
+	}
+
+	// Varying sizes only reallocate when growing past the next power of two.
+	reallocs := 0
+	for _, size := range []uint32{10, 900, 1500, 1100, 3000, 2100, 4096, 200, 4000, 5000} {
+		prev := m.bufPtr
+		reserve(size)
+		if m.bufPtr != prev {
+			reallocs++
+		}
+	}
+	if m.size != 8192 {
+		t.Errorf("buffer of %d bytes after reserving up to 5000; want 8192", m.size)
+	}
+	if reallocs > 5 {
+		t.Errorf("%d reallocations; want at most 5", reallocs)
+	}
+
+	// A large one-off input is reclaimed after enough small operations.
+	reserve(1 << 20)
+	for i := 0; i < sharedMemoryShrinkAfter; i++ {
+		reserve(100)
+	}
+	if m.size != minSharedMemorySize {
+		t.Errorf("buffer of %d bytes after small operations; want %d", m.size, minSharedMemorySize)
+	}
+
+	// Allocations never go past the reserved buffer.
+	reserve(3000)
+	m.allocate(m.size - 8)
+	m.allocate(8)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("allocate past the reserved buffer did not panic")
+		}
+	}()
+	m.allocate(1)
+}
+
+func TestReadMatchOutsideInput(t *testing.T) {
+	re := MustCompile(`a+b`)
+	defer re.Close()
+	abi := re.abi
+	abi.startOperation(64)
+	defer abi.endOperation()
+
+	cs := newCString(abi, "xaab")
+	matchArr := newCStringArray(abi, 1)
+	for _, bad := range []cString{
+		{ptr: cs.ptr - 1, length: 2},
+		{ptr: cs.ptr + 2, length: 3},
+		{ptr: 3070285412, length: 1},
+	} {
+		ptr := newCStringPtr(abi, bad)
+		match := abi.memory.read(abi, ptr.ptr, 8)
+		abi.wasmMemory.Write(uint32(matchArr.ptr), match)
+
+		var err error
+		func() {
+			defer recoverWasmError(&err)
+			readMatch(abi, cs, matchArr.ptr, nil)
+		}()
+		start := int(bad.ptr) - int(cs.ptr)
+		if !errors.Is(err, ErrCorruptMatch) {
+			t.Errorf("readMatch of %d bytes at offset %d: got error %v; want %v", bad.length, start, err, ErrCorruptMatch)
+		} else if pair := fmt.Sprintf("[%d:%d]", start, start+bad.length); !strings.Contains(err.Error(), pair) {
+			t.Errorf("readMatch of %d bytes at offset %d: error %q does not name the match %s", bad.length, start, err, pair)
+		}
+	}
+}
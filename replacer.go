@@ -0,0 +1,76 @@
+package re2
+
+import "runtime"
+
+// Replacer replaces matches of a Regexp with a single template in many texts, e.g., a
+// stream of documents, without preparing the template for each of them as
+// Regexp.ReplaceAllString does. It holds an instance of the expression in a module of its
+// own, like a Matcher, with the template converted to the syntax of re2 and copied into
+// its memory once.
+//
+// A Replacer can be used by multiple goroutines simultaneously, though their
+// replacements wait for each other, and must be closed with Close when no longer
+// needed, though its resources are also released when it is garbage collected.
+type Replacer struct {
+	re   *Regexp
+	repl string
+	// rewrite is the template in the memory of the module, unless it refers to a group
+	// re2 cannot and is expanded in Go instead.
+	rewrite   cString
+	converted bool
+	// b keeps the converted template alive when it is used in place.
+	b []byte
+}
+
+// Replacer returns a new Replacer of matches of the expression with repl, expanded as
+// with ReplaceAllString, returning an error if it cannot be compiled into a module of its
+// own.
+func (re *Regexp) Replacer(repl string) (*Replacer, error) {
+	inst, err := re.newPrivateInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replacer{re: inst, repl: repl}
+	replRE2, ok := convertReplacement(repl, inst.subexpNames)
+	if !ok {
+		return r, nil
+	}
+	inst.abi.startOperation(0)
+	r.rewrite, err = newSourceText(inst.abi, replRE2)
+	inst.abi.endOperation()
+	if err != nil {
+		_ = inst.Close()
+		return nil, err
+	}
+	r.converted, r.b = true, replRE2
+	return r, nil
+}
+
+// ReplaceAll returns a copy of src, replacing matches of the expression with the
+// template of the Replacer, as Regexp.ReplaceAllString.
+func (r *Replacer) ReplaceAll(src string) string {
+	if !r.converted {
+		return r.re.ReplaceAllString(src, r.repl)
+	}
+
+	re := r.re
+	re.abi.startOperation(len(src) + 16)
+	defer re.endOperation()
+
+	srcCS := newCString(re.abi, src)
+	srcCSPtr := newCStringPtr(re.abi, srcCS)
+	replCSPtr := newCStringPtr(re.abi, r.rewrite)
+
+	res, matched := globalReplace(re, srcCSPtr.ptr, replCSPtr.ptr)
+	runtime.KeepAlive(r.b)
+	if !matched {
+		return src
+	}
+	return string(res)
+}
+
+// Close releases the module of the Replacer. Using the Replacer after Close panics.
+func (r *Replacer) Close() error {
+	return r.re.Close()
+}
@@ -0,0 +1,57 @@
+package re2
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplacer(t *testing.T) {
+	for _, tc := range replaceTests {
+		re := MustCompile(tc.pattern)
+		r, err := re.Replacer(tc.replacement)
+		if err != nil {
+			t.Fatalf("Replacer(%q): unexpected error: %v", tc.replacement, err)
+		}
+		// Reusing the Replacer gives the same result each time.
+		for i := 0; i < 2; i++ {
+			if got := r.ReplaceAll(tc.input); got != tc.output {
+				t.Errorf("%#q.Replacer(%q).ReplaceAll(%q) = %q; want %q", tc.pattern, tc.replacement, tc.input, got, tc.output)
+			}
+		}
+		r.Close()
+		re.Close()
+	}
+
+	// re2 cannot refer to the tenth group, which is expanded in Go instead.
+	re := MustCompile(strings.Repeat(`(\w)`, 10))
+	defer re.Close()
+	r, err := re.Replacer("$10$1")
+	if err != nil {
+		t.Fatalf("Replacer: unexpected error: %v", err)
+	}
+	defer r.Close()
+	if got, want := r.ReplaceAll("-abcdefghij-"), "-ja-"; got != want {
+		t.Errorf("ReplaceAll with $10 = %q; want %q", got, want)
+	}
+}
+
+func TestReplacerClose(t *testing.T) {
+	re := MustCompile(`a`)
+	defer re.Close()
+	r, err := re.Replacer("b")
+	if err != nil {
+		t.Fatalf("Replacer: unexpected error: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if !re.MatchString("a") {
+		t.Errorf("closing the Replacer closed the Regexp")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("ReplaceAll after Close: expected panic")
+		}
+	}()
+	r.ReplaceAll("a")
+}
@@ -0,0 +1,266 @@
+package re2
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Set is a collection of regular expressions matched against a text together,
+// reporting which of them match, e.g., for rule sets of a firewall. Patterns are
+// added with Add and the Set is then compiled with Compile, after which it can be
+// used by multiple goroutines simultaneously.
+//
+// A Set uses the native set of re2, which matches all its patterns in one pass. If the
+// embedded libcre2 was built before it exported the set, or Options.MaxProgramSize is
+// set, which re2 cannot check for a set, a Set instead matches the alternation of all
+// its patterns, which decides in one pass whether any of them matches, and only then
+// matches the patterns individually.
+type Set struct {
+	opts Options
+
+	// abi and ptr hold the native set once the first pattern is added, with n patterns.
+	abi *libre2ABI
+	ptr uintptr
+	n   int
+
+	// Without a native set, exprs are matched with res after matching any.
+	fallback bool
+	exprs    []string
+	res      []*Regexp
+	any      *Regexp
+
+	compiled, failed bool
+}
+
+// NewSet returns an empty Set whose patterns are compiled with opts.
+// Options.Unsynchronized is ignored since a compiled Set can be used by multiple
+// goroutines simultaneously.
+func NewSet(opts Options) *Set {
+	opts.Unsynchronized = false
+	return &Set{opts: opts}
+}
+
+// Add adds the pattern to the Set, returning its index, which is reported by Match
+// when it matches, or an error if it does not compile. It cannot be called after
+// Compile.
+func (s *Set) Add(pattern string) (int, error) {
+	if s.compiled || s.failed {
+		return -1, errors.New("re2: Set.Add called after Compile")
+	}
+	if s.ptr == 0 && !s.fallback {
+		if err := s.newNative(); err != nil {
+			return -1, err
+		}
+	}
+	if s.fallback {
+		re, err := CompileWith(pattern, s.opts)
+		if err != nil {
+			return -1, err
+		}
+		s.exprs = append(s.exprs, pattern)
+		s.res = append(s.res, re)
+		return len(s.res) - 1, nil
+	}
+
+	s.abi.startOperation(len(pattern))
+	idx := setAdd(s.abi, s.ptr, newCString(s.abi, pattern))
+	s.abi.endOperation()
+	if idx < 0 {
+		// re2 only reports the message of the error, so compile the pattern alone for the
+		// same error as Compile.
+		re, err := CompileWith(pattern, s.opts)
+		if err != nil {
+			return -1, err
+		}
+		_ = re.Close()
+		return -1, fmt.Errorf("re2: failed to add %#q to Set", pattern)
+	}
+	s.n++
+	return idx, nil
+}
+
+// newNative creates the native set of re2 in a module, or falls back to matching
+// expressions individually if it is not supported.
+func (s *Set) newNative() error {
+	if s.opts.DotNL && s.opts.NeverNL {
+		return errors.New("re2: DotNL and NeverNL are mutually exclusive")
+	}
+	abi, err := acquireABI()
+	if err != nil {
+		return fmt.Errorf("re2: failed to instantiate module: %w", err)
+	}
+	if !setSupported(abi) || s.opts.MaxProgramSize > 0 {
+		releaseABI(abi)
+		s.fallback = true
+		return nil
+	}
+	if err := checkOptions(abi, s.opts); err != nil {
+		releaseABI(abi)
+		return err
+	}
+
+	abi.startOperation(0)
+	ptr := newSet(abi, s.opts)
+	abi.endOperation()
+	if ptr == 0 {
+		releaseABI(abi)
+		return errors.New("re2: out of memory creating Set")
+	}
+	s.abi, s.ptr = abi, ptr
+	runtime.SetFinalizer(s, (*Set).release)
+	return nil
+}
+
+// Compile prepares the Set for matching once all patterns are added, returning an
+// error if the combined patterns do not fit within Options.MaxMem. A Set that fails to
+// compile stays uncompiled, matching nothing, and cannot be compiled again.
+func (s *Set) Compile() error {
+	if s.compiled || s.failed {
+		return errors.New("re2: Set.Compile called more than once")
+	}
+	if err := s.compile(); err != nil {
+		s.failed = true
+		return err
+	}
+	s.compiled = true
+	return nil
+}
+
+func (s *Set) compile() error {
+	if s.ptr != 0 {
+		s.abi.startOperation(0)
+		defer s.abi.endOperation()
+		if !setCompile(s.abi, s.ptr) {
+			return errors.New("re2: Set does not fit within Options.MaxMem")
+		}
+		return nil
+	}
+
+	// An unterminated \Q would quote the parentheses around the pattern, so matching
+	// the alternation would not mean that any pattern matches.
+	for _, expr := range s.exprs {
+		if strings.Contains(expr, `\Q`) {
+			return nil
+		}
+	}
+	if len(s.exprs) < 2 {
+		return nil
+	}
+
+	opts := s.opts
+	var sb strings.Builder
+	for i, expr := range s.exprs {
+		if i > 0 {
+			sb.WriteByte('|')
+		}
+		if opts.Literal {
+			expr = QuoteMeta(expr)
+		}
+		sb.WriteString("(?:")
+		sb.WriteString(expr)
+		sb.WriteByte(')')
+	}
+	opts.Literal = false
+
+	re, err := CompileWith(sb.String(), opts)
+	if err != nil {
+		return err
+	}
+	s.any = re
+	return nil
+}
+
+// Match returns the indexes of the patterns in the Set that match text, in
+// increasing order, or nil if none match or the Set is not compiled.
+func (s *Set) Match(text string) []int {
+	if !s.compiled {
+		return nil
+	}
+	if s.ptr != 0 {
+		s.abi.startOperation(len(text) + 4*s.n)
+		matched := setMatch(s.abi, s.ptr, newCString(s.abi, text), s.n)
+		s.abi.endOperation()
+		if len(matched) == 0 {
+			return nil
+		}
+		sort.Ints(matched)
+		return matched
+	}
+	if s.any != nil && !s.any.MatchString(text) {
+		return nil
+	}
+
+	var matched []int
+	for i, re := range s.res {
+		if re.MatchString(text) {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+// Close releases the resources of the Set, as Regexp.Close. Using the Set after Close
+// panics.
+func (s *Set) Close() error {
+	if s.ptr != 0 {
+		if s.abi == nil {
+			return nil
+		}
+		runtime.SetFinalizer(s, nil)
+		abi := s.abi
+		s.abi = nil
+		return releaseSet(abi, s.ptr)
+	}
+	var err error
+	if s.any != nil {
+		err = s.any.Close()
+	}
+	for _, re := range s.res {
+		if closeErr := re.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *Set) release() {
+	if s.abi == nil {
+		return
+	}
+	abi := s.abi
+	s.abi = nil
+	// There is no one to report errors to when finalizing, Close returns them instead.
+	_ = releaseSet(abi, s.ptr)
+}
+
+// CompileLiteralSet compiles an expression matching any of words as literal text, e.g.,
+// for keyword scanners, escaping each with QuoteMeta so that they need no escaping by
+// hand. Among words starting at the same position, the longest one matches, regardless
+// of their order and of Options.Longest, so that with words ab and abc, abcd matches abc.
+// Options.Literal is ignored. It returns an error if words is empty.
+//
+// Unlike a Set, the result is a single expression, so that it also reports where the
+// words match.
+func CompileLiteralSet(words []string, opts Options) (*Regexp, error) {
+	if len(words) == 0 {
+		return nil, errors.New("re2: CompileLiteralSet called without words")
+	}
+
+	// Leftmost-first matching picks the first alternative that matches, so trying longer
+	// words first matches the longest.
+	sorted := append([]string(nil), words...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	var sb strings.Builder
+	for i, word := range sorted {
+		if i > 0 {
+			sb.WriteByte('|')
+		}
+		sb.WriteString(QuoteMeta(word))
+	}
+	opts.Literal = false
+	return CompileWith(sb.String(), opts)
+}
@@ -0,0 +1,222 @@
+package re2
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	patterns := []string{`foo`, `(?i)BAR`, `^baz$`, `\d{3}`, `a|b`, `\Qx.y`}
+	s := NewSet(Options{})
+	defer s.Close()
+	for i, p := range patterns {
+		idx, err := s.Add(p)
+		if err != nil {
+			t.Fatalf("Add(%#q): unexpected error: %v", p, err)
+		}
+		if idx != i {
+			t.Errorf("Add(%#q) = %d; want %d", p, idx, i)
+		}
+	}
+	if matched := s.Match("foo"); matched != nil {
+		t.Errorf("Match before Compile = %v; want nil", matched)
+	}
+	if err := s.Compile(); err != nil {
+		t.Fatalf("Compile: unexpected error: %v", err)
+	}
+
+	for _, text := range []string{"", "foo", "foobar", "Bar 123", "baz", "xbaz", "x.y", "xzy", "ccc"} {
+		var want []int
+		for i, p := range patterns {
+			if regexp.MustCompile(p).MatchString(text) {
+				want = append(want, i)
+			}
+		}
+		if got := s.Match(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("Match(%q) = %v; want %v", text, got, want)
+		}
+	}
+
+	if _, err := s.Add(`qux`); err == nil {
+		t.Errorf("Add after Compile: expected error")
+	}
+	if err := s.Compile(); err == nil {
+		t.Errorf("second Compile: expected error")
+	}
+}
+
+func TestSetNative(t *testing.T) {
+	s := NewSet(Options{})
+	defer s.Close()
+	// Enough patterns matching at once that their indexes need more memory than the text.
+	const n = 100
+	for i := 0; i < n; i++ {
+		p := fmt.Sprintf(`\w{0,%d}`, i)
+		if _, err := s.Add(p); err != nil {
+			t.Fatalf("Add(%#q): unexpected error: %v", p, err)
+		}
+	}
+	skipWithoutNativeSet(t, s)
+	if s.ptr == 0 {
+		t.Fatalf("Set does not use the native set of re2")
+	}
+	if err := s.Compile(); err != nil {
+		t.Fatalf("Compile: unexpected error: %v", err)
+	}
+
+	want := make([]int, n)
+	for i := range want {
+		want[i] = i
+	}
+	if got := s.Match("x"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Match(%q) = %v; want all %d patterns", "x", got, n)
+	}
+}
+
+// skipWithoutNativeSet skips the test if s, which has a pattern added, fell back to
+// matching its patterns individually because the embedded libcre2 does not export the
+// native set of re2.
+func skipWithoutNativeSet(t *testing.T, s *Set) {
+	t.Helper()
+	if s.fallback && s.opts.MaxProgramSize == 0 {
+		t.Skip("native set not supported by the embedded libcre2, which needs to be rebuilt to export cre2_set_*")
+	}
+}
+
+func TestSetPrefilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		patterns []string
+		text     string
+		want     []int
+	}{
+		{"flags are scoped to the pattern", Options{}, []string{`(?i)a`, `B`}, "b", nil},
+		{"literal", Options{Literal: true}, []string{`a.c`, `(d`}, "abc (d a.c", []int{0, 1}},
+		{"options", Options{CaseInsensitive: true}, []string{`abc`, `def`}, "DEF", []int{1}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewSet(tc.opts)
+			defer s.Close()
+			for _, p := range tc.patterns {
+				_, err := s.Add(p)
+				if errors.Is(err, errUnsupportedOption) {
+					t.Skip(err)
+				}
+				if err != nil {
+					t.Fatalf("Add(%#q): unexpected error: %v", p, err)
+				}
+			}
+			if err := s.Compile(); err != nil {
+				t.Fatalf("Compile: unexpected error: %v", err)
+			}
+			if s.ptr == 0 && s.any == nil {
+				t.Fatalf("neither a native set nor an alternation compiled for %q", tc.patterns)
+			}
+			if got := s.Match(tc.text); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Match(%q) = %v; want %v", tc.text, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetUnsynchronized(t *testing.T) {
+	s := NewSet(Options{Unsynchronized: true})
+	defer s.Close()
+	for _, p := range []string{`a+`, `b+`} {
+		if _, err := s.Add(p); err != nil {
+			t.Fatalf("Add(%#q): unexpected error: %v", p, err)
+		}
+	}
+	if err := s.Compile(); err != nil {
+		t.Fatalf("Compile: unexpected error: %v", err)
+	}
+	for _, re := range append(s.res, s.any) {
+		if re != nil && re.opts.Unsynchronized {
+			t.Errorf("%#q of the Set compiled with Unsynchronized", re)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := s.Match("aab"); !reflect.DeepEqual(got, []int{0, 1}) {
+					t.Errorf("Match(%q) = %v; want [0 1]", "aab", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSetAddError(t *testing.T) {
+	s := NewSet(Options{})
+	defer s.Close()
+	if _, err := s.Add(`a(`); err == nil {
+		t.Fatalf("Add(%#q): expected error", `a(`)
+	}
+	if idx, err := s.Add(`a`); err != nil || idx != 0 {
+		t.Errorf("Add(%#q) = %d, %v; want 0, nil", `a`, idx, err)
+	}
+}
+
+func TestSetCompileError(t *testing.T) {
+	// Each pattern fits within MaxMem, but not all of them together.
+	s := NewSet(Options{MaxMem: 1 << 17})
+	defer s.Close()
+	for i := 0; i < 80; i++ {
+		p := fmt.Sprintf(`%d\pL{4}`, i)
+		if _, err := s.Add(p); err != nil {
+			t.Fatalf("Add(%#q): unexpected error: %v", p, err)
+		}
+	}
+	if err := s.Compile(); err == nil {
+		t.Fatalf("Compile: expected error")
+	}
+	if matched := s.Match("1a"); matched != nil {
+		t.Errorf("Match after failed Compile = %v; want nil", matched)
+	}
+	if err := s.Compile(); err == nil {
+		t.Errorf("Compile after failed Compile: expected error")
+	}
+	if _, err := s.Add(`a`); err == nil {
+		t.Errorf("Add after failed Compile: expected error")
+	}
+}
+
+func TestCompileLiteralSet(t *testing.T) {
+	tests := []struct {
+		words []string
+		opts  Options
+		text  string
+		want  []string
+	}{
+		{[]string{"ab", "abc"}, Options{}, "abcd ab", []string{"abc", "ab"}},
+		{[]string{"abc", "ab"}, Options{}, "abcd ab", []string{"abc", "ab"}},
+		{[]string{"a.b", "(c", "x*"}, Options{}, "a.b axb (c xx x*", []string{"a.b", "(c", "x*"}},
+		{[]string{"Foo"}, Options{CaseInsensitive: true}, "foo FOO", []string{"foo", "FOO"}},
+		{[]string{"a|b"}, Options{Literal: true}, "a a|b", []string{"a|b"}},
+	}
+	for _, tc := range tests {
+		re, err := CompileLiteralSet(tc.words, tc.opts)
+		if err != nil {
+			t.Fatalf("CompileLiteralSet(%q): unexpected error: %v", tc.words, err)
+		}
+		if got := re.FindAllString(tc.text, -1); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("CompileLiteralSet(%q).FindAllString(%q) = %q; want %q", tc.words, tc.text, got, tc.want)
+		}
+	}
+
+	if _, err := CompileLiteralSet(nil, Options{}); err == nil {
+		t.Errorf("CompileLiteralSet(nil): expected error")
+	}
+}
@@ -0,0 +1,67 @@
+package re2
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Source matches a Regexp against ranges of a single large text, e.g., lines of a log
+// file read in full, without copying each range into the memory of the WebAssembly
+// module as matching slices of the text would. The text is copied once when creating
+// the Source, into a module of its own holding an instance of the expression, so
+// matching never waits for other expressions. With cgo, the text is matched in place
+// and must not be modified while the Source is in use.
+//
+// A Source can be used by multiple goroutines simultaneously, though their matches wait
+// for each other, and must be closed with Close when no longer needed, though its
+// resources are also released when it is garbage collected.
+type Source struct {
+	re   *Regexp
+	text cString
+	// b keeps the text alive when it is matched in place.
+	b []byte
+}
+
+// NewSource returns a new Source for matching the expression against ranges of b,
+// returning an error if it cannot be compiled into a module of its own or b does not fit
+// in its memory.
+func (re *Regexp) NewSource(b []byte) (*Source, error) {
+	inst, err := re.newPrivateInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	inst.abi.startOperation(0)
+	text, err := newSourceText(inst.abi, b)
+	inst.abi.endOperation()
+	if err != nil {
+		_ = inst.Close()
+		return nil, err
+	}
+	return &Source{re: inst, text: text, b: b}, nil
+}
+
+// Len returns the length in bytes of the text of the Source.
+func (s *Source) Len() int {
+	return s.text.length
+}
+
+// MatchRange reports whether the text of the Source from byte offset start up to end
+// contains any match of the expression, as Regexp.Match on the same slice of the text.
+// It panics if the range is not within the text, like slicing it would.
+func (s *Source) MatchRange(start, end int) bool {
+	if start < 0 || end < start || end > s.text.length {
+		panic(fmt.Sprintf("re2: range [%d:%d] out of bounds for source of %d bytes", start, end, s.text.length))
+	}
+	s.re.abi.startOperation(0)
+	defer s.re.endOperation()
+
+	res := match(s.re, cString{ptr: s.text.ptr + uintptr(start), length: end - start}, 0, 0)
+	runtime.KeepAlive(s.b)
+	return res
+}
+
+// Close releases the module of the Source. Using the Source after Close panics.
+func (s *Source) Close() error {
+	return s.re.Close()
+}
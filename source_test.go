@@ -0,0 +1,67 @@
+package re2
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	expr := `^\w+@\w+\.com$|\bERROR\b`
+	text := []byte("a@b.com\nINFO ok\nERRORS\nERROR\n")
+	re := MustCompile(expr)
+	defer re.Close()
+	std := regexp.MustCompile(expr)
+
+	src, err := re.NewSource(text)
+	if err != nil {
+		t.Fatalf("NewSource: unexpected error: %v", err)
+	}
+	defer src.Close()
+	if src.Len() != len(text) {
+		t.Errorf("Len() = %d; want %d", src.Len(), len(text))
+	}
+
+	// The text outside of the range is not considered, so ^ and \b match at its ends.
+	for start := 0; start <= len(text); start++ {
+		for end := start; end <= len(text); end++ {
+			if got, want := src.MatchRange(start, end), std.Match(text[start:end]); got != want {
+				t.Errorf("MatchRange(%d, %d) of %q = %v; want %v", start, end, text[start:end], got, want)
+			}
+		}
+	}
+
+	for _, r := range [][2]int{{-1, 1}, {2, 1}, {0, len(text) + 1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("MatchRange(%d, %d): expected panic", r[0], r[1])
+				}
+			}()
+			src.MatchRange(r[0], r[1])
+		}()
+	}
+}
+
+func TestSourceClose(t *testing.T) {
+	re := MustCompile(`a`)
+	defer re.Close()
+	src, err := re.NewSource(nil)
+	if err != nil {
+		t.Fatalf("NewSource: unexpected error: %v", err)
+	}
+	if src.MatchRange(0, 0) {
+		t.Errorf("MatchRange(0, 0) of empty source = true; want false")
+	}
+	if err := src.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if !re.MatchString("a") {
+		t.Errorf("closing the Source closed the Regexp")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MatchRange after Close: expected panic")
+		}
+	}()
+	src.MatchRange(0, 0)
+}